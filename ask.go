@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"opml-opt/common"
+	"opml-opt/rpc"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	cli "gopkg.in/urfave/cli.v1"
+)
+
+var (
+	urlFlag = cli.StringFlag{
+		Name:  "url",
+		Usage: "url of the operator",
+		Value: "http://127.0.0.1:1234",
+	}
+	modelFlag = cli.StringFlag{
+		Name:  "model",
+		Usage: "model to ask, the default one of the operator if empty",
+	}
+	imageFlag = cli.StringFlag{
+		Name:  "image",
+		Usage: "file of the 28x28 grayscale image to classify, for mnist models",
+	}
+	listenFlag = cli.StringFlag{
+		Name:  "listen",
+		Usage: "address of the callback receiver",
+		Value: "127.0.0.1:0",
+	}
+	callbackURLFlag = cli.StringFlag{
+		Name:  "callback-url",
+		Usage: "callback url sent to the operator, http://<listen address>/callback if empty",
+	}
+	timeoutFlag = cli.DurationFlag{
+		Name:  "timeout",
+		Usage: "time to wait for the callback",
+		Value: 30 * time.Minute,
+	}
+	jsonFlag = cli.BoolFlag{
+		Name:  "json",
+		Usage: "print the result as json",
+	}
+)
+
+var commandAsk = cli.Command{
+	Name:  "ask",
+	Usage: "ask an operator a question and wait for its callback",
+	Flags: []cli.Flag{
+		urlFlag,
+		promptFlag,
+		modelFlag,
+		imageFlag,
+		listenFlag,
+		callbackURLFlag,
+		timeoutFlag,
+		jsonFlag,
+	},
+	Action: RunAsk,
+}
+
+type AskOptions struct {
+	URL    string
+	Model  string
+	Prompt string
+	Image  []byte
+	// the callback receiver listens on Listen, the operator posts to CallbackURL
+	Listen      string
+	CallbackURL string
+	Timeout     time.Duration
+}
+
+// AskResult is the callback of the operator, with the time to accept the question and
+// the time to the callback
+type AskResult struct {
+	common.CallbackReq
+	SubmitMs int64 `json:"submit_ms"`
+	TotalMs  int64 `json:"total_ms"`
+}
+
+// Ask posts a question to the operator and waits for its callback on a temporary receiver
+func Ask(opts AskOptions) (*AskResult, error) {
+	ln, err := net.Listen("tcp", opts.Listen)
+	if err != nil {
+		return nil, err
+	}
+	reqId := uuid.NewString()
+	done := make(chan common.CallbackReq, 1)
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var cb common.CallbackReq
+		if err := json.NewDecoder(r.Body).Decode(&cb); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if cb.ReqId != reqId {
+			http.Error(w, "unknown req_id", http.StatusNotFound)
+			return
+		}
+		select {
+		case done <- cb:
+		default:
+		}
+	})}
+	go srv.Serve(ln)
+	defer srv.Shutdown(context.Background())
+
+	callbackURL := opts.CallbackURL
+	if callbackURL == "" {
+		callbackURL = fmt.Sprintf("http://%s/callback", ln.Addr())
+	}
+	body, _ := json.Marshal(&rpc.QuestionReq{
+		Prompt:   opts.Prompt,
+		Model:    opts.Model,
+		CallBack: callbackURL,
+		ReqId:    reqId,
+		Image:    opts.Image,
+	})
+	start := time.Now()
+	resp, err := http.Post(strings.TrimSuffix(opts.URL, "/")+"/api/v1/question", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var rep rpc.Resp
+	if err := json.NewDecoder(resp.Body).Decode(&rep); err != nil {
+		return nil, fmt.Errorf("question response: %w", err)
+	}
+	if rep.ResultCode != rpc.Success {
+		return nil, fmt.Errorf("question rejected with code %d: %s", rep.ResultCode, rep.ResultMsg)
+	}
+	submit := time.Since(start)
+
+	select {
+	case cb := <-done:
+		if cb.Error != "" {
+			return nil, fmt.Errorf("job %s failed with code %d: %s", reqId, cb.Code, cb.Error)
+		}
+		return &AskResult{
+			CallbackReq: cb,
+			SubmitMs:    submit.Milliseconds(),
+			TotalMs:     time.Since(start).Milliseconds(),
+		}, nil
+	case <-time.After(opts.Timeout):
+		return nil, fmt.Errorf("no callback for %s after %s", reqId, opts.Timeout)
+	}
+}
+
+func RunAsk(ctx *cli.Context) error {
+	opts := AskOptions{
+		URL:         ctx.String(urlFlag.Name),
+		Model:       ctx.String(modelFlag.Name),
+		Prompt:      ctx.String(promptFlag.Name),
+		Listen:      ctx.String(listenFlag.Name),
+		CallbackURL: ctx.String(callbackURLFlag.Name),
+		Timeout:     ctx.Duration(timeoutFlag.Name),
+	}
+	if fn := ctx.String(imageFlag.Name); fn != "" {
+		image, err := os.ReadFile(fn)
+		if err != nil {
+			return err
+		}
+		opts.Image = image
+		// the prompt flag has a default, an image is the whole question
+		if !ctx.IsSet(promptFlag.Name) {
+			opts.Prompt = ""
+		}
+	}
+	result, err := Ask(opts)
+	if err != nil {
+		return err
+	}
+	if ctx.Bool(jsonFlag.Name) {
+		return json.NewEncoder(os.Stdout).Encode(result)
+	}
+	fmt.Println("req_id:", result.ReqId)
+	fmt.Println("node_id:", result.NodeId)
+	fmt.Println("model:", result.Model)
+	fmt.Printf("answer: %q (%s)\n", result.Answer, result.AnswerBackend)
+	if result.Consistent != nil {
+		fmt.Println("consistent:", *result.Consistent)
+	}
+	fmt.Println("state_root:", result.StateRoot)
+	if result.TranscriptRoot != "" {
+		fmt.Println("transcript_root:", result.TranscriptRoot)
+	}
+	fmt.Println("submit:", time.Duration(result.SubmitMs)*time.Millisecond)
+	fmt.Println("total:", time.Duration(result.TotalMs)*time.Millisecond)
+	return nil
+}
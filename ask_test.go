@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"opml-opt/callback"
+	"opml-opt/common"
+	"opml-opt/rpc"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeOperator accepts the questions and calls back with answer, or fails the job with
+// jobErr if not empty
+func fakeOperator(t *testing.T, answer string, jobErr string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req rpc.QuestionReq
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || r.URL.Path != "/api/v1/question" {
+			json.NewEncoder(w).Encode(rpc.Resp{ResultCode: rpc.ErrorCodeUnmarshal, ResultMsg: "bad request"})
+			return
+		}
+		json.NewEncoder(w).Encode(rpc.Resp{ResultCode: rpc.Success})
+		go func() {
+			cb := common.CallbackReq{Code: common.CODE_SUCCESS, ReqId: req.ReqId, Model: "llama", Prompt: req.Prompt, Answer: answer, StateRoot: "0x01"}
+			if jobErr != "" {
+				cb = common.CallbackReq{Code: common.CODE_JOB_FAILED, Error: jobErr, ReqId: req.ReqId, Model: "llama", Prompt: req.Prompt}
+			}
+			body, _ := json.Marshal(&cb)
+			if _, err := callback.DoPost(req.CallBack, string(body), time.Second); err != nil {
+				t.Error(err)
+			}
+		}()
+	}))
+}
+
+func TestAsk(t *testing.T) {
+	operator := fakeOperator(t, "Hello", "")
+	defer operator.Close()
+	result, err := Ask(AskOptions{URL: operator.URL, Prompt: "hi", Listen: "127.0.0.1:0", Timeout: 5 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Answer != "Hello" || result.StateRoot != "0x01" || result.Prompt != "hi" || result.TotalMs < result.SubmitMs {
+		t.Fatalf("got %+v", result)
+	}
+
+	// failed job, before the timeout
+	failing := fakeOperator(t, "", "mips run failed")
+	defer failing.Close()
+	start := time.Now()
+	_, err = Ask(AskOptions{URL: failing.URL, Prompt: "hi", Listen: "127.0.0.1:0", Timeout: time.Minute})
+	if err == nil || !strings.Contains(err.Error(), "mips run failed") || time.Since(start) > 10*time.Second {
+		t.Fatalf("got %v after %s", err, time.Since(start))
+	}
+
+	// no callback
+	silent := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(rpc.Resp{ResultCode: rpc.Success})
+	}))
+	defer silent.Close()
+	if _, err := Ask(AskOptions{URL: silent.URL, Listen: "127.0.0.1:0", Timeout: 10 * time.Millisecond}); err == nil {
+		t.Fatal("expected a timeout")
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"opml-opt/mips"
+	"opml-opt/models"
+	"os"
+	"strings"
+
+	cli "gopkg.in/urfave/cli.v1"
+)
+
+var (
+	promptsFlag = cli.StringFlag{
+		Name:  "prompts",
+		Usage: "file of the prompts to bench, a prompt a line, over --prompt",
+	}
+	runsFlag = cli.IntFlag{
+		Name:  "runs",
+		Usage: "times to run every prompt",
+		Value: 1,
+	}
+	phasesFlag = cli.StringFlag{
+		Name:  "phases",
+		Usage: "phases to run, of " + strings.Join(mips.BenchPhases, ", "),
+		Value: strings.Join(mips.BenchPhases, ","),
+	}
+	outFlag = cli.StringFlag{
+		Name:  "out",
+		Usage: "file of the json report, stdout if empty",
+	}
+)
+
+var commandBench = cli.Command{
+	Name:  "bench",
+	Usage: "time prompts through llama.cpp, the mlgo graph and the mips program",
+	Description: `Every prompt runs --runs times through the phases, one after the other. The json report
+has the latency percentiles of each phase, the peak rss and, by run, the trie preimages and
+the size of the golden checkpoint.`,
+	Flags: []cli.Flag{
+		configPathFlag,
+		setFlag,
+		modelFlag,
+		promptFlag,
+		promptsFlag,
+		runsFlag,
+		phasesFlag,
+		outFlag,
+	},
+	Action: RunBench,
+}
+
+// readPrompts reads a prompt a line, skipping empty lines
+func readPrompts(fn string) ([]string, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var prompts []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			prompts = append(prompts, line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(prompts) == 0 {
+		return nil, fmt.Errorf("no prompt in %s", fn)
+	}
+	return prompts, nil
+}
+
+func RunBench(ctx *cli.Context) error {
+	prompts := []string{ctx.String(promptFlag.Name)}
+	if fn := ctx.String(promptsFlag.Name); fn != "" {
+		var err error
+		if prompts, err = readPrompts(fn); err != nil {
+			return err
+		}
+	}
+	runs := ctx.Int(runsFlag.Name)
+	if runs < 1 {
+		return fmt.Errorf("--runs %d is not a count of runs", runs)
+	}
+	phases := strings.Split(ctx.String(phasesFlag.Name), ",")
+	if err := mips.CheckPhases(phases); err != nil {
+		return err
+	}
+
+	conf := loadConfig(ctx)
+	registry, err := models.NewRegistry(conf.ModelList())
+	if err != nil {
+		return err
+	}
+	model, err := registry.Get(ctx.String(modelFlag.Name))
+	if err != nil {
+		return err
+	}
+	if err := mips.InitWorker(conf.ModelName, conf.VMConfig(), 1); err != nil {
+		return err
+	}
+	// the vm prints its progress to stdout, keep it for the report
+	stdout := os.Stdout
+	os.Stdout = os.Stderr
+	report, err := mips.Bench(model, prompts, runs, phases)
+	os.Stdout = stdout
+	if err != nil {
+		return err
+	}
+
+	out := os.Stdout
+	if fn := ctx.String(outFlag.Name); fn != "" {
+		f, err := os.Create(fn)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out = f
+	}
+	enc := json.NewEncoder(out)
+	enc.SetIndent("", "  ")
+	return enc.Encode(report)
+}
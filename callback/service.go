@@ -27,25 +27,45 @@ func init() {
 	IsBusy = false
 }
 
+// Finish completes the work of a question before its callback, set by the mips worker to
+// check the answer against the mlgo one and commit its transcript
+var Finish func(qa *common.OptQA) error
+
 func (c *CallBackService) callBack(qa common.OptQA) {
-	log.Debugf("work done \n%v\n", qa)
+	job := log.With(log.Fields{ReqId: qa.ReqId, Phase: "callback"})
+	if qa.Err == nil && Finish != nil {
+		qa.Err = Finish(&qa)
+	}
+	job.Debugf("work done, model %s, state root %s, answer of %s", qa.Model, qa.StateRoot, qa.AnswerBackend)
 	IsBusy = false
+	code, errMsg := common.CODE_SUCCESS, ""
+	if qa.Err != nil {
+		code, errMsg = common.CODE_JOB_FAILED, qa.Err.Error()
+		job.Warn("job failed", qa.Err)
+	}
 	reqBody, _ := json.Marshal(&common.CallbackReq{
+		Code:      code,
+		Error:     errMsg,
 		NodeId:    common.NodeID,
 		ReqId:     qa.ReqId,
 		Model:     qa.Model,
 		Prompt:    qa.Prompt,
 		Answer:    qa.Answer,
 		StateRoot: qa.StateRoot,
+
+		AnswerBackend: qa.AnswerBackend,
+		Consistent:    qa.Consistent,
+
+		TranscriptRoot: qa.TranscriptRoot,
 	})
 	_, err := DoPost(qa.CallBack, string(reqBody), CALLBACK_TIMEOUT)
 	if err != nil {
-		log.Errorf("callback post error\n %v \n %v \n %v\n", qa.CallBack, string(reqBody), err)
+		job.Errorf("callback post error %v: %v, body %s", qa.CallBack, err, reqBody)
 	}
 }
 
 func DoneWork(qa common.OptQA) {
-	log.Debugf("done work %v", qa)
+	log.With(log.Fields{ReqId: qa.ReqId}).Debugf("done work, state root %q, answer %q, error %v", qa.StateRoot, qa.Answer, qa.Err)
 	CallBack.mu.Lock()
 	defer CallBack.mu.Unlock()
 	if qa.CallBack == "" {
@@ -57,14 +77,34 @@ func DoneWork(qa common.OptQA) {
 	qaExit, ok := CallBack.MipsWorks[qa.ReqId]
 	if !ok {
 		qaExit = qa
+	} else if qaExit.Err != nil {
+		// called back with the error of the other worker
+		return
 	}
-	if qa.Answer != "" {
+	if qa.Err != nil {
+		qaExit.Err = qa.Err
+	}
+	// the mlgo answer is final even if empty
+	if qa.Answer != "" || qa.AnswerBackend == common.BACKEND_MLGO {
 		qaExit.Answer = qa.Answer
+		qaExit.AnswerBackend = qa.AnswerBackend
+	}
+	if qa.MlgoAnswer != "" {
+		qaExit.MlgoAnswer = qa.MlgoAnswer
 	}
 	if qa.StateRoot != "" {
 		qaExit.StateRoot = qa.StateRoot
+		qaExit.ModelPath = qa.ModelPath
+		qaExit.PromptTokens = qa.PromptTokens
+		qaExit.MlgoTokens = qa.MlgoTokens
+		qaExit.NodeRoots = qa.NodeRoots
 	}
 	CallBack.MipsWorks[qa.ReqId] = qaExit
+	if qaExit.Err != nil {
+		// kept to drop the result of the other worker, see Forget
+		go CallBack.callBack(qaExit)
+		return
+	}
 	if qaExit.Done() {
 		delete(CallBack.MipsWorks, qa.ReqId)
 		// db.InsertSingleConversation(qaExit)
@@ -72,6 +112,13 @@ func DoneWork(qa common.OptQA) {
 	}
 }
 
+// Forget drops the work of a question once all its workers are done
+func Forget(reqId string) {
+	CallBack.mu.Lock()
+	defer CallBack.mu.Unlock()
+	delete(CallBack.MipsWorks, reqId)
+}
+
 func DoPost(requrl, body string, timeoutS time.Duration) (*http.Response, error) {
 	req, err := http.NewRequest("POST", requrl, bytes.NewBufferString(body))
 	if err != nil {
@@ -0,0 +1,79 @@
+package callback
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"opml-opt/common"
+	"opml-opt/log"
+	"testing"
+	"time"
+)
+
+func TestDoneWorkFailed(t *testing.T) {
+	log.InitLog(log.InfoLog)
+	posts := make(chan common.CallbackReq, 4)
+	dispatcher := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var cb common.CallbackReq
+		if err := json.NewDecoder(r.Body).Decode(&cb); err != nil {
+			t.Error(err)
+		}
+		posts <- cb
+	}))
+	defer dispatcher.Close()
+
+	qa := common.OptQA{ReqId: "req", Model: "llama", Prompt: "hi", CallBack: dispatcher.URL}
+	failed := qa
+	failed.Err = errors.New("mips run failed")
+	DoneWork(failed)
+	select {
+	case cb := <-posts:
+		if cb.Code != common.CODE_JOB_FAILED || cb.Error != "mips run failed" || cb.ReqId != "req" {
+			t.Fatalf("got %+v", cb)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("failed job not called back")
+	}
+
+	// the answer of the other worker is dropped
+	answered := qa
+	answered.Answer = "hello"
+	DoneWork(answered)
+	select {
+	case cb := <-posts:
+		t.Fatalf("called back twice: %+v", cb)
+	case <-time.After(50 * time.Millisecond):
+	}
+	Forget("req")
+	if _, ok := CallBack.MipsWorks["req"]; ok {
+		t.Error("work of the question not forgotten")
+	}
+}
+
+func TestDoneWorkEmptyMlgoAnswer(t *testing.T) {
+	log.InitLog(log.InfoLog)
+	posts := make(chan common.CallbackReq, 4)
+	dispatcher := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var cb common.CallbackReq
+		if err := json.NewDecoder(r.Body).Decode(&cb); err != nil {
+			t.Error(err)
+		}
+		posts <- cb
+	}))
+	defer dispatcher.Close()
+
+	// the graph ended the text at its first token
+	DoneWork(common.OptQA{ReqId: "empty", Model: "llama", Prompt: "hi", CallBack: dispatcher.URL, StateRoot: "0x01", AnswerBackend: common.BACKEND_MLGO})
+	select {
+	case cb := <-posts:
+		if cb.Code != common.CODE_SUCCESS || cb.Answer != "" || cb.AnswerBackend != common.BACKEND_MLGO || cb.StateRoot != "0x01" {
+			t.Fatalf("got %+v", cb)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("empty mlgo answer not called back")
+	}
+	if _, ok := CallBack.MipsWorks["empty"]; ok {
+		t.Error("work of the question kept")
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"fmt"
+	"opml-opt/mips/vm"
+	"os"
+	"strconv"
+
+	"github.com/ethereum/go-ethereum/oracle"
+	cli "gopkg.in/urfave/cli.v1"
+)
+
+var (
+	addrFlag = cli.StringFlag{
+		Name:  "addr",
+		Usage: "address of the first word to dump",
+		Value: "0x20000000",
+	}
+	lenFlag = cli.StringFlag{
+		Name:  "len",
+		Usage: "bytes to dump",
+		Value: "256",
+	}
+)
+
+var commandCheckpoint = cli.Command{
+	Name:  "checkpoint",
+	Usage: "inspect binary or json checkpoints",
+	Subcommands: []cli.Command{
+		{
+			Name:      "info",
+			Usage:     "print the root, step, node and size of a checkpoint",
+			ArgsUsage: "<checkpoint>",
+			Action:    CheckpointInfo,
+		},
+		{
+			Name:      "regs",
+			Usage:     "print the registers of a checkpoint",
+			ArgsUsage: "<checkpoint>",
+			Action:    CheckpointRegs,
+		},
+		{
+			Name:      "mem",
+			Usage:     "dump a memory range of a checkpoint",
+			ArgsUsage: "<checkpoint>",
+			Flags:     []cli.Flag{addrFlag, lenFlag},
+			Action:    CheckpointMem,
+		},
+		{
+			Name:      "diff",
+			Usage:     "list the words that differ between two checkpoints",
+			ArgsUsage: "<checkpoint> <checkpoint>",
+			Action:    CheckpointDiff,
+		},
+	},
+}
+
+func checkpointArgs(ctx *cli.Context, n int) ([]string, error) {
+	if ctx.NArg() != n {
+		return nil, fmt.Errorf("%s takes %d checkpoint files", ctx.Command.Name, n)
+	}
+	return ctx.Args(), nil
+}
+
+// checkpointRams rebuilds the ram of checkpoint files. The oracle writes every trie node it
+// reads under its root, a temporary directory here rather than the basedir of the runs.
+func checkpointRams(fns ...string) ([]*vm.Checkpoint, []map[uint32](uint32), error) {
+	dir, err := os.MkdirTemp("", "opml-checkpoint")
+	if err != nil {
+		return nil, nil, err
+	}
+	defer os.RemoveAll(dir)
+	oracle.SetRoot(dir)
+	var cs []*vm.Checkpoint
+	var rams []map[uint32](uint32)
+	for _, fn := range fns {
+		c, ram, err := vm.CheckpointRam(fn)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %w", fn, err)
+		}
+		cs = append(cs, c)
+		rams = append(rams, ram)
+	}
+	return cs, rams, nil
+}
+
+func CheckpointInfo(ctx *cli.Context) error {
+	args, err := checkpointArgs(ctx, 1)
+	if err != nil {
+		return err
+	}
+	fi, err := os.Stat(args[0])
+	if err != nil {
+		return err
+	}
+	c, err := vm.ReadCheckpoint(args[0])
+	if err != nil {
+		return err
+	}
+	fmt.Println("root:", c.Root.Hex())
+	fmt.Println("step:", c.Step)
+	fmt.Printf("node: %d of %d\n", c.NodeID, c.NodeCount)
+	fmt.Println("program:", c.ProgramHash.Hex())
+	fmt.Printf("preimages: %d, %d bytes\n", len(c.Preimages), c.PreimageSize())
+	fmt.Printf("size: %d bytes\n", fi.Size())
+	return nil
+}
+
+func CheckpointRegs(ctx *cli.Context) error {
+	args, err := checkpointArgs(ctx, 1)
+	if err != nil {
+		return err
+	}
+	cs, rams, err := checkpointRams(args[0])
+	if err != nil {
+		return err
+	}
+	regs := vm.RegistersFromRam(rams[0])
+	fmt.Printf("pc   %08x  hi   %08x  lo   %08x  heap %08x\n", regs.PC, regs.HI, regs.LO, regs.Heap)
+	// not recorded before the checkpoint version 2
+	if cs[0].NextPC != 0 {
+		fmt.Printf("next %08x\n", cs[0].NextPC)
+	}
+	for i, reg := range regs.GPR {
+		fmt.Printf("%-4s %08x", vm.REG_NAMES[i], reg)
+		if i%4 == 3 {
+			fmt.Println()
+		} else {
+			fmt.Print("  ")
+		}
+	}
+	return nil
+}
+
+func CheckpointMem(ctx *cli.Context) error {
+	args, err := checkpointArgs(ctx, 1)
+	if err != nil {
+		return err
+	}
+	addr, err := strconv.ParseUint(ctx.String(addrFlag.Name), 0, 32)
+	if err != nil {
+		return fmt.Errorf("--addr: %w", err)
+	}
+	size, err := strconv.ParseUint(ctx.String(lenFlag.Name), 0, 32)
+	if err != nil {
+		return fmt.Errorf("--len: %w", err)
+	}
+	_, rams, err := checkpointRams(args[0])
+	if err != nil {
+		return err
+	}
+	ram := rams[0]
+	// whole words, 4 a line
+	start := uint32(addr) &^ 3
+	end := uint64(addr) + size
+	for a := uint64(start); a < end; a += 4 {
+		if (a-uint64(start))%16 == 0 {
+			if a != uint64(start) {
+				fmt.Println()
+			}
+			fmt.Printf("%08x:", a)
+		}
+		fmt.Printf(" %08x", ram[uint32(a)])
+	}
+	fmt.Println()
+	return nil
+}
+
+func CheckpointDiff(ctx *cli.Context) error {
+	args, err := checkpointArgs(ctx, 2)
+	if err != nil {
+		return err
+	}
+	cs, rams, err := checkpointRams(args...)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("steps %d -> %d\n", cs[0].Step, cs[1].Step)
+	diffs := vm.DiffRam(rams[0], rams[1])
+	for _, d := range diffs {
+		fmt.Printf("%08x: %08x -> %08x", d.Addr, d.A, d.B)
+		if name := vm.RegName(d.Addr); name != "" {
+			fmt.Print(" ", name)
+		}
+		fmt.Println()
+	}
+	fmt.Printf("%d words differ\n", len(diffs))
+	return nil
+}
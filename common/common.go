@@ -2,7 +2,9 @@ package common
 
 import (
 	"errors"
+	"fmt"
 
+	ethcommon "github.com/ethereum/go-ethereum/common"
 	"github.com/google/uuid"
 )
 
@@ -21,6 +23,48 @@ func init() {
 //     "state_root": "0x130b06b347409671f3125f3c21b7fbeb720aba7bd2a8bd1b102634750a111686"
 // }
 
+// answer modes, which backend answers and whether the llama.cpp answer is checked against
+// the mlgo graph whose state root is committed
+const (
+	ANSWER_LLAMACPP = "llamacpp" // llama.cpp answers, unchecked
+	ANSWER_MLGO     = "mlgo"     // the next token of the mlgo graph answers
+	ANSWER_CHECK    = "check"    // llama.cpp answers, flagged when it disagrees with the mlgo graph
+	ANSWER_STRICT   = "strict"   // llama.cpp answers, replaced by the mlgo answer when they disagree
+)
+
+// backends recorded in the callback
+const (
+	BACKEND_LLAMACPP = "llama.cpp"
+	BACKEND_MLGO     = "mlgo"
+)
+
+var AnswerMode = ANSWER_LLAMACPP
+
+func SetAnswerMode(mode string) error {
+	if err := CheckAnswerMode(mode); err != nil {
+		return err
+	}
+	if mode == "" {
+		mode = ANSWER_LLAMACPP
+	}
+	AnswerMode = mode
+	return nil
+}
+
+// CheckAnswerMode checks mode is an answer mode, empty for llamacpp
+func CheckAnswerMode(mode string) error {
+	switch mode {
+	case "", ANSWER_LLAMACPP, ANSWER_MLGO, ANSWER_CHECK, ANSWER_STRICT:
+		return nil
+	}
+	return fmt.Errorf("unknown answer mode %s", mode)
+}
+
+// MlgoAnswerNeeded tells if the mips worker computes the answer of the mlgo graph
+func MlgoAnswerNeeded() bool {
+	return AnswerMode != ANSWER_LLAMACPP
+}
+
 var (
 	ErrExceedMaxJobs = errors.New("LlamaWorker exceed max jobs")
 	ErrJobDownUnknow = errors.New("worker job error unknown")
@@ -35,17 +79,84 @@ type OptQA struct {
 	StartTime int64  `json:"startTime" bson:"startTime"`
 	CallBack  string `json:"callback"`
 	Err       error  `json:"-" bson:"-"`
+	// backend of Answer, the next token of the mlgo graph and whether Answer agrees with it
+	AnswerBackend string `json:"answer_backend" bson:"answerBackend"`
+	MlgoAnswer    string `json:"mlgo_answer" bson:"mlgoAnswer"`
+	Consistent    *bool  `json:"consistent,omitempty" bson:"consistent,omitempty"`
+	// root of the committed transcript of the inference, if enabled
+	TranscriptRoot string `json:"transcript_root,omitempty" bson:"transcriptRoot,omitempty"`
+	// image classified by an mnist model
+	Image []byte `json:"image,omitempty" bson:"image,omitempty"`
+	// set by the mips worker to commit the transcript of the answer: the model, the tokens
+	// of the prompt and of the mlgo answer and the final roots of the graph nodes
+	ModelPath    string           `json:"-" bson:"-"`
+	PromptTokens []uint32         `json:"-" bson:"-"`
+	MlgoTokens   []uint32         `json:"-" bson:"-"`
+	NodeRoots    []ethcommon.Hash `json:"-" bson:"-"`
 }
 
+// codes of the callbacks, a failed job is called back with its error
+const (
+	CODE_SUCCESS    = 200
+	CODE_JOB_FAILED = -509
+)
+
 type CallbackReq struct {
+	// CODE_SUCCESS, or CODE_JOB_FAILED with the error of the job
+	Code      int    `json:"code"`
+	Error     string `json:"error,omitempty"`
 	NodeId    string `json:"node_id"`
 	ReqId     string `json:"req_id"`
 	Model     string `json:"model"`
 	Prompt    string `json:"prompt"`
 	Answer    string `json:"answer"`
 	StateRoot string `json:"state_root"`
+	// llama.cpp or mlgo, consistent is only set when the answer is checked
+	AnswerBackend string `json:"answer_backend"`
+	Consistent    *bool  `json:"consistent,omitempty"`
+	// merkle root of the prompt tokens, generated tokens, node count and final node roots
+	TranscriptRoot string `json:"transcript_root,omitempty"`
 }
 
+// Done tells if the question is answered, or failed. The mlgo answer can be empty, when the
+// graph ends the text first, it is given with the state root by the mips worker.
 func (qa *OptQA) Done() bool {
-	return qa.ReqId != "" && qa.Model != "" && qa.Answer != "" && qa.StateRoot != "" && qa.CallBack != ""
+	if qa.Err != nil {
+		return true
+	}
+	answered := qa.Answer != "" || qa.AnswerBackend == BACKEND_MLGO
+	return qa.ReqId != "" && qa.Model != "" && answered && qa.StateRoot != "" && qa.CallBack != ""
+}
+
+// AnswerChecked tells if the llama.cpp answers are compared with the mlgo ones
+func AnswerChecked() bool {
+	return AnswerMode == ANSWER_CHECK || AnswerMode == ANSWER_STRICT
+}
+
+// CheckAnswer compares the tokens of the llama.cpp answer with the mlgo ones in the check
+// modes, a disagreeing answer is replaced by the mlgo one in strict mode
+func (qa *OptQA) CheckAnswer(tokens []uint32) {
+	if !AnswerChecked() || qa.AnswerBackend != BACKEND_LLAMACPP {
+		return
+	}
+	consistent := AnswerAgrees(tokens, qa.MlgoTokens)
+	qa.Consistent = &consistent
+	if !consistent && AnswerMode == ANSWER_STRICT {
+		qa.Answer = qa.MlgoAnswer
+		qa.AnswerBackend = BACKEND_MLGO
+	}
+}
+
+// AnswerAgrees tells if the tokens of the llama.cpp answer start with the tokens of the
+// mlgo answer, which is shorter or ends with the end of text
+func AnswerAgrees(tokens []uint32, mlgo []uint32) bool {
+	if len(tokens) < len(mlgo) {
+		return false
+	}
+	for i := range mlgo {
+		if tokens[i] != mlgo[i] {
+			return false
+		}
+	}
+	return true
 }
@@ -0,0 +1,69 @@
+package common
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestCheckAnswer(t *testing.T) {
+	defer SetAnswerMode("")
+	// tokens of " world, how are you"
+	mlgo := []uint32{3186, 29892, 920, 526}
+	tests := []struct {
+		mode       string
+		tokens     []uint32
+		consistent bool
+		want       string
+	}{
+		{ANSWER_CHECK, []uint32{3186, 29892, 920, 526, 366}, true, "llama answer"},
+		{ANSWER_CHECK, []uint32{3186, 29892, 920, 527, 366}, false, "llama answer"},
+		{ANSWER_CHECK, []uint32{3186, 29892}, false, "llama answer"},
+		{ANSWER_STRICT, []uint32{3186, 29892, 920, 526}, true, "llama answer"},
+		{ANSWER_STRICT, []uint32{3186, 1781, 920, 526}, false, " world, how are"},
+	}
+	for _, tt := range tests {
+		if err := SetAnswerMode(tt.mode); err != nil {
+			t.Fatal(err)
+		}
+		qa := OptQA{Prompt: "hello", Answer: "llama answer", AnswerBackend: BACKEND_LLAMACPP, MlgoAnswer: " world, how are", MlgoTokens: mlgo}
+		qa.CheckAnswer(tt.tokens)
+		if qa.Consistent == nil || *qa.Consistent != tt.consistent || qa.Answer != tt.want {
+			t.Fatalf("%s %v: got %q consistent %v", tt.mode, tt.tokens, qa.Answer, qa.Consistent)
+		}
+		if !tt.consistent && tt.mode == ANSWER_STRICT && qa.AnswerBackend != BACKEND_MLGO {
+			t.Fatalf("backend %s", qa.AnswerBackend)
+		}
+	}
+
+	SetAnswerMode(ANSWER_LLAMACPP)
+	qa := OptQA{Prompt: "hello", Answer: "hello there", AnswerBackend: BACKEND_LLAMACPP, MlgoTokens: mlgo}
+	qa.CheckAnswer([]uint32{1})
+	if qa.Consistent != nil {
+		t.Fatal("answer checked in llamacpp mode")
+	}
+	if err := SetAnswerMode("gpt"); err == nil {
+		t.Fatal("expected an error for an unknown mode")
+	}
+}
+
+func TestDone(t *testing.T) {
+	qa := OptQA{ReqId: "req", Model: "llama", CallBack: "http://127.0.0.1/", Answer: "hello"}
+	if qa.Done() {
+		t.Fatal("done without a state root")
+	}
+	qa.Err = errors.New("mips run failed")
+	if !qa.Done() {
+		t.Fatal("failed question not done")
+	}
+}
+
+func TestDoneEmptyMlgoAnswer(t *testing.T) {
+	qa := OptQA{ReqId: "req", Model: "llama", CallBack: "http://127.0.0.1/", StateRoot: "0x01"}
+	if qa.Done() {
+		t.Fatal("done without an answer")
+	}
+	qa.AnswerBackend = BACKEND_MLGO
+	if !qa.Done() {
+		t.Fatal("empty mlgo answer not done")
+	}
+}
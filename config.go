@@ -0,0 +1,331 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"opml-opt/common"
+	"opml-opt/log"
+	"opml-opt/mips"
+	"opml-opt/mips/vm"
+	"opml-opt/models"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	cli "gopkg.in/urfave/cli.v1"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// environment variables overriding the config file, OPML_<KEY> sets the yaml key
+const ENV_PREFIX = "OPML_"
+
+var setFlag = cli.StringSliceFlag{
+	Name:  "set",
+	Usage: "config key to override, repeatable: <yaml key>=<value>, over the config file and the OPML_* environment variables",
+}
+
+var commandConfig = cli.Command{
+	Name:  "config",
+	Usage: "inspect the config",
+	Subcommands: []cli.Command{
+		{
+			Name:   "print",
+			Usage:  "print the effective config, secrets redacted",
+			Flags:  []cli.Flag{configPathFlag, setFlag},
+			Action: PrintConfig,
+		},
+	},
+}
+
+type Config struct {
+	Port          string `yaml:"port"`
+	Host          string `yaml:"host"`
+	ModelName     string `yaml:"model_name"`
+	ModelPath     string `yaml:"model_path"`
+	MipsProgram   string `yaml:"mips_program"`
+	MongoURI      string `yaml:"mongo_uri"`
+	DispatcherUrl string `yaml:"dispatcher"`
+	PreimageDir   string `yaml:"preimage_dir"`
+	RootCachePath string `yaml:"root_cache"`
+	RootCacheSize int    `yaml:"root_cache_size"`
+	MipsMaxJobs   int32  `yaml:"mips_max_jobs"`
+	// a run stops with an error past these limits, 0 for no limit
+	MipsMaxSteps    int           `yaml:"mips_max_steps"`
+	MipsMaxDuration time.Duration `yaml:"mips_max_duration"`
+	// bytes of the heap of a run, 0 for all the heap region
+	MipsMaxHeap int `yaml:"mips_max_heap"`
+	// record the steps in [mips_trace_from, mips_trace_to) of the runs here, if set
+	MipsTraceDir  string `yaml:"mips_trace_dir"`
+	MipsTraceFrom int    `yaml:"mips_trace_from"`
+	MipsTraceTo   int    `yaml:"mips_trace_to"`
+	// json, or binary for smaller checkpoints
+	CheckpointFormat string `yaml:"checkpoint_format"`
+	// remove the preimages no cached root or checkpoint of these dirs reaches, 0 for never
+	PreimageGCInterval    time.Duration `yaml:"preimage_gc_interval"`
+	PreimageGCCheckpoints []string      `yaml:"preimage_gc_checkpoints"`
+	// llamacpp, mlgo, check or strict, see common.AnswerMode
+	AnswerMode string `yaml:"answer_mode"`
+	// tokens of the mlgo answers, compared with the llama.cpp ones in the check modes
+	MlgoAnswerTokens int `yaml:"mlgo_answer_tokens"`
+	// commit the transcript of every answer and save it here, if set
+	TranscriptDir string `yaml:"transcript_dir"`
+	// served models, model_name, model_path and mips_program make the only one if empty
+	Models []models.Model `yaml:"models"`
+}
+
+func defaultConfig() Config {
+	return Config{
+		Port:          "1234",
+		Host:          "http://127.0.0.1",
+		ModelName:     "llama",
+		ModelPath:     vm.DEFAULT_MODEL_PATH,
+		MipsProgram:   vm.DEFAULT_MIPS_PROGRAM,
+		RootCacheSize: mips.DefaultRootCacheSize,
+		MipsMaxJobs:   1,
+		AnswerMode:    common.ANSWER_LLAMACPP,
+
+		MlgoAnswerTokens: mips.DefaultAnswerTokens,
+
+		CheckpointFormat: vm.FORMAT_JSON,
+	}
+}
+
+// LoadConfig layers the defaults, the config file at path, the OPML_* environment
+// variables and the key=value overrides, then validates the result. A missing config
+// file is an error only if required.
+func LoadConfig(path string, required bool, overrides []string) (Config, error) {
+	conf := defaultConfig()
+	b, err := os.ReadFile(path)
+	if err == nil {
+		// unknown keys are errors
+		if err := yaml.UnmarshalStrict(b, &conf); err != nil {
+			return conf, fmt.Errorf("config %s: %w", path, err)
+		}
+	} else if required || !errors.Is(err, fs.ErrNotExist) {
+		return conf, fmt.Errorf("read config error: %w", err)
+	}
+	if err := conf.applyEnv(os.Environ()); err != nil {
+		return conf, err
+	}
+	for _, kv := range overrides {
+		key, value, ok := strings.Cut(kv, "=")
+		if !ok {
+			return conf, fmt.Errorf("--set %s is not <key>=<value>", kv)
+		}
+		if err := conf.Set(key, value); err != nil {
+			return conf, fmt.Errorf("--set %s: %w", key, err)
+		}
+	}
+	return conf, conf.Validate()
+}
+
+func (conf *Config) applyEnv(environ []string) error {
+	for _, kv := range environ {
+		if !strings.HasPrefix(kv, ENV_PREFIX) {
+			continue
+		}
+		name, value, _ := strings.Cut(kv, "=")
+		if err := conf.Set(strings.ToLower(strings.TrimPrefix(name, ENV_PREFIX)), value); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// Set sets the field of the yaml key, models can only be listed in the config file
+func (conf *Config) Set(key string, value string) error {
+	v := reflect.ValueOf(conf).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		if strings.Split(v.Type().Field(i).Tag.Get("yaml"), ",")[0] != key {
+			continue
+		}
+		f := v.Field(i)
+		switch {
+		case f.Type() == reflect.TypeOf(time.Duration(0)):
+			d, err := time.ParseDuration(value)
+			if err != nil {
+				return err
+			}
+			f.SetInt(int64(d))
+		case f.Kind() == reflect.String:
+			f.SetString(value)
+		case f.Kind() == reflect.Int || f.Kind() == reflect.Int32:
+			n, err := strconv.ParseInt(value, 10, f.Type().Bits())
+			if err != nil {
+				return fmt.Errorf("%s is not an integer", value)
+			}
+			f.SetInt(n)
+		default:
+			return fmt.Errorf("%s can only be set in the config file", key)
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown config key %s", key)
+}
+
+// Validate checks the values, the files of the models are checked by Registry
+func (conf Config) Validate() error {
+	if port, err := strconv.Atoi(conf.Port); err != nil || port <= 0 || port > 65535 {
+		return fmt.Errorf("port %q is not a port number", conf.Port)
+	}
+	for _, u := range []struct {
+		key   string
+		value string
+	}{{"host", conf.Host}, {"dispatcher", conf.DispatcherUrl}} {
+		if u.value == "" {
+			continue
+		}
+		if parsed, err := url.Parse(u.value); err != nil || parsed.Scheme == "" || parsed.Host == "" {
+			return fmt.Errorf("%s %q is not an url", u.key, u.value)
+		}
+	}
+	// the mongo uri is not echoed, it holds the credentials
+	if _, err := url.Parse(conf.MongoURI); err != nil {
+		return fmt.Errorf("mongo_uri is not an url")
+	}
+	if conf.RootCacheSize < 0 || conf.MipsMaxJobs < 0 || conf.MipsMaxSteps < 0 || conf.MipsMaxDuration < 0 {
+		return fmt.Errorf("root_cache_size, mips_max_jobs, mips_max_steps and mips_max_duration can not be negative")
+	}
+	if conf.MipsMaxHeap < 0 || conf.MipsMaxHeap > vm.MAX_HEAP_SIZE {
+		return fmt.Errorf("mips_max_heap %d is not in [0, %d]", conf.MipsMaxHeap, vm.MAX_HEAP_SIZE)
+	}
+	if conf.MlgoAnswerTokens < 1 {
+		return fmt.Errorf("mlgo_answer_tokens %d is not a count of tokens", conf.MlgoAnswerTokens)
+	}
+	if conf.PreimageGCInterval < 0 || (conf.PreimageGCInterval > 0 && conf.PreimageDir == "") {
+		return fmt.Errorf("preimage_gc_interval %s needs a preimage_dir", conf.PreimageGCInterval)
+	}
+	if conf.MipsTraceFrom < 0 || conf.MipsTraceTo < 0 || (conf.MipsTraceTo > 0 && conf.MipsTraceTo <= conf.MipsTraceFrom) {
+		return fmt.Errorf("mips_trace_from %d and mips_trace_to %d are not a range of steps", conf.MipsTraceFrom, conf.MipsTraceTo)
+	}
+	if err := vm.CheckFormat(conf.CheckpointFormat); err != nil {
+		return err
+	}
+	if err := common.CheckAnswerMode(conf.AnswerMode); err != nil {
+		return err
+	}
+	_, err := models.NewRegistry(conf.ModelList())
+	return err
+}
+
+// Redacted returns the config with the passwords of its urls replaced
+func (conf Config) Redacted() Config {
+	conf.Host = redactURL(conf.Host)
+	conf.DispatcherUrl = redactURL(conf.DispatcherUrl)
+	conf.MongoURI = redactURL(conf.MongoURI)
+	return conf
+}
+
+func redactURL(s string) string {
+	u, err := url.Parse(s)
+	if err != nil || u.User == nil {
+		return s
+	}
+	if _, ok := u.User.Password(); !ok {
+		return s
+	}
+	u.User = url.UserPassword(u.User.Username(), "xxxxx")
+	return u.String()
+}
+
+// LlamaCpp tells if llama.cpp answers in the answer mode of the config
+func (conf Config) LlamaCpp() bool {
+	return conf.AnswerMode != common.ANSWER_MLGO
+}
+
+// ModelList returns the registry entries of the config, the only llama model of a config
+// without models has the default gguf model if llama.cpp answers
+func (conf Config) ModelList() []models.Model {
+	if len(conf.Models) > 0 {
+		return conf.Models
+	}
+	m := models.Model{
+		Name:    conf.ModelName,
+		Model:   models.PinnedFile{Path: conf.ModelPath},
+		Program: models.PinnedFile{Path: conf.MipsProgram},
+	}
+	if conf.LlamaCpp() {
+		m.GGUF.Path = models.DefaultGGUFPath
+	}
+	if m.Name == "" {
+		m.Name = "llama"
+	}
+	if m.Model.Path == "" {
+		m.Model.Path = vm.DEFAULT_MODEL_PATH
+	}
+	if m.Program.Path == "" {
+		m.Program.Path = vm.DEFAULT_MIPS_PROGRAM
+	}
+	return []models.Model{m}
+}
+
+// Registry returns the verified model registry of the config
+func (conf Config) Registry() (*models.Registry, error) {
+	registry, err := models.NewRegistry(conf.ModelList())
+	if err != nil {
+		return nil, err
+	}
+	return registry, registry.Verify(conf.LlamaCpp())
+}
+
+func (conf Config) VMConfig() *vm.Config {
+	config := vm.DefaultConfig()
+	if conf.MipsProgram != "" {
+		config.ProgramPath = conf.MipsProgram
+	}
+	if conf.ModelPath != "" {
+		config.ModelPath = conf.ModelPath
+	}
+	if conf.PreimageDir != "" {
+		config.Store = vm.NewDiskPreimageStore(conf.PreimageDir)
+	}
+	config.CheckpointFormat = conf.CheckpointFormat
+	config.MaxSteps = conf.MipsMaxSteps
+	config.MaxDuration = conf.MipsMaxDuration
+	if conf.MipsMaxHeap > 0 {
+		config.MaxHeapSize = uint64(conf.MipsMaxHeap)
+	}
+	config.TraceDir = conf.MipsTraceDir
+	config.TraceFrom = conf.MipsTraceFrom
+	config.TraceTo = conf.MipsTraceTo
+	return config
+}
+
+// configSource returns the config path of the command line, required if given, and the
+// --set overrides, the ones of a subcommand last
+func configSource(ctx *cli.Context) (string, bool, []string) {
+	path, required := configPathFlag.Value, false
+	var overrides []string
+	for c := ctx; c != nil; c = c.Parent() {
+		if !required && c.IsSet(configPathFlag.Name) {
+			path, required = c.String(configPathFlag.Name), true
+		}
+		overrides = append(append([]string{}, c.StringSlice(setFlag.Name)...), overrides...)
+	}
+	return path, required, overrides
+}
+
+func loadConfig(ctx *cli.Context) Config {
+	conf, err := LoadConfig(configSource(ctx))
+	if err != nil {
+		log.Fatal(err)
+	}
+	return conf
+}
+
+func PrintConfig(ctx *cli.Context) error {
+	conf, err := LoadConfig(configSource(ctx))
+	if err != nil {
+		return err
+	}
+	b, err := yaml.Marshal(conf.Redacted())
+	if err != nil {
+		return err
+	}
+	fmt.Print(string(b))
+	return nil
+}
@@ -13,14 +13,17 @@ import (
 
 const HEART_BEAT_TIMER = time.Second * 5
 
-func callHeartBeat(config Config) {
+// callHeartBeat reports to the dispatcher of the running config, read at each beat
+func callHeartBeat() {
 	ticker := time.NewTicker(HEART_BEAT_TIMER)
-	workerUrl := fmt.Sprintf("%s:%s", config.Host, config.Port)
-	hbUrl, err := url.JoinPath(config.DispatcherUrl, "receive_heart_beat")
-	if err != nil {
-		log.Fatal(err)
-	}
 	call := func() {
+		config := runningConfig.Load()
+		workerUrl := fmt.Sprintf("%s:%s", config.Host, config.Port)
+		hbUrl, err := url.JoinPath(config.DispatcherUrl, "receive_heart_beat")
+		if err != nil {
+			log.Error(err)
+			return
+		}
 		mipsJobs := mips.MipsWork.JobsNum
 		llamagoJobs := llamago.LlamaWorker.JobsNum
 		queue := mipsJobs
@@ -6,6 +6,7 @@ import (
 	"opml-opt/callback"
 	"opml-opt/common"
 	"opml-opt/log"
+	"opml-opt/models"
 	"os/exec"
 	"runtime"
 	"sync"
@@ -106,17 +107,30 @@ func InitWorker(modelName string, modelPath string) error {
 	return nil
 }
 
-func Inference(qa common.OptQA) error {
+// time a llama.cpp answer may take
+const Timeout = 300 * time.Second
+
+// Command runs llama.cpp greedily on the prompt with the gguf model of model
+func Command(ctx context.Context, model *models.Model, prompt string) *exec.Cmd {
+	return exec.CommandContext(ctx, "./llamacpp/llama-cli",
+		"-m", model.GGUF.Path, "-p", prompt,
+		"--temp", "0", "-n", "256")
+}
+
+func Inference(qa common.OptQA, model *models.Model) error {
 	defer func() {
 		if qa.Answer == "" && qa.Err == nil {
 			qa.Err = common.ErrJobDownUnknow
 		}
 		callback.DoneWork(qa)
 	}()
+	job := log.With(log.Fields{ReqId: qa.ReqId, Worker: log.WORKER_LLAMA, Phase: "llamacpp"})
 	LlamaWorker.mut.Lock()
 	if LlamaWorker.JobsNum >= LlamaWorker.MaxJobs {
-		log.Info("llama go jobs exceed")
-		return common.ErrExceedMaxJobs
+		LlamaWorker.mut.Unlock()
+		job.Info("llama go jobs exceed")
+		qa.Err = common.ErrExceedMaxJobs
+		return qa.Err
 	}
 	LlamaWorker.JobsNum++
 	LlamaWorker.mut.Unlock()
@@ -124,31 +138,27 @@ func Inference(qa common.OptQA) error {
 		LlamaWorker.JobsNum -= 1
 	}()
 
-	log.Infof("llama go handling job %v", qa)
-	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Second)
+	job.Infof("handling job of model %s, prompt of %d bytes", qa.Model, len(qa.Prompt))
+	ctx, cancel := context.WithTimeout(context.Background(), Timeout)
 	defer cancel()
 
-	cmd := exec.CommandContext(ctx, "./llamacpp/llama-cli",
-		"-m", "./llama-2-7b-chat.Q2_K.gguf", "-p", qa.Prompt,
-		"--temp", "0", "-n", "256")
+	cmd := Command(ctx, model, qa.Prompt)
 
 	output, err := cmd.CombinedOutput()
 
 	if ctx.Err() == context.DeadlineExceeded {
-		fmt.Println("Command timed out: %v", ctx.Err())
+		job.Errorf("command timed out: %v", ctx.Err())
+		qa.Err = fmt.Errorf("llama.cpp timed out after %s", Timeout)
+		return qa.Err
 	}
-
 	if err != nil {
-		fmt.Println("Command execution failed: %v, Output: %s", err, string(output))
+		job.Errorf("command execution failed: %v, output: %s", err, string(output))
+		qa.Err = fmt.Errorf("llama.cpp: %w", err)
+		return qa.Err
 	}
+	job.Info("command executed successfully")
 
 	qa.Answer = string(output)
-
-	if cmd.ProcessState.Success() {
-		fmt.Println("Command executed successfully.")
-	} else {
-		fmt.Println("Command execution failed with non-zero exit status.")
-	}
-
+	qa.AnswerBackend = common.BACKEND_LLAMACPP
 	return nil
 }
@@ -0,0 +1,125 @@
+package log
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// workers of the jobs
+const (
+	WORKER_LLAMA = "llama"
+	WORKER_MIPS  = "mips"
+)
+
+// Fields are the context of the lines of a job, the node id is the one of the logger if empty
+type Fields struct {
+	ReqId  string `json:"req_id,omitempty"`
+	NodeId string `json:"node_id,omitempty"`
+	Worker string `json:"worker,omitempty"`
+	Phase  string `json:"phase,omitempty"`
+}
+
+// merge overrides f with the fields set in g
+func (f Fields) merge(g Fields) Fields {
+	if g.ReqId != "" {
+		f.ReqId = g.ReqId
+	}
+	if g.NodeId != "" {
+		f.NodeId = g.NodeId
+	}
+	if g.Worker != "" {
+		f.Worker = g.Worker
+	}
+	if g.Phase != "" {
+		f.Phase = g.Phase
+	}
+	return f
+}
+
+func (f Fields) writeText(b *strings.Builder) {
+	for _, kv := range [][2]string{{"req_id", f.ReqId}, {"node_id", f.NodeId}, {"worker", f.Worker}, {"phase", f.Phase}} {
+		if kv[1] != "" {
+			b.WriteString(" " + kv[0] + "=" + kv[1])
+		}
+	}
+}
+
+// Entry logs the lines of a job with its fields
+type Entry struct {
+	Fields Fields
+}
+
+func With(fields Fields) Entry {
+	return Entry{Fields: fields}
+}
+
+func (e Entry) With(fields Fields) Entry {
+	return Entry{Fields: e.Fields.merge(fields)}
+}
+
+// Phase returns the entry of a phase of the job
+func (e Entry) Phase(phase string) Entry {
+	return e.With(Fields{Phase: phase})
+}
+
+type fieldsKey struct{}
+
+// NewContext returns a context carrying the fields of ctx overridden by fields
+func NewContext(ctx context.Context, fields Fields) context.Context {
+	return context.WithValue(ctx, fieldsKey{}, FromContext(ctx).Fields.merge(fields))
+}
+
+// FromContext returns the entry of the fields of ctx
+func FromContext(ctx context.Context) Entry {
+	fields, _ := ctx.Value(fieldsKey{}).(Fields)
+	return Entry{Fields: fields}
+}
+
+func (e Entry) Trace(a ...interface{}) {
+	Log.output(TraceLog, 1, e.Fields, sprint(a...))
+}
+
+func (e Entry) Tracef(format string, a ...interface{}) {
+	Log.output(TraceLog, 1, e.Fields, fmt.Sprintf(format, a...))
+}
+
+func (e Entry) Debug(a ...interface{}) {
+	Log.output(DebugLog, 1, e.Fields, sprint(a...))
+}
+
+func (e Entry) Debugf(format string, a ...interface{}) {
+	Log.output(DebugLog, 1, e.Fields, fmt.Sprintf(format, a...))
+}
+
+func (e Entry) Info(a ...interface{}) {
+	Log.output(InfoLog, 1, e.Fields, sprint(a...))
+}
+
+func (e Entry) Infof(format string, a ...interface{}) {
+	Log.output(InfoLog, 1, e.Fields, fmt.Sprintf(format, a...))
+}
+
+func (e Entry) Warn(a ...interface{}) {
+	Log.output(WarnLog, 1, e.Fields, sprint(a...))
+}
+
+func (e Entry) Warnf(format string, a ...interface{}) {
+	Log.output(WarnLog, 1, e.Fields, fmt.Sprintf(format, a...))
+}
+
+func (e Entry) Error(a ...interface{}) {
+	Log.output(ErrorLog, 1, e.Fields, sprint(a...))
+}
+
+func (e Entry) Errorf(format string, a ...interface{}) {
+	Log.output(ErrorLog, 1, e.Fields, fmt.Sprintf(format, a...))
+}
+
+func (e Entry) Fatal(a ...interface{}) {
+	Log.output(FatalLog, 1, e.Fields, sprint(a...))
+}
+
+func (e Entry) Fatalf(format string, a ...interface{}) {
+	Log.output(FatalLog, 1, e.Fields, fmt.Sprintf(format, a...))
+}
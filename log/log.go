@@ -2,6 +2,7 @@ package log
 
 import (
 	"bytes"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
@@ -43,12 +44,20 @@ const (
 
 var (
 	levels = map[int]string{
-		DebugLog: Color(Green, "[DEBUG]"),
-		InfoLog:  Color(Cyan, "[INFO ]"),
-		WarnLog:  Color(Yellow, "[WARN ]"),
-		ErrorLog: Color(Red, "[ERROR]"),
-		FatalLog: Color(Pink, "[FATAL]"),
-		TraceLog: Color(Blue, "[TRACE]"),
+		DebugLog: "[DEBUG]",
+		InfoLog:  "[INFO ]",
+		WarnLog:  "[WARN ]",
+		ErrorLog: "[ERROR]",
+		FatalLog: "[FATAL]",
+		TraceLog: "[TRACE]",
+	}
+	levelColors = map[int]string{
+		DebugLog: Green,
+		InfoLog:  Cyan,
+		WarnLog:  Yellow,
+		ErrorLog: Red,
+		FatalLog: Pink,
+		TraceLog: Blue,
 	}
 	Stdout = os.Stdout
 )
@@ -104,6 +113,14 @@ func init() {
 }
 
 func LevelName(level int) string {
+	if name, ok := levels[level]; ok {
+		return Color(levelColors[level], name)
+	}
+	return levelText(level)
+}
+
+// levelText is the level name without color
+func levelText(level int) string {
 	if name, ok := levels[level]; ok {
 		return name
 	}
@@ -111,8 +128,8 @@ func LevelName(level int) string {
 }
 
 func NameLevel(name string) int {
-	for k, v := range levels {
-		if v == name {
+	for k := range levels {
+		if LevelName(k) == name {
 			return k
 		}
 	}
@@ -123,11 +140,23 @@ func NameLevel(name string) int {
 	return level
 }
 
+// formats of the lines
+const (
+	FORMAT_TEXT = "text"
+	FORMAT_JSON = "json"
+)
+
 type Logger struct {
 	level   int
 	logger  *log.Logger
 	logFile *os.File
 	ignore  []string
+	flag    int
+	// json lines rather than text, colored text on terminals only
+	json  bool
+	color bool
+	// node id of every json line
+	nodeId string
 }
 
 func New(out io.Writer, prefix string, flag, level int, file *os.File) *Logger {
@@ -136,9 +165,20 @@ func New(out io.Writer, prefix string, flag, level int, file *os.File) *Logger {
 		logger:  log.New(out, prefix, flag),
 		logFile: file,
 		ignore:  make([]string, 0),
+		flag:    flag,
+		color:   isTerminal(out),
 	}
 }
 
+func isTerminal(out io.Writer) bool {
+	f, ok := out.(*os.File)
+	if !ok {
+		return false
+	}
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
 func (l *Logger) SetDebugLevel(level int) error {
 	if level > MaxLevelLog || level < 0 {
 		return errors.New("Invalid Debug Level")
@@ -148,122 +188,191 @@ func (l *Logger) SetDebugLevel(level int) error {
 	return nil
 }
 
-func (l *Logger) Output(level int, a ...interface{}) error {
-	gid := GetGID()
-	gidStr := strconv.FormatUint(gid, 10)
+// SetFormat writes text or json lines
+func (l *Logger) SetFormat(format string) error {
+	switch format {
+	case FORMAT_TEXT, "":
+		l.json = false
+		l.logger.SetFlags(l.flag)
+	case FORMAT_JSON:
+		l.json = true
+		l.logger.SetFlags(0)
+	default:
+		return fmt.Errorf("unknown log format %s, expected %s or %s", format, FORMAT_TEXT, FORMAT_JSON)
+	}
+	return nil
+}
+
+// SetNodeId sets the node id of the json lines, text lines are read on their node
+func (l *Logger) SetNodeId(nodeId string) {
+	l.nodeId = nodeId
+}
+
+func (l *Logger) paint(code, msg string) string {
+	if !l.color || code == "" {
+		return msg
+	}
+	return Color(code, msg)
+}
+
+// caller is where a line is logged from
+type caller struct {
+	pkg  string
+	fn   string
+	file string
+	line int
+}
+
+// callerAt returns the caller skip frames above the caller of callerAt
+func callerAt(skip int) caller {
+	pc := make([]uintptr, 1)
+	if runtime.Callers(skip+2, pc) == 0 {
+		return caller{}
+	}
+	frame, _ := runtime.CallersFrames(pc).Next()
+	return caller{pkg: pkgName(frame.Function), fn: frame.Function, file: frame.File, line: frame.Line}
+}
+
+func pkgName(nameFull string) string {
+	if ProcName == "" || !strings.Contains(nameFull, ProcName) {
+		nameEnd := filepath.Base(nameFull)
+		return strings.Split(nameEnd, ".")[0]
+	}
+	nameEnd := nameFull[strings.LastIndex(nameFull, ProcName)+len(ProcName)+1:]
+	return strings.Split(nameEnd, ".")[0]
+}
+
+func (l *Logger) enabled(level int, c caller) bool {
 	if level <= DebugLog {
-		a = append([]interface{}{LevelName(level), "GID",
-			gidStr + ","}, a...)
-		for k, v := range ModuleLevel {
-			if strings.Contains(a[4].(string), k) {
-				if level >= v {
-					return l.logger.Output(CALL_DEPTH, fmt.Sprintln(a...))
-				}
-				return nil
+		for _, ig := range l.ignore {
+			if strings.Contains(c.file, ig) {
+				return false
 			}
 		}
-	} else {
-		pkgName := GetPkg()
-		a = append([]interface{}{LevelName(level), "GID",
-			gidStr + ", " + pkgName}, a...)
-		for k, v := range ModuleLevel {
-			if strings.Contains(pkgName, k) {
-				if level >= v {
-					return l.logger.Output(CALL_DEPTH, fmt.Sprintln(a...))
-				}
-				return nil
-			}
-		}
-
 	}
-	if level >= l.level {
-		//fmt.Printf("level >= l.level\n")
-		return l.logger.Output(CALL_DEPTH, fmt.Sprintln(a...))
+	for k, v := range ModuleLevel {
+		if strings.Contains(c.pkg, k) {
+			return level >= v
+		}
 	}
-	return nil
+	return level >= l.level
 }
 
-func (l *Logger) Outputf(level int, format string, a ...interface{}) error {
+// jsonLine is a line of the json format, debug and trace lines have their caller
+type jsonLine struct {
+	Time  string `json:"time"`
+	Level string `json:"level"`
+	GID   uint64 `json:"gid"`
+	Pkg   string `json:"pkg,omitempty"`
+	Func  string `json:"func,omitempty"`
+	File  string `json:"file,omitempty"`
+	Fields
+	Msg string `json:"msg"`
+}
+
+// output writes a line of msg logged skip frames above its caller
+func (l *Logger) output(level int, skip int, fields Fields, msg string) error {
+	if level < l.level && len(ModuleLevel) == 0 {
+		return nil
+	}
+	c := callerAt(skip + 1)
+	if !l.enabled(level, c) {
+		return nil
+	}
 	gid := GetGID()
-	if level <= DebugLog {
-		a = append([]interface{}{LevelName(level), "GID",
-			gid}, a...)
-		for k, v := range ModuleLevel {
-			if strings.Contains(a[4].(string), k) {
-				if level >= v {
-					return l.logger.Output(CALL_DEPTH, fmt.Sprintf("%s %s %d, "+format+"\n", a...))
-				}
-				return nil
-			}
+	if l.json {
+		line := jsonLine{
+			Time:   time.Now().Format(time.RFC3339Nano),
+			Level:  strings.ToLower(strings.Trim(levelText(level), "[] ")),
+			GID:    gid,
+			Pkg:    c.pkg,
+			Fields: fields,
+			Msg:    msg,
 		}
-		if level >= l.level {
-			return l.logger.Output(CALL_DEPTH, fmt.Sprintf("%s %s %d, "+format+"\n", a...))
+		if line.NodeId == "" {
+			line.NodeId = l.nodeId
 		}
-	} else {
-		pkgName := GetPkg()
-		a = append([]interface{}{LevelName(level), "GID",
-			gid, pkgName}, a...)
-		for k, v := range ModuleLevel {
-			if strings.Contains(pkgName, k) {
-				if level >= v {
-					return l.logger.Output(CALL_DEPTH, fmt.Sprintf("%s %s %d, %s "+format+"\n", a...))
-				}
-			}
-			return nil
+		if level <= DebugLog {
+			line.Func = c.fn
+			line.File = filepath.Base(c.file) + ":" + strconv.Itoa(c.line)
 		}
-		if level >= l.level {
-			return l.logger.Output(CALL_DEPTH, fmt.Sprintf("%s %s %d, %s "+format+"\n", a...))
+		b, err := json.Marshal(&line)
+		if err != nil {
+			return err
 		}
+		return l.logger.Output(CALL_DEPTH, string(b))
 	}
-	return nil
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s GID %d, %s", l.paint(levelColors[level], levelText(level)), gid, l.paint(Cyan, "["+c.pkg+"]"))
+	if level <= DebugLog {
+		fmt.Fprintf(&b, " %s %s:%d", c.fn, filepath.Base(c.file), c.line)
+	}
+	fields.writeText(&b)
+	b.WriteString(" ")
+	b.WriteString(msg)
+	return l.logger.Output(CALL_DEPTH, b.String())
+}
+
+// sprint spaces the operands as the text lines always did
+func sprint(a ...interface{}) string {
+	return strings.TrimSuffix(fmt.Sprintln(a...), "\n")
+}
+
+func (l *Logger) Output(level int, a ...interface{}) error {
+	return l.output(level, 1, Fields{}, sprint(a...))
+}
+
+func (l *Logger) Outputf(level int, format string, a ...interface{}) error {
+	return l.output(level, 1, Fields{}, fmt.Sprintf(format, a...))
 }
 
 func (l *Logger) Trace(a ...interface{}) {
-	l.Output(TraceLog, a...)
+	l.output(TraceLog, 1, Fields{}, sprint(a...))
 }
 
 func (l *Logger) Tracef(format string, a ...interface{}) {
-	l.Outputf(TraceLog, format, a...)
+	l.output(TraceLog, 1, Fields{}, fmt.Sprintf(format, a...))
 }
 
 func (l *Logger) Debug(a ...interface{}) {
-	l.Output(DebugLog, a...)
+	l.output(DebugLog, 1, Fields{}, sprint(a...))
 }
 
 func (l *Logger) Debugf(format string, a ...interface{}) {
-	l.Outputf(DebugLog, format, a...)
+	l.output(DebugLog, 1, Fields{}, fmt.Sprintf(format, a...))
 }
 
 func (l *Logger) Info(a ...interface{}) {
-	l.Output(InfoLog, a...)
+	l.output(InfoLog, 1, Fields{}, sprint(a...))
 }
 
 func (l *Logger) Infof(format string, a ...interface{}) {
-	l.Outputf(InfoLog, format, a...)
+	l.output(InfoLog, 1, Fields{}, fmt.Sprintf(format, a...))
 }
 
 func (l *Logger) Warn(a ...interface{}) {
-	l.Output(WarnLog, a...)
+	l.output(WarnLog, 1, Fields{}, sprint(a...))
 }
 
 func (l *Logger) Warnf(format string, a ...interface{}) {
-	l.Outputf(WarnLog, format, a...)
+	l.output(WarnLog, 1, Fields{}, fmt.Sprintf(format, a...))
 }
 
 func (l *Logger) Error(a ...interface{}) {
-	l.Output(ErrorLog, a...)
+	l.output(ErrorLog, 1, Fields{}, sprint(a...))
 }
 
 func (l *Logger) Errorf(format string, a ...interface{}) {
-	l.Outputf(ErrorLog, format, a...)
+	l.output(ErrorLog, 1, Fields{}, fmt.Sprintf(format, a...))
 }
 
 func (l *Logger) Fatal(a ...interface{}) {
-	l.Output(FatalLog, a...)
+	l.output(FatalLog, 1, Fields{}, sprint(a...))
 }
 
 func (l *Logger) Fatalf(format string, a ...interface{}) {
-	l.Outputf(FatalLog, format, a...)
+	l.output(FatalLog, 1, Fields{}, fmt.Sprintf(format, a...))
 }
 
 func AddIgnore(name string) {
@@ -277,149 +386,54 @@ func CleanIgnore() {
 	Log.ignore = Log.ignore[:0]
 }
 
-func Trace(a ...interface{}) {
-	if TraceLog < Log.level && len(ModuleLevel) == 0 {
-		return
-	}
+// the level functions log without fields, see With for the lines of a job
 
-	pc := make([]uintptr, 10)
-	runtime.Callers(2, pc)
-	f := runtime.FuncForPC(pc[0])
-	file, line := f.FileLine(pc[0])
-	fileName := filepath.Base(file)
-
-	nameFull := f.Name()
-	nameEnd := filepath.Ext(nameFull)
-	funcName := strings.TrimPrefix(nameEnd, ".")
-	var pkgName string
-	if ProcName == "" || !strings.Contains(nameFull, ProcName) {
-		nameEnd := filepath.Base(nameFull)
-		pkgName = strings.Split(nameEnd, ".")[0]
-	} else {
-		nameEnd := nameFull[strings.LastIndex(nameFull, ProcName)+len(ProcName)+1:]
-		pkgName = strings.Split(nameEnd, ".")[0]
-	}
-
-	a = append([]interface{}{Color(Cyan, "["+pkgName+"]"), funcName + "()", fileName + ":" + strconv.Itoa(line)}, a...)
-
-	Log.Trace(a...)
+func Trace(a ...interface{}) {
+	Log.output(TraceLog, 1, Fields{}, sprint(a...))
 }
 
 func Tracef(format string, a ...interface{}) {
-	if TraceLog < Log.level && len(ModuleLevel) == 0 {
-		return
-	}
-
-	pc := make([]uintptr, 10)
-	runtime.Callers(2, pc)
-	f := runtime.FuncForPC(pc[0])
-	file, line := f.FileLine(pc[0])
-	fileName := filepath.Base(file)
-
-	nameFull := f.Name()
-	nameEnd := filepath.Ext(nameFull)
-	funcName := strings.TrimPrefix(nameEnd, ".")
-	var pkgName string
-	if ProcName == "" || !strings.Contains(nameFull, ProcName) {
-		nameEnd := filepath.Base(nameFull)
-		pkgName = strings.Split(nameEnd, ".")[0]
-	} else {
-		nameEnd := nameFull[strings.LastIndex(nameFull, ProcName)+len(ProcName)+1:]
-		pkgName = strings.Split(nameEnd, ".")[0]
-	}
-	a = append([]interface{}{Color(Cyan, "["+pkgName+"]"), funcName, fileName, line}, a...)
-
-	Log.Tracef("%s %s() %s:%d "+format, a...)
+	Log.output(TraceLog, 1, Fields{}, fmt.Sprintf(format, a...))
 }
 
 func Debug(a ...interface{}) {
-	if DebugLog < Log.level && len(ModuleLevel) == 0 {
-		return
-	}
-
-	pc := make([]uintptr, 10)
-	runtime.Callers(2, pc)
-	f := runtime.FuncForPC(pc[0])
-	file, line := f.FileLine(pc[0])
-	fileName := filepath.Base(file)
-
-	for _, ig := range Log.ignore {
-		if strings.Index(file, ig) != -1 {
-			return
-		}
-	}
-	nameFull := f.Name()
-	var pkgName string
-	if ProcName == "" || !strings.Contains(nameFull, ProcName) {
-		nameEnd := filepath.Base(nameFull)
-		pkgName = strings.Split(nameEnd, ".")[0]
-	} else {
-		nameEnd := nameFull[strings.LastIndex(nameFull, ProcName)+len(ProcName)+1:]
-		pkgName = strings.Split(nameEnd, ".")[0]
-	}
-	a = append([]interface{}{Color(Cyan, "["+pkgName+"]"), f.Name(), fileName + ":" + strconv.Itoa(line)}, a...)
-
-	Log.Debug(a...)
+	Log.output(DebugLog, 1, Fields{}, sprint(a...))
 }
 
 func Debugf(format string, a ...interface{}) {
-	if DebugLog < Log.level && len(ModuleLevel) == 0 {
-		return
-	}
-	pc := make([]uintptr, 10)
-	runtime.Callers(2, pc)
-	f := runtime.FuncForPC(pc[0])
-	file, line := f.FileLine(pc[0])
-	fileName := filepath.Base(file)
-	for _, ig := range Log.ignore {
-		if strings.Index(file, ig) != -1 {
-			return
-		}
-	}
-	nameFull := f.Name()
-	var pkgName string
-	if ProcName == "" || !strings.Contains(nameFull, ProcName) {
-		nameEnd := filepath.Base(nameFull)
-		pkgName = strings.Split(nameEnd, ".")[0]
-	} else {
-		nameEnd := nameFull[strings.LastIndex(nameFull, ProcName)+len(ProcName)+1:]
-		pkgName = strings.Split(nameEnd, ".")[0]
-	}
-	a = append([]interface{}{Color(Cyan, "["+pkgName+"]"), f.Name(), fileName, line}, a...)
-
-	Log.Debugf("%s %s %s:%d "+format, a...)
+	Log.output(DebugLog, 1, Fields{}, fmt.Sprintf(format, a...))
 }
 
 func Info(a ...interface{}) {
-	Log.Info(a...)
+	Log.output(InfoLog, 1, Fields{}, sprint(a...))
 }
 
 func Warn(a ...interface{}) {
-	Log.Warn(a...)
+	Log.output(WarnLog, 1, Fields{}, sprint(a...))
 }
 
 func Error(a ...interface{}) {
-	Log.Error(a...)
+	Log.output(ErrorLog, 1, Fields{}, sprint(a...))
 }
 
 func Fatal(a ...interface{}) {
-	Log.Fatal(a...)
+	Log.output(FatalLog, 1, Fields{}, sprint(a...))
 }
 
 func Infof(format string, a ...interface{}) {
-	Log.Infof(format, a...)
+	Log.output(InfoLog, 1, Fields{}, fmt.Sprintf(format, a...))
 }
 
 func Warnf(format string, a ...interface{}) {
-	Log.Warnf(format, a...)
+	Log.output(WarnLog, 1, Fields{}, fmt.Sprintf(format, a...))
 }
 
 func Errorf(format string, a ...interface{}) {
-	Log.Errorf(format, a...)
+	Log.output(ErrorLog, 1, Fields{}, fmt.Sprintf(format, a...))
 }
 
 func Fatalf(format string, a ...interface{}) {
-	Log.Fatalf(format, a...)
+	Log.output(FatalLog, 1, Fields{}, fmt.Sprintf(format, a...))
 }
 
 func FileOpen(path string) (*os.File, error) {
@@ -474,8 +488,12 @@ func InitLog(logLevel int, a ...interface{}) {
 			}
 		}
 	}
-	fileAndStdoutWrite := io.MultiWriter(writers...)
-	Log = New(fileAndStdoutWrite, "", log.Ldate|log.Lmicroseconds, logLevel, logFile)
+	// a single writer is colored if it is a terminal
+	var out io.Writer = io.MultiWriter(writers...)
+	if len(writers) == 1 {
+		out = writers[0]
+	}
+	Log = New(out, "", log.Ldate|log.Lmicroseconds, logLevel, logFile)
 	ModuleLevel = make(map[string]int)
 }
 
@@ -0,0 +1,63 @@
+package log
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log"
+	"strings"
+	"testing"
+)
+
+func TestJSONLines(t *testing.T) {
+	var buf bytes.Buffer
+	Log = New(&buf, "", log.Ldate, InfoLog, nil)
+	if err := Log.SetFormat("yaml"); err == nil {
+		t.Error("expected an error for an unknown format")
+	}
+	if err := Log.SetFormat(FORMAT_JSON); err != nil {
+		t.Fatal(err)
+	}
+	Log.SetNodeId("node")
+	job := With(Fields{ReqId: "req", Worker: WORKER_MIPS})
+	job.Phase("run").Infof("steps %d", 10)
+	job.Debug("dropped below the level")
+	Warn("no", "fields")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("got %d lines: %q", len(lines), buf.String())
+	}
+	var line jsonLine
+	if err := json.Unmarshal([]byte(lines[0]), &line); err != nil {
+		t.Fatal(err)
+	}
+	want := Fields{ReqId: "req", NodeId: "node", Worker: WORKER_MIPS, Phase: "run"}
+	if line.Fields != want || line.Level != "info" || line.Msg != "steps 10" || line.Pkg != "log" {
+		t.Errorf("got %+v", line)
+	}
+	line = jsonLine{}
+	if err := json.Unmarshal([]byte(lines[1]), &line); err != nil {
+		t.Fatal(err)
+	}
+	if line.Fields != (Fields{NodeId: "node"}) || line.Level != "warn" || line.Msg != "no fields" {
+		t.Errorf("got %+v", line)
+	}
+}
+
+func TestTextLines(t *testing.T) {
+	var buf bytes.Buffer
+	Log = New(&buf, "", 0, InfoLog, nil)
+	Log.SetNodeId("node")
+	ctx := NewContext(context.Background(), Fields{ReqId: "req", Worker: WORKER_LLAMA})
+	ctx = NewContext(ctx, Fields{Phase: "answer"})
+	FromContext(ctx).Error("failed")
+	got := buf.String()
+	if strings.Contains(got, "\033[") {
+		t.Errorf("colored line to a buffer: %q", got)
+	}
+	want := "[ERROR] GID "
+	if !strings.HasPrefix(got, want) || !strings.HasSuffix(got, ", [log] req_id=req worker=llama phase=answer failed\n") {
+		t.Errorf("got %q", got)
+	}
+}
@@ -2,21 +2,24 @@ package main
 
 import (
 	"context"
+	"encoding/hex"
 	"fmt"
+	"opml-opt/common"
 	"opml-opt/db"
 	"opml-opt/llamago"
 	"opml-opt/log"
 	"opml-opt/mips"
 	"opml-opt/mips/vm"
+	"opml-opt/models"
 	"opml-opt/rpc"
 	"os"
 	"os/signal"
 	"strings"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	cli "gopkg.in/urfave/cli.v1"
-	yaml "gopkg.in/yaml.v2"
 )
 
 var (
@@ -49,10 +52,38 @@ var (
 		Usage: "log root path",
 		Value: "./logs",
 	}
+	logFormatFlag = cli.StringFlag{
+		Name:  "logFormat",
+		Usage: "log line format, text or json",
+		Value: log.FORMAT_TEXT,
+	}
 	promptFlag = cli.StringFlag{
 		Name:  "prompt",
 		Value: "Why Golang is so popular?",
 	}
+	basedirFlag = cli.StringFlag{
+		Name:  "basedir",
+		Usage: "directory of the node data and checkpoints",
+		Value: "/tmp/cannon",
+	}
+	nodeFlag = cli.IntFlag{
+		Name:  "node",
+		Usage: "graph node to run",
+	}
+	targetFlag = cli.IntFlag{
+		Name:  "target",
+		Usage: "step of the checkpoint, -1 for the final state",
+		Value: -1,
+	}
+	stepsFlag = cli.IntFlag{
+		Name:  "steps",
+		Usage: "instructions to run",
+		Value: 1000000,
+	}
+	faultFlag = cli.StringSliceFlag{
+		Name:  "fault",
+		Usage: "fault to inject, repeatable: reg:<step>:<reg>:<value>, mem:<step>:<addr>[:<mask>], write:<addr>:<value>, oracle:<hash|*>[:<mask>] or node:<node>:<index>[:<mask>]",
+	}
 )
 
 func init() {
@@ -62,9 +93,11 @@ func init() {
 		configPathFlag,
 		logLevelFlag,
 		logFilePath,
+		logFormatFlag,
+		setFlag,
 	}
 	app.Action = Start
-	app.Commands = []cli.Command{commandMips}
+	app.Commands = []cli.Command{commandMips, commandConfig, commandAsk, commandVerify, commandCheckpoint, commandTrace, commandBench, commandPreimages}
 	cli.CommandHelpTemplate = OriginCommandHelpTemplate
 }
 
@@ -75,16 +108,6 @@ func main() {
 	}
 }
 
-type Config struct {
-	Port          string `yaml:"port"`
-	Host          string `yaml:"host"`
-	ModelName     string `yaml:"model_name"`
-	ModelPath     string `yaml:"model_path"`
-	MipsProgram   string `yaml:"mips_program"`
-	MongoURI      string `yaml:"mongo_uri"`
-	DispatcherUrl string `yaml:"dispatcher"`
-}
-
 var commandMips = cli.Command{
 	Name:  "mips",
 	Usage: "run mips",
@@ -92,19 +115,84 @@ var commandMips = cli.Command{
 		configPathFlag,
 		promptFlag,
 	},
-	Action: RunMips,
+	Action:      RunMips,
+	Subcommands: []cli.Command{commandFault, commandReplay},
+}
+
+var commandFault = cli.Command{
+	Name:  "fault",
+	Usage: "run a graph node as a dishonest operator",
+	Flags: []cli.Flag{
+		configPathFlag,
+		promptFlag,
+		basedirFlag,
+		nodeFlag,
+		targetFlag,
+		faultFlag,
+	},
+	Action: RunFault,
 }
 
-func RunMips(ctx *cli.Context) {
+var commandReplay = cli.Command{
+	Name:      "replay",
+	Usage:     "resume a run from a checkpoint and write the checkpoint of the step it stops at",
+	ArgsUsage: "<checkpoint>",
+	Flags: []cli.Flag{
+		configPathFlag,
+		basedirFlag,
+		stepsFlag,
+		faultFlag,
+	},
+	Action: RunReplay,
+}
+
+func RunMips(ctx *cli.Context) error {
 	conf := loadConfig(ctx)
 	prompt := ctx.String(promptFlag.Name)
-	vm.ModelPath = conf.ModelPath
-	vm.MIPS_PROGRAM = conf.MipsProgram
-	nodeHash, err := vm.RunCheckPointZeroRoot(prompt)
+	nodeHash, nodeCount, err := vm.NewMachine(conf.VMConfig()).RunCheckPointZeroRoot(prompt)
 	if err != nil {
-		panic(err)
+		return err
 	}
+	println("nodes:", nodeCount)
 	println("ok:", nodeHash.String())
+	return nil
+}
+
+func RunFault(ctx *cli.Context) error {
+	conf := loadConfig(ctx)
+	m := vm.NewMachine(conf.VMConfig())
+	for _, spec := range ctx.StringSlice(faultFlag.Name) {
+		if err := m.Faults.Set(spec); err != nil {
+			return err
+		}
+	}
+	result, err := m.RunNode(ctx.String(basedirFlag.Name), ctx.String(promptFlag.Name), ctx.Int(nodeFlag.Name), ctx.Int(targetFlag.Name))
+	if err != nil {
+		return err
+	}
+	println("output:", hex.EncodeToString(result.Output))
+	println("ok:", result.Root.String())
+	return nil
+}
+
+func RunReplay(ctx *cli.Context) error {
+	if ctx.NArg() != 1 {
+		return fmt.Errorf("replay takes a checkpoint file")
+	}
+	conf := loadConfig(ctx)
+	m := vm.NewMachine(conf.VMConfig())
+	for _, spec := range ctx.StringSlice(faultFlag.Name) {
+		if err := m.Faults.Set(spec); err != nil {
+			return err
+		}
+	}
+	result, err := m.Replay(ctx.String(basedirFlag.Name)+"/checkpoint", ctx.Args().First(), ctx.Int(stepsFlag.Name))
+	if err != nil {
+		return err
+	}
+	println("step:", result.Steps)
+	println("ok:", result.Final.String())
+	return nil
 }
 
 func Start(ctx *cli.Context) {
@@ -128,6 +216,10 @@ func Start(ctx *cli.Context) {
 	defer logFile.Close()
 
 	log.InitLog(log.DebugLog, logFile)
+	if err := log.Log.SetFormat(ctx.String(logFormatFlag.Name)); err != nil {
+		panic(err)
+	}
+	log.Log.SetNodeId(common.NodeID)
 
 	conf := loadConfig(ctx)
 	if conf.Host != "" {
@@ -137,58 +229,102 @@ func Start(ctx *cli.Context) {
 	db.MongoURI = conf.MongoURI
 	// db.Init()
 
+	err = common.SetAnswerMode(conf.AnswerMode)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	registry, err := conf.Registry()
+	if err != nil {
+		log.Fatal(err)
+	}
+	models.Swap(registry)
+	runningConfig.Store(&conf)
+
 	//init workers
 	err = llamago.InitWorker(conf.ModelName, conf.ModelPath)
 	if err != nil {
 		log.Fatal(err)
 	}
-	err = mips.InitWorker(conf.ModelName, conf.ModelPath, conf.MipsProgram)
+	err = mips.InitWorker(conf.ModelName, conf.VMConfig(), conf.MipsMaxJobs)
 	if err != nil {
 		log.Fatal(err)
 	}
-
-	rpc.InitRpcService(conf.Port, conf.ModelName, conf.ModelPath)
-
-	go callHeartBeat(conf)
-
-	contx := context.Background()
-	err = rpc.RpcServer.Start(contx)
+	err = mips.InitRootCache(conf.RootCachePath, conf.RootCacheSize)
 	if err != nil {
 		log.Fatal(err)
 	}
-	waitToExit()
-}
+	mips.InitTranscripts(conf.TranscriptDir)
+	mips.InitAnswerTokens(conf.MlgoAnswerTokens)
+	if conf.PreimageGCInterval > 0 {
+		go mips.CollectPreimagesEvery(conf.PreimageGCInterval, conf.PreimageGCCheckpoints)
+	}
 
-func loadConfig(ctx *cli.Context) Config {
-	var optConfig Config
-	if ctx.IsSet(configPathFlag.Name) {
-		configPath := ctx.String(configPathFlag.Name)
-		b, err := os.ReadFile(configPath)
-		if err != nil {
-			log.Fatal("read config error", err)
-		}
-		mips.ConfigPath = configPath
-		err = yaml.Unmarshal(b, &optConfig)
+	rpc.InitRpcService(conf.Port, conf.ModelName, conf.ModelPath)
+	path, required, overrides := configSource(ctx)
+	reload := func() error {
+		return reloadConfig(path, required, overrides)
+	}
+	rpc.Reload = reload
+
+	go callHeartBeat()
+
+	go func() {
+		contx := context.Background()
+		err := rpc.RpcServer.Start(contx)
 		if err != nil {
 			log.Fatal(err)
 		}
+	}()
+	waitToExit(reload)
+}
+
+// the running config, replaced by a reload
+var runningConfig atomic.Pointer[Config]
+
+// reloadConfig loads and validates the config again and applies it: the models are swapped
+// once their jobs are done, in the order of the reloads, and the heartbeat follows the new
+// dispatcher and host. The port and the worker settings need a restart, a changed
+// answer_mode is rejected.
+func reloadConfig(path string, required bool, overrides []string) error {
+	conf, err := LoadConfig(path, required, overrides)
+	if err != nil {
+		return err
+	}
+	registry, err := conf.Registry()
+	if err != nil {
+		return err
+	}
+	old := runningConfig.Load()
+	// the questions in flight depend on the answer mode
+	if conf.AnswerMode != old.AnswerMode {
+		return fmt.Errorf("answer_mode change from %s to %s needs a restart", old.AnswerMode, conf.AnswerMode)
 	}
-	return optConfig
+	if conf.Port != old.Port {
+		log.Warnf("port change to %s ignored until restart", conf.Port)
+		conf.Port = old.Port
+	}
+	runningConfig.Store(&conf)
+	log.Infof("config reloaded, serving %v once their jobs are done", registry.Names())
+	models.Reload(registry)
+	return nil
 }
 
-func waitToExit() {
-	exit := make(chan bool, 0)
+// waitToExit reloads the config on SIGHUP and returns on SIGINT or SIGTERM
+func waitToExit(reload func() error) {
 	sc := make(chan os.Signal, 1)
 	if !signal.Ignored(syscall.SIGHUP) {
 		signal.Notify(sc, syscall.SIGHUP)
 	}
 	signal.Notify(sc, syscall.SIGINT, syscall.SIGTERM)
-	go func() {
-		for sig := range sc {
-			fmt.Printf("received exit signal:%v", sig.String())
-			close(exit)
-			break
+	for sig := range sc {
+		if sig == syscall.SIGHUP {
+			if err := reload(); err != nil {
+				log.Error("reload error", err)
+			}
+			continue
 		}
-	}()
-	<-exit
+		fmt.Printf("received exit signal:%v", sig.String())
+		return
+	}
 }
@@ -0,0 +1,301 @@
+package mips
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"opml-opt/common"
+	"opml-opt/llamago"
+	"opml-opt/mips/vm"
+	"opml-opt/models"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// phases of a bench run
+const (
+	PHASE_LLAMACPP = "llamacpp" // answer with llama.cpp
+	PHASE_GRAPH    = "graph"    // expand the mlgo graph and compute the env of node 0
+	PHASE_MIPS     = "mips"     // run the program on node 0 to the golden checkpoint
+)
+
+var BenchPhases = []string{PHASE_LLAMACPP, PHASE_GRAPH, PHASE_MIPS}
+
+// CheckPhases checks the phases to bench, the mips phase runs on the env of the graph phase
+func CheckPhases(phases []string) error {
+	if len(phases) == 0 {
+		return fmt.Errorf("no phase to bench")
+	}
+	set := make(map[string]bool)
+	for _, phase := range phases {
+		if phase != PHASE_LLAMACPP && phase != PHASE_GRAPH && phase != PHASE_MIPS {
+			return fmt.Errorf("unknown phase %s, expected %s", phase, strings.Join(BenchPhases, ", "))
+		}
+		set[phase] = true
+	}
+	if set[PHASE_MIPS] && !set[PHASE_GRAPH] {
+		return fmt.Errorf("the %s phase runs on the env of the %s phase", PHASE_MIPS, PHASE_GRAPH)
+	}
+	return nil
+}
+
+// PhaseStats are the latencies of a phase over the runs, in ms
+type PhaseStats struct {
+	Count  int     `json:"count"`
+	MinMs  float64 `json:"min_ms"`
+	MeanMs float64 `json:"mean_ms"`
+	P50Ms  float64 `json:"p50_ms"`
+	P90Ms  float64 `json:"p90_ms"`
+	P99Ms  float64 `json:"p99_ms"`
+	MaxMs  float64 `json:"max_ms"`
+}
+
+func ms(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// percentile is the nearest rank of sorted
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	rank := int(math.Ceil(p/100*float64(len(sorted)))) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	return sorted[rank]
+}
+
+func phaseStats(durations []time.Duration) PhaseStats {
+	if len(durations) == 0 {
+		return PhaseStats{}
+	}
+	sorted := append([]time.Duration(nil), durations...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	var total time.Duration
+	for _, d := range sorted {
+		total += d
+	}
+	return PhaseStats{
+		Count:  len(sorted),
+		MinMs:  ms(sorted[0]),
+		MeanMs: ms(total) / float64(len(sorted)),
+		P50Ms:  ms(percentile(sorted, 50)),
+		P90Ms:  ms(percentile(sorted, 90)),
+		P99Ms:  ms(percentile(sorted, 99)),
+		MaxMs:  ms(sorted[len(sorted)-1]),
+	}
+}
+
+// BenchRun is a prompt through the phases, the golden checkpoint fields are set by the mips phase
+type BenchRun struct {
+	Prompt          string             `json:"prompt"`
+	Run             int                `json:"run"`
+	Ms              map[string]float64 `json:"ms"`
+	NodeCount       int                `json:"node_count,omitempty"`
+	StateRoot       string             `json:"state_root,omitempty"`
+	Preimages       int                `json:"preimages,omitempty"`
+	PreimageBytes   int                `json:"preimage_bytes,omitempty"`
+	CheckpointBytes int64              `json:"checkpoint_bytes,omitempty"`
+	// peak rss of the process during the run, on linux only
+	PeakRSSKB int64 `json:"peak_rss_kb,omitempty"`
+}
+
+// BenchReport compares hosts and model branches: fp32, fp16 or fp8
+type BenchReport struct {
+	Model      string                `json:"model"`
+	ModelPath  string                `json:"model_path"`
+	ModelBytes int64                 `json:"model_bytes"`
+	GGUFPath   string                `json:"gguf_path,omitempty"`
+	Program    string                `json:"program"`
+	Host       string                `json:"host"`
+	NumCPU     int                   `json:"num_cpu"`
+	Phases     map[string]PhaseStats `json:"phases"`
+	Runs       []BenchRun            `json:"runs"`
+	PeakRSSKB  int64                 `json:"peak_rss_kb"`
+	// peak rss of the largest llama.cpp process waited for
+	LargestChildRSSKB int64   `json:"largest_child_rss_kb"`
+	TotalMs           float64 `json:"total_ms"`
+}
+
+// resetPeakRSS resets the peak rss of the process to its current rss, false where the kernel
+// does not support it
+func resetPeakRSS() bool {
+	return os.WriteFile("/proc/self/clear_refs", []byte("5"), 0) == nil
+}
+
+// peakRSSSinceReset returns the peak rss in kB of the process since resetPeakRSS, VmHWM
+func peakRSSSinceReset() int64 {
+	status, err := os.ReadFile("/proc/self/status")
+	if err != nil {
+		return 0
+	}
+	for _, line := range strings.Split(string(status), "\n") {
+		if value, ok := strings.CutPrefix(line, "VmHWM:"); ok {
+			kb, _ := strconv.ParseInt(strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(value), "kB")), 10, 64)
+			return kb
+		}
+	}
+	return 0
+}
+
+// peakRSS returns the peak rss in kB over the life of the process, or of the largest child
+// waited for
+func peakRSS(who int) int64 {
+	var usage syscall.Rusage
+	if err := syscall.Getrusage(who, &usage); err != nil {
+		return 0
+	}
+	// bytes on darwin
+	if runtime.GOOS == "darwin" {
+		return int64(usage.Maxrss) / 1024
+	}
+	return int64(usage.Maxrss)
+}
+
+// Bench runs the prompts through the phases runs times, one after the other. It takes a
+// job slot of the worker.
+func Bench(model *models.Model, prompts []string, runs int, phases []string) (*BenchReport, error) {
+	if model.Kind != models.KIND_LLAMA {
+		return nil, fmt.Errorf("model %s of kind %s has no prompt to bench", model.Name, model.Kind)
+	}
+	if err := CheckPhases(phases); err != nil {
+		return nil, err
+	}
+	for _, prompt := range prompts {
+		if err := vm.CheckPrompt(prompt); err != nil {
+			return nil, err
+		}
+	}
+	config := MipsWork.configFor(model)
+	fi, err := os.Stat(config.ModelPath)
+	if err != nil {
+		return nil, err
+	}
+	host, _ := os.Hostname()
+	report := &BenchReport{
+		Model:      model.Name,
+		ModelPath:  config.ModelPath,
+		ModelBytes: fi.Size(),
+		Program:    config.ProgramPath,
+		Host:       host,
+		NumCPU:     runtime.NumCPU(),
+		Phases:     make(map[string]PhaseStats),
+	}
+	if contains(phases, PHASE_LLAMACPP) {
+		if model.GGUF.Path == "" {
+			return nil, fmt.Errorf("model %s has no gguf for the %s phase", model.Name, PHASE_LLAMACPP)
+		}
+		report.GGUFPath = model.GGUF.Path
+	}
+
+	if !MipsWork.startJob() {
+		return nil, common.ErrExceedMaxJobs
+	}
+	defer MipsWork.doneJob()
+	start := time.Now()
+	durations := make(map[string][]time.Duration)
+	for run := 0; run < runs; run++ {
+		for _, prompt := range prompts {
+			r, err := benchRun(config, model, prompt, phases)
+			if err != nil {
+				return nil, fmt.Errorf("run %d of %q: %w", run, prompt, err)
+			}
+			r.Run = run
+			for phase, d := range r.Ms {
+				durations[phase] = append(durations[phase], time.Duration(d*float64(time.Millisecond)))
+			}
+			report.Runs = append(report.Runs, *r)
+		}
+	}
+	for phase, ds := range durations {
+		report.Phases[phase] = phaseStats(ds)
+	}
+	report.TotalMs = ms(time.Since(start))
+	report.PeakRSSKB = peakRSS(syscall.RUSAGE_SELF)
+	report.LargestChildRSSKB = peakRSS(syscall.RUSAGE_CHILDREN)
+	return report, nil
+}
+
+func contains(phases []string, phase string) bool {
+	for _, p := range phases {
+		if p == phase {
+			return true
+		}
+	}
+	return false
+}
+
+// benchRun runs a prompt through the phases in a temporary basedir
+func benchRun(config *vm.Config, model *models.Model, prompt string, phases []string) (*BenchRun, error) {
+	r := &BenchRun{Prompt: prompt, Ms: make(map[string]float64)}
+	if resetPeakRSS() {
+		defer func() { r.PeakRSSKB = peakRSSSinceReset() }()
+	}
+	if contains(phases, PHASE_LLAMACPP) {
+		ctx, cancel := context.WithTimeout(context.Background(), llamago.Timeout)
+		start := time.Now()
+		output, err := llamago.Command(ctx, model, prompt).CombinedOutput()
+		cancel()
+		if err != nil {
+			return nil, fmt.Errorf("llama.cpp: %w: %s", err, tail(output, 512))
+		}
+		r.Ms[PHASE_LLAMACPP] = ms(time.Since(start))
+	}
+	if !contains(phases, PHASE_GRAPH) {
+		return r, nil
+	}
+
+	basedir, err := os.MkdirTemp("", "opml-bench")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(basedir)
+	params := &vm.Params{
+		ModelPath: config.ModelPath,
+		Basedir:   basedir,
+		ModelName: vm.MODEL_LLAMA,
+		Prompt:    prompt,
+	}
+	start := time.Now()
+	nodeFile, nodeCount, err := vm.LayerRun(basedir+"/data", 0, params.ModelName, params)
+	if err != nil {
+		return nil, err
+	}
+	r.Ms[PHASE_GRAPH] = ms(time.Since(start))
+	r.NodeCount = nodeCount
+
+	if contains(phases, PHASE_MIPS) {
+		start := time.Now()
+		root, err := vm.NewMachine(config).MIPSRunRoot(basedir+"/checkpoint", 0, 0, config.ProgramPath, nodeFile, nodeCount)
+		if err != nil {
+			return nil, err
+		}
+		r.Ms[PHASE_MIPS] = ms(time.Since(start))
+		r.StateRoot = root.Hex()
+		fn := filepath.Join(basedir, "checkpoint", "0_golden"+vm.CheckpointExt(config.CheckpointFormat))
+		fi, err := os.Stat(fn)
+		if err != nil {
+			return nil, err
+		}
+		c, err := vm.ReadCheckpoint(fn)
+		if err != nil {
+			return nil, err
+		}
+		r.CheckpointBytes = fi.Size()
+		r.Preimages = len(c.Preimages)
+		r.PreimageBytes = c.PreimageSize()
+	}
+	return r, nil
+}
+
+// tail is the end of the output of a failed command
+func tail(output []byte, n int) string {
+	if len(output) > n {
+		output = output[len(output)-n:]
+	}
+	return strings.TrimSpace(string(output))
+}
@@ -0,0 +1,55 @@
+package mips
+
+import (
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestPhaseStats(t *testing.T) {
+	var ds []time.Duration
+	for i := 100; i >= 1; i-- {
+		ds = append(ds, time.Duration(i)*time.Millisecond)
+	}
+	s := phaseStats(ds)
+	want := PhaseStats{Count: 100, MinMs: 1, MeanMs: 50.5, P50Ms: 50, P90Ms: 90, P99Ms: 99, MaxMs: 100}
+	if s != want {
+		t.Errorf("got %+v, want %+v", s, want)
+	}
+	if ds[0] != 100*time.Millisecond {
+		t.Error("phaseStats sorted its input")
+	}
+	if s := phaseStats([]time.Duration{7 * time.Millisecond}); s.P50Ms != 7 || s.P99Ms != 7 {
+		t.Errorf("single run: %+v", s)
+	}
+}
+
+func TestCheckPhases(t *testing.T) {
+	if err := CheckPhases(BenchPhases); err != nil {
+		t.Error(err)
+	}
+	if err := CheckPhases([]string{PHASE_LLAMACPP}); err != nil {
+		t.Error(err)
+	}
+	for _, phases := range [][]string{nil, {"gpu"}, {PHASE_MIPS}, {PHASE_LLAMACPP, PHASE_MIPS}} {
+		if err := CheckPhases(phases); err == nil {
+			t.Errorf("%v: expected an error", phases)
+		}
+	}
+}
+
+func TestPeakRSSSinceReset(t *testing.T) {
+	if !resetPeakRSS() {
+		t.Skip("no clear_refs")
+	}
+	before := peakRSSSinceReset()
+	b := make([]byte, 64<<20)
+	for i := range b {
+		b[i] = 1
+	}
+	after := peakRSSSinceReset()
+	runtime.KeepAlive(b)
+	if before == 0 || after-before < 60<<10 {
+		t.Fatalf("peak rss %d kB then %d kB", before, after)
+	}
+}
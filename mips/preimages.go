@@ -0,0 +1,59 @@
+package mips
+
+import (
+	"fmt"
+	"opml-opt/common"
+	"opml-opt/log"
+	"opml-opt/mips/vm"
+	"time"
+
+	ethcommon "github.com/ethereum/go-ethereum/common"
+)
+
+// CollectPreimages removes the preimages of the store that no root of the root cache or
+// checkpoint under checkpointDirs reaches. No run may write the store meanwhile, the job
+// slots are taken, a busy worker is an ErrExceedMaxJobs.
+func CollectPreimages(checkpointDirs []string) (int, error) {
+	store, ok := MipsWork.Config.Store.(*vm.DiskPreimageStore)
+	if !ok {
+		return 0, fmt.Errorf("no preimage_dir to collect")
+	}
+	MipsWork.mut.Lock()
+	if MipsWork.JobsNum > 0 {
+		MipsWork.mut.Unlock()
+		return 0, common.ErrExceedMaxJobs
+	}
+	// busy for Status and startJob
+	MipsWork.JobsNum = MipsWork.MaxJobs + 1
+	MipsWork.mut.Unlock()
+	defer func() {
+		MipsWork.mut.Lock()
+		MipsWork.JobsNum = 0
+		MipsWork.mut.Unlock()
+	}()
+
+	var roots []ethcommon.Hash
+	if MipsWork.rootCache != nil {
+		roots = MipsWork.rootCache.LiveRoots()
+	}
+	for _, dir := range checkpointDirs {
+		dirRoots, err := vm.CheckpointRoots(dir)
+		if err != nil {
+			return 0, err
+		}
+		roots = append(roots, dirRoots...)
+	}
+	return store.GC(roots)
+}
+
+// CollectPreimagesEvery runs CollectPreimages every interval, skipped while jobs run
+func CollectPreimagesEvery(interval time.Duration, checkpointDirs []string) {
+	for range time.Tick(interval) {
+		removed, err := CollectPreimages(checkpointDirs)
+		if err != nil {
+			log.Warn("preimage gc skipped:", err)
+			continue
+		}
+		log.Infof("preimage gc removed %d preimages", removed)
+	}
+}
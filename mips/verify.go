@@ -0,0 +1,80 @@
+package mips
+
+import (
+	"fmt"
+	"opml-opt/common"
+	"opml-opt/mips/vm"
+	"opml-opt/models"
+
+	ethcommon "github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+)
+
+// Verdict is the check of a claimed state root against the recomputed golden root
+type Verdict struct {
+	Model       string `json:"model"`
+	Prompt      string `json:"prompt"`
+	ClaimedRoot string `json:"claimed_root"`
+	StateRoot   string `json:"state_root"`
+	NodeCount   int    `json:"node_count"`
+	// keccak of the files the root was computed with
+	ProgramHash string `json:"program_hash"`
+	ModelHash   string `json:"model_hash"`
+	Valid       bool   `json:"valid"`
+}
+
+// Verify recomputes the golden root of the prompt with the pinned files of the model and
+// compares it to the claimed root. It takes a job slot of the worker, hashing included.
+func Verify(model *models.Model, prompt string, claimed string) (verdict *Verdict, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			verdict, err = nil, fmt.Errorf("verify panic: %v", r)
+		}
+	}()
+	if model.Kind != models.KIND_LLAMA {
+		return nil, fmt.Errorf("model %s of kind %s has no prompt to verify", model.Name, model.Kind)
+	}
+	if err := vm.CheckPrompt(prompt); err != nil {
+		return nil, err
+	}
+	b, err := hexutil.Decode(claimed)
+	if err != nil || len(b) != ethcommon.HashLength {
+		return nil, fmt.Errorf("claimed root %q is not a 0x hash", claimed)
+	}
+	claimedRoot := ethcommon.BytesToHash(b)
+	// hashing an unpinned model is as long as a run
+	if !MipsWork.startJob() {
+		return nil, common.ErrExceedMaxJobs
+	}
+	defer MipsWork.doneJob()
+	// the pins are checked with the digests of the verdict, those of the startup check if
+	// the files are unchanged, the root does not depend on the gguf model
+	modelHash, err := model.Model.Digest()
+	if err != nil {
+		return nil, fmt.Errorf("model %s model: %w", model.Name, err)
+	}
+	config := MipsWork.configFor(model)
+	program := model.Program
+	if program.Path == "" {
+		program.Path = config.ProgramPath
+	}
+	programHash, err := program.Digest()
+	if err != nil {
+		return nil, fmt.Errorf("model %s program: %w", model.Name, err)
+	}
+
+	root, nodeCount, err := vm.NewMachine(config).RunCheckPointZeroRoot(prompt)
+	if err != nil {
+		return nil, err
+	}
+	return &Verdict{
+		Model:       model.Name,
+		Prompt:      prompt,
+		ClaimedRoot: claimedRoot.Hex(),
+		StateRoot:   root.Hex(),
+		NodeCount:   nodeCount,
+		ProgramHash: programHash.Hex(),
+		ModelHash:   modelHash.Hex(),
+		Valid:       root == claimedRoot,
+	}, nil
+}
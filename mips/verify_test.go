@@ -0,0 +1,30 @@
+package mips
+
+import (
+	"opml-opt/mips/vm"
+	"opml-opt/models"
+	"path/filepath"
+	"testing"
+)
+
+func TestVerifyRejects(t *testing.T) {
+	InitWorker("", vm.DefaultConfig(), 1)
+	missing := filepath.Join(t.TempDir(), "model.bin")
+	llama := &models.Model{Name: "llama", Kind: models.KIND_LLAMA, Model: models.PinnedFile{Path: missing}}
+	mnist := &models.Model{Name: "mnist", Kind: models.KIND_MNIST, Model: models.PinnedFile{Path: missing}}
+	root := "0x" + "ab00000000000000000000000000000000000000000000000000000000000001"
+	for _, c := range []struct {
+		name  string
+		model *models.Model
+		root  string
+	}{
+		{"mnist model", mnist, root},
+		{"short root", llama, "0xab"},
+		{"root without 0x", llama, root[2:]},
+		{"missing model file", llama, root},
+	} {
+		if _, err := Verify(c.model, "hello", c.root); err == nil {
+			t.Errorf("%s: expected an error", c.name)
+		}
+	}
+}
@@ -0,0 +1,298 @@
+package vm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// binary checkpoint layout, all integers are big endian
+//
+//	magic       [8]byte "OPMLCKPT"
+//	version     uint16
+//	compression uint8
+//	root        [32]byte
+//	step        int64
+//	nodeID      int64
+//	nodeCount   int64
+//	programHash [32]byte
+//	preimages   uint64
+//	nextPC      uint32, from version 2
+//	body        preimages * (uvarint length, rlp node), compressed as a whole
+var checkpointMagic = []byte("OPMLCKPT")
+
+const CHECKPOINT_VERSION = 2
+
+const (
+	FORMAT_BINARY = "binary"
+	FORMAT_JSON   = "json"
+)
+
+const (
+	COMPRESSION_NONE   uint8 = 0
+	COMPRESSION_SNAPPY uint8 = 1
+	COMPRESSION_ZSTD   uint8 = 2
+)
+
+type Checkpoint struct {
+	Root        common.Hash
+	Step        int
+	NodeID      int
+	NodeCount   int
+	ProgramHash common.Hash
+	Preimages   map[common.Hash][]byte
+	// the pc after the one in the ram, the branch target in a delay slot, 0 in the checkpoints
+	// written before it was recorded
+	NextPC uint32
+}
+
+func ParseCompression(name string) (uint8, error) {
+	switch strings.ToLower(name) {
+	case "", "none":
+		return COMPRESSION_NONE, nil
+	case "snappy":
+		return COMPRESSION_SNAPPY, nil
+	case "zstd":
+		return COMPRESSION_ZSTD, nil
+	}
+	return 0, fmt.Errorf("unknown checkpoint compression %s", name)
+}
+
+// CheckpointExt is the file extension of checkpoints written in format
+func CheckpointExt(format string) string {
+	if format == FORMAT_JSON {
+		return ".json"
+	}
+	return ".ckpt"
+}
+
+// CheckFormat checks a checkpoint format
+func CheckFormat(format string) error {
+	if format != FORMAT_JSON && format != FORMAT_BINARY {
+		return fmt.Errorf("unknown checkpoint format %s, expected %s or %s", format, FORMAT_JSON, FORMAT_BINARY)
+	}
+	return nil
+}
+
+// otherCheckpointFile is fn with the extension of the other format, empty if fn has neither
+func otherCheckpointFile(fn string) string {
+	switch filepath.Ext(fn) {
+	case CheckpointExt(FORMAT_JSON):
+		return strings.TrimSuffix(fn, CheckpointExt(FORMAT_JSON)) + CheckpointExt(FORMAT_BINARY)
+	case CheckpointExt(FORMAT_BINARY):
+		return strings.TrimSuffix(fn, CheckpointExt(FORMAT_BINARY)) + CheckpointExt(FORMAT_JSON)
+	}
+	return ""
+}
+
+func (c *Checkpoint) MarshalBinary(compression uint8) ([]byte, error) {
+	keys := make([]common.Hash, 0, len(c.Preimages))
+	for k := range c.Preimages {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return bytes.Compare(keys[i][:], keys[j][:]) < 0 })
+
+	var body bytes.Buffer
+	lenBuf := make([]byte, binary.MaxVarintLen64)
+	for _, k := range keys {
+		node := c.Preimages[k]
+		n := binary.PutUvarint(lenBuf, uint64(len(node)))
+		body.Write(lenBuf[:n])
+		body.Write(node)
+	}
+
+	var out bytes.Buffer
+	out.Write(checkpointMagic)
+	binary.Write(&out, binary.BigEndian, uint16(CHECKPOINT_VERSION))
+	out.WriteByte(compression)
+	out.Write(c.Root[:])
+	binary.Write(&out, binary.BigEndian, int64(c.Step))
+	binary.Write(&out, binary.BigEndian, int64(c.NodeID))
+	binary.Write(&out, binary.BigEndian, int64(c.NodeCount))
+	out.Write(c.ProgramHash[:])
+	binary.Write(&out, binary.BigEndian, uint64(len(keys)))
+	binary.Write(&out, binary.BigEndian, c.NextPC)
+
+	switch compression {
+	case COMPRESSION_NONE:
+		out.Write(body.Bytes())
+	case COMPRESSION_SNAPPY:
+		out.Write(snappy.Encode(nil, body.Bytes()))
+	case COMPRESSION_ZSTD:
+		enc, err := zstd.NewWriter(nil)
+		if err != nil {
+			return nil, err
+		}
+		out.Write(enc.EncodeAll(body.Bytes(), nil))
+		enc.Close()
+	default:
+		return nil, fmt.Errorf("unknown checkpoint compression %d", compression)
+	}
+	return out.Bytes(), nil
+}
+
+func (c *Checkpoint) UnmarshalBinary(dat []byte) error {
+	r := bytes.NewReader(dat)
+	magic := make([]byte, len(checkpointMagic))
+	if _, err := io.ReadFull(r, magic); err != nil || !bytes.Equal(magic, checkpointMagic) {
+		return errors.New("not a binary checkpoint")
+	}
+	var header struct {
+		Version     uint16
+		Compression uint8
+		Root        common.Hash
+		Step        int64
+		NodeID      int64
+		NodeCount   int64
+		ProgramHash common.Hash
+		Preimages   uint64
+	}
+	if err := binary.Read(r, binary.BigEndian, &header); err != nil {
+		return fmt.Errorf("read checkpoint header: %v", err)
+	}
+	if header.Version < 1 || header.Version > CHECKPOINT_VERSION {
+		return fmt.Errorf("unsupported checkpoint version %d", header.Version)
+	}
+	var nextPC uint32
+	if header.Version >= 2 {
+		if err := binary.Read(r, binary.BigEndian, &nextPC); err != nil {
+			return fmt.Errorf("read checkpoint header: %v", err)
+		}
+	}
+
+	rest := dat[len(dat)-r.Len():]
+	var body []byte
+	var err error
+	switch header.Compression {
+	case COMPRESSION_NONE:
+		body = rest
+	case COMPRESSION_SNAPPY:
+		body, err = snappy.Decode(nil, rest)
+	case COMPRESSION_ZSTD:
+		var dec *zstd.Decoder
+		dec, err = zstd.NewReader(nil)
+		if err == nil {
+			body, err = dec.DecodeAll(rest, nil)
+			dec.Close()
+		}
+	default:
+		err = fmt.Errorf("unknown checkpoint compression %d", header.Compression)
+	}
+	if err != nil {
+		return err
+	}
+
+	// an entry is its size varint then the node, the count is bounded by the body before the
+	// map is sized with it
+	if header.Preimages > uint64(len(body)) {
+		return fmt.Errorf("%d preimages in a body of %d bytes", header.Preimages, len(body))
+	}
+	preimages := make(map[common.Hash][]byte, header.Preimages)
+	br := bytes.NewReader(body)
+	for i := uint64(0); i < header.Preimages; i++ {
+		size, err := binary.ReadUvarint(br)
+		if err != nil {
+			return fmt.Errorf("read preimage %d: %v", i, err)
+		}
+		if size > uint64(br.Len()) {
+			return fmt.Errorf("preimage %d truncated", i)
+		}
+		node := make([]byte, size)
+		if _, err := io.ReadFull(br, node); err != nil {
+			return fmt.Errorf("read preimage %d: %v", i, err)
+		}
+		preimages[crypto.Keccak256Hash(node)] = node
+	}
+	if br.Len() != 0 {
+		return fmt.Errorf("%d bytes after the preimages", br.Len())
+	}
+
+	c.Root = header.Root
+	c.Step = int(header.Step)
+	c.NodeID = int(header.NodeID)
+	c.NodeCount = int(header.NodeCount)
+	c.ProgramHash = header.ProgramHash
+	c.Preimages = preimages
+	c.NextPC = nextPC
+	return nil
+}
+
+// ToJson exports the checkpoint in the Jtree format
+func (c *Checkpoint) ToJson() ([]byte, error) {
+	return json.Marshal(Jtree{Preimages: c.Preimages, Step: c.Step, NodeID: c.NodeID, NodeCount: c.NodeCount, Root: c.Root, NextPC: c.NextPC})
+}
+
+// CheckpointFromBytes decodes a binary or a json checkpoint
+func CheckpointFromBytes(dat []byte) (*Checkpoint, error) {
+	c := &Checkpoint{}
+	if bytes.HasPrefix(dat, checkpointMagic) {
+		return c, c.UnmarshalBinary(dat)
+	}
+	var j Jtree
+	if err := json.Unmarshal(dat, &j); err != nil {
+		return nil, err
+	}
+	c.Root = j.Root
+	c.Step = j.Step
+	c.NodeID = j.NodeID
+	c.NodeCount = j.NodeCount
+	c.Preimages = j.Preimages
+	c.NextPC = j.NextPC
+	return c, nil
+}
+
+// ReadCheckpoint reads a binary or json checkpoint, a missing file is looked up with the
+// extension of the other format, as written before a format change
+func ReadCheckpoint(fn string) (*Checkpoint, error) {
+	dat, err := ioutil.ReadFile(fn)
+	if os.IsNotExist(err) {
+		other := otherCheckpointFile(fn)
+		if other != "" {
+			if odat, oerr := ioutil.ReadFile(other); oerr == nil {
+				dat, err = odat, nil
+			}
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return CheckpointFromBytes(dat)
+}
+
+// WriteCheckpointFile writes c in format and returns the encoded size
+func WriteCheckpointFile(c *Checkpoint, fn string, format string, compression uint8) (int, error) {
+	var dat []byte
+	var err error
+	if format == FORMAT_JSON {
+		dat, err = c.ToJson()
+	} else {
+		dat, err = c.MarshalBinary(compression)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return len(dat), ioutil.WriteFile(fn, dat, 0644)
+}
+
+// TrieFromCheckpoint loads the preimages of a binary or json checkpoint, like TrieFromJson
+func TrieFromCheckpoint(dat []byte) (common.Hash, int, error) {
+	c, err := CheckpointFromBytes(dat)
+	if err != nil {
+		return common.Hash{}, 0, err
+	}
+	Preimages = c.Preimages
+	return c.Root, c.Step, nil
+}
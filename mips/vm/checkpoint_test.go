@@ -0,0 +1,113 @@
+package vm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"path/filepath"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/oracle"
+)
+
+func TestCheckpointRoundTrip(t *testing.T) {
+	_, ram := loadTestProgram()
+	Preimages = make(map[common.Hash][]byte)
+	root := RamToTrie(ram)
+	c := &Checkpoint{
+		Root:      root,
+		Step:      -1,
+		NodeID:    3,
+		NodeCount: 1000,
+		Preimages: Preimages,
+	}
+	c.ProgramHash[0] = 0x42
+
+	for _, compression := range []uint8{COMPRESSION_NONE, COMPRESSION_SNAPPY, COMPRESSION_ZSTD} {
+		dat, err := c.MarshalBinary(compression)
+		if err != nil {
+			t.Fatal(err)
+		}
+		d, err := CheckpointFromBytes(dat)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d.Root != c.Root || d.Step != c.Step || d.NodeID != c.NodeID || d.NodeCount != c.NodeCount || d.ProgramHash != c.ProgramHash {
+			t.Fatalf("compression %d: header mismatch %+v", compression, d)
+		}
+		if len(d.Preimages) != len(c.Preimages) {
+			t.Fatalf("compression %d: got %d preimages, expected %d", compression, len(d.Preimages), len(c.Preimages))
+		}
+		for k, v := range c.Preimages {
+			if !bytes.Equal(d.Preimages[k], v) {
+				t.Fatalf("compression %d: preimage %s mismatch", compression, k)
+			}
+		}
+	}
+
+	dat, err := c.ToJson()
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := CheckpointFromBytes(dat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Root != root || len(d.Preimages) != len(c.Preimages) {
+		t.Fatal("json checkpoint mismatch")
+	}
+
+	// the oracle writes every node it reads under its root
+	oracle.SetRoot(t.TempDir())
+	Preimages = d.Preimages
+	rram, err := RamFromTrie(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for addr, v := range ram {
+		if rram[addr] != v {
+			t.Fatalf("%x: got %x, expected %x", addr, rram[addr], v)
+		}
+	}
+}
+
+func TestReadCheckpointOtherFormat(t *testing.T) {
+	c := &Checkpoint{Root: common.HexToHash("0x0a"), Step: -1, Preimages: map[common.Hash][]byte{}}
+	dir := t.TempDir()
+	if _, err := WriteCheckpointFile(c, filepath.Join(dir, "0_golden.json"), FORMAT_JSON, COMPRESSION_NONE); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := WriteCheckpointFile(c, filepath.Join(dir, "1_golden.ckpt"), FORMAT_BINARY, COMPRESSION_ZSTD); err != nil {
+		t.Fatal(err)
+	}
+	// the name of the checkpoint in the other format
+	for _, fn := range []string{"0_golden.ckpt", "1_golden.json"} {
+		d, err := ReadCheckpoint(filepath.Join(dir, fn))
+		if err != nil || d.Root != c.Root {
+			t.Fatalf("%s: got %v %v", fn, d, err)
+		}
+	}
+	if _, err := ReadCheckpoint(filepath.Join(dir, "2_golden.json")); err == nil {
+		t.Fatal("expected an error for a missing checkpoint")
+	}
+}
+
+func TestCheckpointPreimageCount(t *testing.T) {
+	c := &Checkpoint{Root: common.HexToHash("0x0a"), Preimages: map[common.Hash][]byte{common.Hash{}: []byte("node")}}
+	dat, err := c.MarshalBinary(COMPRESSION_NONE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the count is before the next pc, the last word of the header, and the 5 bytes of the body
+	count := len(dat) - 5 - 4 - 8
+	for _, n := range []uint64{1 << 62, 6, 2, 0} {
+		crafted := append([]byte{}, dat...)
+		binary.BigEndian.PutUint64(crafted[count:], n)
+		if _, err := CheckpointFromBytes(crafted); err == nil {
+			t.Fatalf("%d preimages decoded from a body of one", n)
+		}
+	}
+	if _, err := CheckpointFromBytes(dat[:len(dat)-1]); err == nil {
+		t.Fatal("truncated preimage decoded")
+	}
+}
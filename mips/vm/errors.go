@@ -0,0 +1,76 @@
+package vm
+
+import "fmt"
+
+// LoadError is returned when the program, model or input of a run can not be loaded
+type LoadError struct {
+	What string // program, model, input
+	Path string
+	Err  error
+}
+
+func (e *LoadError) Error() string {
+	return fmt.Sprintf("load %s %s: %v", e.What, e.Path, e.Err)
+}
+
+func (e *LoadError) Unwrap() error {
+	return e.Err
+}
+
+// InterruptError is raised by any interrupt but the syscall one
+type InterruptError struct {
+	Intno uint32
+	Step  int
+	PC    uint32
+}
+
+func (e *InterruptError) Error() string {
+	return fmt.Sprintf("invalid interrupt %d at step %d pc %x", e.Intno, e.Step, e.PC)
+}
+
+// WriteSizeError is a store that is not 1, 2 or 4 bytes wide
+type WriteSizeError struct {
+	Size int
+	Addr uint32
+	Step int
+}
+
+func (e *WriteSizeError) Error() string {
+	return fmt.Sprintf("bad size %d write to %x at step %d", e.Size, e.Addr, e.Step)
+}
+
+// LimitError is a run stopped by the step budget or the wall clock limit of the Config
+type LimitError struct {
+	Limit string // steps, duration
+	Step  int
+	PC    uint32
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("%s limit exceeded at step %d pc %x", e.Limit, e.Step, e.PC)
+}
+
+// TrieError is a failure to build, read or persist the memory trie
+type TrieError struct {
+	Op  string
+	Err error
+}
+
+func (e *TrieError) Error() string {
+	return fmt.Sprintf("trie %s: %v", e.Op, e.Err)
+}
+
+func (e *TrieError) Unwrap() error {
+	return e.Err
+}
+
+// ResumeError is a checkpoint a run can not resume from
+type ResumeError struct {
+	Step   int
+	PC     uint32
+	Reason string
+}
+
+func (e *ResumeError) Error() string {
+	return fmt.Sprintf("can not resume at step %d pc %x: %s", e.Step, e.PC, e.Reason)
+}
@@ -0,0 +1,44 @@
+package vm
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/oracle"
+)
+
+type failingStore struct {
+	*MemoryPreimageStore
+}
+
+func (s failingStore) Put(value []byte) (common.Hash, error) {
+	return common.Hash{}, errors.New("disk full")
+}
+
+func TestTrieErrors(t *testing.T) {
+	_, ram := loadTestProgram()
+	m := NewMachine(&Config{Store: failingStore{NewMemoryPreimageStore()}})
+	m.Ram = ram
+	var terr *TrieError
+	if _, err := m.RamRoot(); !errors.As(err, &terr) {
+		t.Fatalf("expected trie error, got %v", err)
+	}
+	m.TrackRam()
+	if _, err := m.RamRoot(); !errors.As(err, &terr) {
+		t.Fatalf("expected trie error, got %v", err)
+	}
+
+	oracle.SetRoot(t.TempDir())
+	if _, err := RamFromTrieWith(common.Hash{1}, nil, nil); !errors.As(err, &terr) {
+		t.Fatalf("expected trie error for a missing root, got %v", err)
+	}
+}
+
+func TestLoadDataUnaligned(t *testing.T) {
+	ram := make(map[uint32](uint32))
+	LoadData([]byte{1, 2, 3, 4, 5, 6}, ram, 0x100)
+	if ram[0x100] != 0x01020304 || ram[0x104] != 0x05060000 {
+		t.Fatalf("got %x %x", ram[0x100], ram[0x104])
+	}
+}
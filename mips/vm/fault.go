@@ -0,0 +1,225 @@
+package vm
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common"
+	uc "github.com/unicorn-engine/unicorn/bindings/go/unicorn"
+	"mlgo/ml"
+)
+
+// fault kinds, a machine with faults plays a dishonest operator in the dispute game
+const (
+	FAULT_REG    = "reg"    // set register Reg to Value at Step
+	FAULT_MEM    = "mem"    // xor the word at Addr with Value at Step
+	FAULT_WRITE  = "write"  // record Value instead of every store to the word at Addr
+	FAULT_ORACLE = "oracle" // xor the bytes of the preimage of Hash (any if zero) with Value
+	FAULT_NODE   = "node"   // xor the bits of element Index of graph node Node with Value
+)
+
+// Fault is a deterministic fault. Reg indexes the register file of the ram layout:
+// 0-31, 32 PC, 33 HI, 34 LO. A zero Value of a xor fault flips all bits.
+type Fault struct {
+	Kind  string
+	Step  int
+	Reg   int
+	Addr  uint32
+	Hash  common.Hash
+	Node  int
+	Index int
+	Value uint32
+}
+
+type Faults []Fault
+
+// ParseFault reads the spec of a fault:
+//
+//	reg:<step>:<reg>:<value>
+//	mem:<step>:<addr>[:<mask>]
+//	write:<addr>:<value>
+//	oracle:<hash|*>[:<mask>]
+//	node:<node>:<index>[:<mask>]
+func ParseFault(spec string) (Fault, error) {
+	parts := strings.Split(spec, ":")
+	f := Fault{Kind: parts[0]}
+	args := parts[1:]
+	nums := make([]uint64, len(args))
+	for i, arg := range args {
+		if f.Kind == FAULT_ORACLE && i == 0 {
+			continue
+		}
+		n, err := strconv.ParseUint(arg, 0, 32)
+		if err != nil {
+			return f, fmt.Errorf("bad fault %s: %v", spec, err)
+		}
+		nums[i] = n
+	}
+	// required and optional arguments of each kind
+	var min, max int
+	switch f.Kind {
+	case FAULT_REG:
+		min, max = 3, 3
+		if len(args) == 3 {
+			f.Step, f.Reg, f.Value = int(nums[0]), int(nums[1]), uint32(nums[2])
+		}
+	case FAULT_MEM:
+		min, max = 2, 3
+		if len(args) >= 2 {
+			f.Step, f.Addr = int(nums[0]), uint32(nums[1])
+		}
+	case FAULT_WRITE:
+		min, max = 2, 2
+		if len(args) == 2 {
+			f.Addr, f.Value = uint32(nums[0]), uint32(nums[1])
+		}
+	case FAULT_ORACLE:
+		min, max = 1, 2
+		if len(args) >= 1 && args[0] != "*" {
+			f.Hash = common.HexToHash(args[0])
+		}
+	case FAULT_NODE:
+		min, max = 2, 3
+		if len(args) >= 2 {
+			f.Node, f.Index = int(nums[0]), int(nums[1])
+		}
+	default:
+		return f, fmt.Errorf("unknown fault kind %s", f.Kind)
+	}
+	if len(args) < min || len(args) > max {
+		return f, fmt.Errorf("bad fault %s: expected %d to %d arguments", spec, min, max)
+	}
+	if f.Kind != FAULT_REG && f.Kind != FAULT_WRITE && len(args) == max {
+		f.Value = uint32(nums[max-1])
+	}
+	if f.Kind == FAULT_REG && f.Reg > 34 {
+		return f, fmt.Errorf("bad fault %s: no register %d", spec, f.Reg)
+	}
+	return f, nil
+}
+
+func (f Fault) mask() uint32 {
+	if f.Value == 0 {
+		return 0xFFFFFFFF
+	}
+	return f.Value
+}
+
+// String and Set make Faults a repeatable flag
+func (fs *Faults) String() string {
+	return fmt.Sprint(*fs)
+}
+
+func (fs *Faults) Set(spec string) error {
+	f, err := ParseFault(spec)
+	if err != nil {
+		return err
+	}
+	*fs = append(*fs, f)
+	return nil
+}
+
+// apply applies the register and memory faults of step to ram through writeRam
+func (fs Faults) apply(step int, ram map[uint32](uint32), writeRam func(uint32, uint32)) {
+	for _, f := range fs {
+		if f.Step != step {
+			continue
+		}
+		switch f.Kind {
+		case FAULT_REG:
+			fmt.Printf("reg fault at step %d: r%d = %x\n", step, f.Reg, f.Value)
+			writeRam(REG_OFFSET+uint32(f.Reg)*4, f.Value)
+		case FAULT_MEM:
+			fmt.Printf("mem fault at step %d: %x ^= %x\n", step, f.Addr, f.mask())
+			writeRam(f.Addr&^3, ram[f.Addr&^3]^f.mask())
+		}
+	}
+}
+
+// applyUnicorn applies the register and memory faults of step to the emulator and ram
+func (fs Faults) applyUnicorn(step int, mu uc.Unicorn, m *Machine) {
+	for _, f := range fs {
+		if f.Step != step {
+			continue
+		}
+		switch f.Kind {
+		case FAULT_REG:
+			fmt.Printf("reg fault at step %d: r%d = %x\n", step, f.Reg, f.Value)
+			mu.RegWrite(ucReg(f.Reg), uint64(f.Value))
+		case FAULT_MEM:
+			addr := f.Addr &^ 3
+			fmt.Printf("mem fault at step %d: %x ^= %x\n", step, addr, f.mask())
+			value := m.Ram[addr] ^ f.mask()
+			tmp := []byte{0, 0, 0, 0}
+			binary.BigEndian.PutUint32(tmp, value)
+			mu.MemWrite(uint64(addr), tmp)
+			m.WriteRam(addr, value)
+		}
+	}
+}
+
+func ucReg(reg int) int {
+	switch reg {
+	case 32:
+		return uc.MIPS_REG_PC
+	case 33:
+		return uc.MIPS_REG_HI
+	case 34:
+		return uc.MIPS_REG_LO
+	}
+	return uc.MIPS_REG_ZERO + reg
+}
+
+// write returns the word recorded for a store to the word at addr, a byte or halfword store
+// is merged into the word before, both engines fault the same word
+func (fs Faults) write(addr uint32, value uint32) uint32 {
+	for _, f := range fs {
+		if f.Kind == FAULT_WRITE && f.Addr&^3 == addr {
+			fmt.Printf("injecting output fault over %x\n", value)
+			value = f.Value
+		}
+	}
+	return value
+}
+
+// Oracle wraps oracle with the oracle faults
+func (fs Faults) Oracle(oracle Oracle) Oracle {
+	return func(hash common.Hash) ([]byte, error) {
+		value, err := oracle(hash)
+		if err != nil {
+			return value, err
+		}
+		for _, f := range fs {
+			if f.Kind == FAULT_ORACLE && (f.Hash == common.Hash{} || f.Hash == hash) {
+				fmt.Printf("oracle fault on %s\n", hash)
+				value = common.CopyBytes(value)
+				for i := range value {
+					value[i] ^= byte(f.mask())
+				}
+			}
+		}
+		return value, nil
+	}
+}
+
+// ApplyNodeFaults tampers with the computed outputs of the graph nodes
+func (fs Faults) ApplyNodeFaults(graph *ml.Graph) error {
+	for _, f := range fs {
+		if f.Kind != FAULT_NODE {
+			continue
+		}
+		if f.Node < 0 || f.Node >= int(graph.NodesCount) {
+			return fmt.Errorf("node fault: no node %d", f.Node)
+		}
+		data := graph.Nodes[f.Node].Data
+		if f.Index < 0 || f.Index >= len(data) {
+			return fmt.Errorf("node fault: node %d has no element %d", f.Node, f.Index)
+		}
+		fmt.Printf("node fault: node %d[%d] ^= %x\n", f.Node, f.Index, f.mask())
+		data[f.Index] = math.Float32frombits(math.Float32bits(data[f.Index]) ^ f.mask())
+	}
+	return nil
+}
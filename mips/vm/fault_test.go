@@ -0,0 +1,126 @@
+package vm
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"mlgo/ml"
+)
+
+func TestParseFault(t *testing.T) {
+	tests := []struct {
+		spec string
+		want Fault
+	}{
+		{"reg:100:2:0xbabababa", Fault{Kind: FAULT_REG, Step: 100, Reg: 2, Value: 0xbabababa}},
+		{"mem:5:0x30000804", Fault{Kind: FAULT_MEM, Step: 5, Addr: 0x30000804}},
+		{"mem:5:0x30000804:0xff", Fault{Kind: FAULT_MEM, Step: 5, Addr: 0x30000804, Value: 0xff}},
+		{"write:0x30000804:0xbabababa", Fault{Kind: FAULT_WRITE, Addr: 0x30000804, Value: 0xbabababa}},
+		{"oracle:*", Fault{Kind: FAULT_ORACLE}},
+		{"oracle:0x01:1", Fault{Kind: FAULT_ORACLE, Hash: common.HexToHash("0x01"), Value: 1}},
+		{"node:3:7", Fault{Kind: FAULT_NODE, Node: 3, Index: 7}},
+	}
+	for _, tt := range tests {
+		got, err := ParseFault(tt.spec)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.spec, err)
+		}
+		if got != tt.want {
+			t.Fatalf("%s: got %+v, expected %+v", tt.spec, got, tt.want)
+		}
+	}
+	for _, spec := range []string{"reg:1:2", "reg:1:40:0", "mem:x:1", "write:1", "disk:1", "node:1"} {
+		if _, err := ParseFault(spec); err == nil {
+			t.Fatalf("%s: expected an error", spec)
+		}
+	}
+}
+
+func TestInterpreterFaults(t *testing.T) {
+	_, honest := loadTestProgram()
+	if err := NewInterpreter(honest, nil).Run(1000); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, spec := range []string{"reg:3:9:0xbabababa", "mem:0:0x1000", "write:0x30000000:0xbabababa"} {
+		f, err := ParseFault(spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := NewMachine(nil)
+		_, m.Ram = loadTestProgram()
+		m.Faults = Faults{f}
+		if err := m.Interpreter("").Run(1000); err != nil {
+			t.Fatal(err)
+		}
+		if RamToTrie(m.Ram) == RamToTrie(honest) {
+			t.Fatalf("%s: same root as the honest run", spec)
+		}
+	}
+}
+
+func TestOracleFault(t *testing.T) {
+	store := NewMemoryPreimageStore()
+	hash, _ := store.Put([]byte{1, 2, 3})
+	other, _ := store.Put([]byte{4})
+	oracle := Faults{{Kind: FAULT_ORACLE, Hash: hash, Value: 0x0f}}.Oracle(StoreOracle(store))
+	if got, _ := oracle(hash); !bytes.Equal(got, []byte{0x0e, 0x0d, 0x0c}) {
+		t.Fatalf("got %x", got)
+	}
+	if got, _ := oracle(other); !bytes.Equal(got, []byte{4}) {
+		t.Fatalf("other preimage tampered: %x", got)
+	}
+	if got, _ := store.Get(hash); !bytes.Equal(got, []byte{1, 2, 3}) {
+		t.Fatalf("store tampered: %x", got)
+	}
+}
+
+func TestNodeFault(t *testing.T) {
+	graph := &ml.Graph{NodesCount: 1}
+	graph.Nodes[0] = &ml.Tensor{Data: []float32{1, 2}}
+	if err := (Faults{{Kind: FAULT_NODE, Node: 0, Index: 1, Value: 0x80000000}}).ApplyNodeFaults(graph); err != nil {
+		t.Fatal(err)
+	}
+	if graph.Nodes[0].Data[0] != 1 || graph.Nodes[0].Data[1] != -2 {
+		t.Fatalf("got %v", graph.Nodes[0].Data)
+	}
+	if err := (Faults{{Kind: FAULT_NODE, Node: 1}}).ApplyNodeFaults(graph); err == nil {
+		t.Fatal("expected an error for a missing node")
+	}
+}
+
+// a sub-word store is faulted after its merge, the unicorn hook and the interpreter record
+// the same word
+func TestSubWordWriteFault(t *testing.T) {
+	faults := Faults{{Kind: FAULT_WRITE, Addr: 0x1000, Value: 0xbabababa}}
+	for _, tt := range []struct {
+		insn uint32
+		size int
+	}{
+		{iType(0x28, rT0, rT1, 2), 1}, // sb
+		{iType(0x29, rT0, rT1, 2), 2}, // sh
+	} {
+		ram := make(map[uint32](uint32))
+		ram[0x1000] = 0x11223344
+		in := NewInterpreter(ram, nil)
+		in.Faults = faults
+		in.setReg(rT0, 0x1000)
+		in.setReg(rT1, 0xAABBCCDD)
+		ram[0] = tt.insn
+		WriteRam(ram, REG_PC, 0)
+		if err := in.Step(); err != nil {
+			t.Fatal(err)
+		}
+
+		m := NewMachine(nil)
+		m.Faults = faults
+		m.Ram[0x1000] = 0x11223344
+		if err := m.memWrite(0x1002, tt.size, 0xAABBCCDD); err != nil {
+			t.Fatal(err)
+		}
+		if ram[0x1000] != 0xbabababa || m.Ram[0x1000] != ram[0x1000] {
+			t.Fatalf("%08x: interpreter %08x, unicorn hook %08x", tt.insn, ram[0x1000], m.Ram[0x1000])
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package vm
+
+import (
+	"sort"
+)
+
+// names of the words at REG_OFFSET, as SyncRegs writes them
+var REG_NAMES = [...]string{
+	"zero", "at", "v0", "v1", "a0", "a1", "a2", "a3",
+	"t0", "t1", "t2", "t3", "t4", "t5", "t6", "t7",
+	"s0", "s1", "s2", "s3", "s4", "s5", "s6", "s7",
+	"t8", "t9", "k0", "k1", "gp", "sp", "fp", "ra",
+	"pc", "hi", "lo", "heap",
+}
+
+// Registers of a checkpoint, Heap is the next heap offset
+type Registers struct {
+	GPR  [32]uint32
+	PC   uint32
+	HI   uint32
+	LO   uint32
+	Heap uint32
+}
+
+func RegistersFromRam(ram map[uint32](uint32)) Registers {
+	var regs Registers
+	for i := range regs.GPR {
+		regs.GPR[i] = ram[REG_OFFSET+uint32(i)*4]
+	}
+	regs.PC = ram[REG_PC]
+	regs.HI = ram[REG_OFFSET+0x21*4]
+	regs.LO = ram[REG_OFFSET+0x22*4]
+	regs.Heap = ram[REG_HEAP]
+	return regs
+}
+
+// RegName names the register word at addr, empty outside of the registers
+func RegName(addr uint32) string {
+	if addr < REG_OFFSET || addr >= REG_OFFSET+uint32(len(REG_NAMES))*4 || addr%4 != 0 {
+		return ""
+	}
+	return REG_NAMES[(addr-REG_OFFSET)/4]
+}
+
+// Ram rebuilds the ram of the checkpoint from its preimages
+func (c *Checkpoint) Ram() (map[uint32](uint32), error) {
+	return RamFromTrieWith(c.Root, c.Preimages, nil)
+}
+
+// PreimageSize is the size of the trie nodes of the checkpoint
+func (c *Checkpoint) PreimageSize() int {
+	size := 0
+	for _, node := range c.Preimages {
+		size += len(node)
+	}
+	return size
+}
+
+// WordDiff is a word of two rams that differs, a word not in a ram is zero
+type WordDiff struct {
+	Addr uint32
+	A    uint32
+	B    uint32
+}
+
+// DiffRam lists the words that differ between a and b by address
+func DiffRam(a map[uint32](uint32), b map[uint32](uint32)) []WordDiff {
+	var diffs []WordDiff
+	for addr, va := range a {
+		if vb := b[addr]; va != vb {
+			diffs = append(diffs, WordDiff{Addr: addr, A: va, B: vb})
+		}
+	}
+	for addr, vb := range b {
+		if _, ok := a[addr]; !ok && vb != 0 {
+			diffs = append(diffs, WordDiff{Addr: addr, A: 0, B: vb})
+		}
+	}
+	sort.Slice(diffs, func(i, j int) bool { return diffs[i].Addr < diffs[j].Addr })
+	return diffs
+}
+
+// CheckpointRam reads a checkpoint file and rebuilds its ram
+func CheckpointRam(fn string) (*Checkpoint, map[uint32](uint32), error) {
+	c, err := ReadCheckpoint(fn)
+	if err != nil {
+		return nil, nil, err
+	}
+	ram, err := c.Ram()
+	return c, ram, err
+}
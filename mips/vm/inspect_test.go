@@ -0,0 +1,47 @@
+package vm
+
+import (
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/oracle"
+)
+
+func TestInspectCheckpoint(t *testing.T) {
+	ram := map[uint32](uint32){
+		HEAP_ADDR:           0x11223344,
+		HEAP_ADDR + 4:       0x55667788,
+		REG_OFFSET + 29*4:   0x7fffd000,
+		REG_PC:              0x400180,
+		REG_OFFSET + 0x22*4: 7,
+		REG_HEAP:            0x1000,
+	}
+	preimages := make(map[common.Hash][]byte)
+	root, err := RamToTrieWith(ram, PreimageKeyValueWriter{Preimages: preimages})
+	if err != nil {
+		t.Fatal(err)
+	}
+	oracle.SetRoot(t.TempDir())
+	c := &Checkpoint{Root: root, Preimages: preimages}
+	got, err := c.Ram()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diffs := DiffRam(ram, got); len(diffs) != 0 {
+		t.Fatalf("ram differs after the trie: %v", diffs)
+	}
+
+	regs := RegistersFromRam(got)
+	if regs.GPR[29] != 0x7fffd000 || regs.PC != 0x400180 || regs.LO != 7 || regs.Heap != 0x1000 {
+		t.Fatalf("got %+v", regs)
+	}
+	if RegName(REG_OFFSET+29*4) != "sp" || RegName(REG_HEAP) != "heap" || RegName(HEAP_ADDR) != "" {
+		t.Fatal("register names")
+	}
+
+	other := map[uint32](uint32){HEAP_ADDR: 0x11223344, HEAP_ADDR + 4: 0x55667789, HEAP_ADDR + 8: 1}
+	diffs := DiffRam(map[uint32](uint32){HEAP_ADDR: 0x11223344, HEAP_ADDR + 4: 0x55667788, HEAP_ADDR + 12: 0}, other)
+	if len(diffs) != 2 || diffs[0] != (WordDiff{HEAP_ADDR + 4, 0x55667788, 0x55667789}) || diffs[1] != (WordDiff{HEAP_ADDR + 8, 0, 1}) {
+		t.Fatalf("got %v", diffs)
+	}
+}
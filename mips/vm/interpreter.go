@@ -0,0 +1,487 @@
+package vm
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// pure go MIPS32 big endian interpreter, it runs on the same ram layout as unicorn
+// (registers at REG_OFFSET, PC at REG_PC, heap pointer at REG_HEAP), so a single
+// step can be re-executed against a memory rebuilt from the trie, like MIPS.sol
+
+var REG_HI uint32 = REG_OFFSET + 0x21*4
+var REG_LO uint32 = REG_OFFSET + 0x22*4
+
+const (
+	HEAP_ADDR   = 0x20000000
+	ORACLE_ADDR = 0x30001000
+	EXIT_PC     = 0x5ead0000
+	STOP_PC     = 0x5ead0004
+)
+
+// Oracle returns the preimage of hash, it backs syscall 4020
+type Oracle func(hash common.Hash) ([]byte, error)
+
+// FileOracle reads preimages from <root>/<hash>, like the unicorn syscall hook without a Store
+func FileOracle(root string) Oracle {
+	return StoreOracle(NewDiskPreimageStore(root))
+}
+
+type Interpreter struct {
+	Ram    map[uint32](uint32)
+	Oracle Oracle
+	Steps  int
+	Faults Faults
+	// allocations past it fail
+	MaxHeapSize uint64
+
+	// in the delay slot of a branch to target, the ram has no word for it
+	delay  bool
+	target uint32
+
+	writeRam    func(addr uint32, value uint32)
+	writeOutput func(fd int, b []byte)
+	stepped     func(pc uint32)
+}
+
+func NewInterpreter(ram map[uint32](uint32), oracle Oracle) *Interpreter {
+	in := &Interpreter{
+		Ram:         ram,
+		Oracle:      oracle,
+		MaxHeapSize: MAX_HEAP_SIZE,
+	}
+	in.writeRam = func(addr uint32, value uint32) {
+		WriteRam(in.Ram, addr, value)
+	}
+	in.writeOutput = WriteBytes
+	return in
+}
+
+func (in *Interpreter) reg(r uint32) uint32 {
+	if r == 0 {
+		return 0
+	}
+	return in.Ram[REG_OFFSET+r*4]
+}
+
+func (in *Interpreter) setReg(r uint32, value uint32) {
+	if r == 0 {
+		return
+	}
+	in.writeRam(REG_OFFSET+r*4, value)
+}
+
+func (in *Interpreter) PC() uint32 {
+	return in.Ram[REG_PC]
+}
+
+func (in *Interpreter) Exited() bool {
+	pc := in.PC()
+	return pc == EXIT_PC || pc == STOP_PC
+}
+
+// Step executes one instruction, the delay slot of a branch or jump is a step of its own
+// like in unicorn
+func (in *Interpreter) Step() error {
+	if in.Exited() {
+		return nil
+	}
+	in.Faults.apply(in.Steps, in.Ram, in.writeRam)
+	pc, nextPC := in.PC(), in.NextPC()
+	if in.delay && isBranch(in.Ram[pc]) {
+		return fmt.Errorf("jump in delay slot at pc %x", pc)
+	}
+	in.delay = false
+	err := in.stepPC(pc, nextPC)
+	if err != nil {
+		return err
+	}
+	if in.stepped != nil {
+		in.stepped(pc)
+	}
+	in.Steps += 1
+	return nil
+}
+
+// NextPC is the pc of the step after the current one, the branch target in a delay slot
+func (in *Interpreter) NextPC() uint32 {
+	if in.delay {
+		return in.target
+	}
+	return in.PC() + 4
+}
+
+// SetNextPC resumes a run at the current pc followed by nextPC, a delay slot if it is not pc+4
+func (in *Interpreter) SetNextPC(nextPC uint32) {
+	in.delay = nextPC != in.PC()+4
+	in.target = nextPC
+}
+
+// Run steps until the program exits or maxSteps steps are executed, maxSteps < 0 means no limit
+func (in *Interpreter) Run(maxSteps int) error {
+	for i := 0; maxSteps < 0 || i < maxSteps; i++ {
+		if in.Exited() {
+			return nil
+		}
+		if err := in.Step(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func signExtend(v uint32, bits uint32) uint32 {
+	shift := 32 - bits
+	return uint32(int32(v<<shift) >> shift)
+}
+
+func (in *Interpreter) stepPC(pc uint32, nextPC uint32) error {
+	insn := in.Ram[pc]
+	opcode := insn >> 26
+	fun := insn & 0x3f
+	rsIdx := (insn >> 21) & 0x1f
+	rtIdx := (insn >> 16) & 0x1f
+	rdIdx := (insn >> 11) & 0x1f
+	rs := in.reg(rsIdx)
+	rt := in.reg(rtIdx)
+
+	// J, JAL
+	if opcode == 2 || opcode == 3 {
+		target := in.branchTarget(pc)
+		if opcode == 3 {
+			in.setReg(31, pc+8)
+		}
+		return in.delaySlot(nextPC, target)
+	}
+
+	// branches
+	if opcode == 1 || (opcode >= 4 && opcode < 8) {
+		target := in.branchTarget(pc)
+		// BLTZAL, BGEZAL
+		if opcode == 1 && rtIdx&0x10 != 0 {
+			in.setReg(31, pc+8)
+		}
+		return in.delaySlot(nextPC, target)
+	}
+
+	if opcode == 0 {
+		switch fun {
+		case 0x08, 0x09: // JR, JALR
+			target := in.branchTarget(pc)
+			if fun == 0x09 {
+				in.setReg(rdIdx, pc+8)
+			}
+			return in.delaySlot(nextPC, target)
+		case 0x0c: // SYSCALL
+			if err := in.syscall(); err != nil {
+				return err
+			}
+			// the exit syscall moves PC itself
+			if in.PC() != EXIT_PC {
+				in.writeRam(REG_PC, nextPC)
+			}
+			return nil
+		case 0x0f: // SYNC
+		case 0x10: // MFHI
+			in.setReg(rdIdx, in.Ram[REG_HI])
+		case 0x11: // MTHI
+			in.writeRam(REG_HI, rs)
+		case 0x12: // MFLO
+			in.setReg(rdIdx, in.Ram[REG_LO])
+		case 0x13: // MTLO
+			in.writeRam(REG_LO, rs)
+		case 0x18: // MULT
+			acc := uint64(int64(int32(rs)) * int64(int32(rt)))
+			in.writeRam(REG_HI, uint32(acc>>32))
+			in.writeRam(REG_LO, uint32(acc))
+		case 0x19: // MULTU
+			acc := uint64(rs) * uint64(rt)
+			in.writeRam(REG_HI, uint32(acc>>32))
+			in.writeRam(REG_LO, uint32(acc))
+		case 0x1a: // DIV
+			if rt != 0 {
+				in.writeRam(REG_HI, uint32(int32(rs)%int32(rt)))
+				in.writeRam(REG_LO, uint32(int32(rs)/int32(rt)))
+			}
+		case 0x1b: // DIVU
+			if rt != 0 {
+				in.writeRam(REG_HI, rs%rt)
+				in.writeRam(REG_LO, rs/rt)
+			}
+		case 0x0a: // MOVZ
+			if rt == 0 {
+				in.setReg(rdIdx, rs)
+			}
+		case 0x0b: // MOVN
+			if rt != 0 {
+				in.setReg(rdIdx, rs)
+			}
+		default:
+			val, err := aluR(insn, fun, rs, rt)
+			if err != nil {
+				return fmt.Errorf("%v at pc %x", err, pc)
+			}
+			in.setReg(rdIdx, val)
+		}
+		in.writeRam(REG_PC, nextPC)
+		return nil
+	}
+
+	// SPECIAL2
+	if opcode == 0x1c {
+		switch fun {
+		case 0x02: // MUL
+			in.setReg(rdIdx, uint32(int32(rs)*int32(rt)))
+		case 0x20, 0x21: // CLZ, CLO
+			v := rs
+			if fun == 0x21 {
+				v = ^v
+			}
+			n := uint32(0)
+			for ; n < 32 && v&0x80000000 == 0; n++ {
+				v <<= 1
+			}
+			in.setReg(rdIdx, n)
+		default:
+			return fmt.Errorf("invalid instruction %08x at pc %x", insn, pc)
+		}
+		in.writeRam(REG_PC, nextPC)
+		return nil
+	}
+
+	imm := insn & 0xFFFF
+	simm := signExtend(imm, 16)
+	switch opcode {
+	case 0x08, 0x09: // ADDI, ADDIU
+		in.setReg(rtIdx, rs+simm)
+	case 0x0a: // SLTI
+		in.setReg(rtIdx, boolToU32(int32(rs) < int32(simm)))
+	case 0x0b: // SLTIU
+		in.setReg(rtIdx, boolToU32(rs < simm))
+	case 0x0c: // ANDI
+		in.setReg(rtIdx, rs&imm)
+	case 0x0d: // ORI
+		in.setReg(rtIdx, rs|imm)
+	case 0x0e: // XORI
+		in.setReg(rtIdx, rs^imm)
+	case 0x0f: // LUI
+		in.setReg(rtIdx, imm<<16)
+	default:
+		if opcode < 0x20 || opcode > 0x38 {
+			return fmt.Errorf("invalid instruction %08x at pc %x", insn, pc)
+		}
+		if err := in.loadStore(insn, opcode, rs+simm, rtIdx, rt); err != nil {
+			return fmt.Errorf("%v at pc %x", err, pc)
+		}
+	}
+	in.writeRam(REG_PC, nextPC)
+	return nil
+}
+
+// delaySlot moves to the delay slot at nextPC, the step after it jumps to target
+func (in *Interpreter) delaySlot(nextPC uint32, target uint32) error {
+	in.writeRam(REG_PC, nextPC)
+	in.delay = true
+	in.target = target
+	return nil
+}
+
+// branchTarget is where the branch or jump at pc goes with the current registers, the pc
+// after its delay slot if it is not taken
+func (in *Interpreter) branchTarget(pc uint32) uint32 {
+	insn := in.Ram[pc]
+	opcode := insn >> 26
+	rtIdx := (insn >> 16) & 0x1f
+	rs := in.reg((insn >> 21) & 0x1f)
+	rt := in.reg(rtIdx)
+	shouldBranch := false
+	switch opcode {
+	case 0: // JR, JALR
+		return rs
+	case 2, 3: // J, JAL
+		return ((pc + 4) & 0xF0000000) | ((insn & 0x03FFFFFF) << 2)
+	case 1:
+		if rtIdx&1 == 0 {
+			shouldBranch = int32(rs) < 0 // BLTZ, BLTZAL
+		} else {
+			shouldBranch = int32(rs) >= 0 // BGEZ, BGEZAL
+		}
+	case 4:
+		shouldBranch = rs == rt // BEQ
+	case 5:
+		shouldBranch = rs != rt // BNE
+	case 6:
+		shouldBranch = int32(rs) <= 0 // BLEZ
+	case 7:
+		shouldBranch = int32(rs) > 0 // BGTZ
+	}
+	if shouldBranch {
+		return pc + 4 + (signExtend(insn&0xFFFF, 16) << 2)
+	}
+	return pc + 8
+}
+
+// isBranch tells if insn is a branch or a jump, the next instruction is its delay slot
+func isBranch(insn uint32) bool {
+	opcode := insn >> 26
+	return opcode == 1 || (opcode >= 2 && opcode < 8) || (opcode == 0 && (insn&0x3f == 8 || insn&0x3f == 9))
+}
+
+func boolToU32(b bool) uint32 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func aluR(insn uint32, fun uint32, rs uint32, rt uint32) (uint32, error) {
+	shamt := (insn >> 6) & 0x1f
+	switch fun {
+	case 0x00: // SLL
+		return rt << shamt, nil
+	case 0x02: // SRL
+		return rt >> shamt, nil
+	case 0x03: // SRA
+		return uint32(int32(rt) >> shamt), nil
+	case 0x04: // SLLV
+		return rt << (rs & 0x1f), nil
+	case 0x06: // SRLV
+		return rt >> (rs & 0x1f), nil
+	case 0x07: // SRAV
+		return uint32(int32(rt) >> (rs & 0x1f)), nil
+	case 0x20, 0x21: // ADD, ADDU
+		return rs + rt, nil
+	case 0x22, 0x23: // SUB, SUBU
+		return rs - rt, nil
+	case 0x24: // AND
+		return rs & rt, nil
+	case 0x25: // OR
+		return rs | rt, nil
+	case 0x26: // XOR
+		return rs ^ rt, nil
+	case 0x27: // NOR
+		return ^(rs | rt), nil
+	case 0x2a: // SLT
+		return boolToU32(int32(rs) < int32(rt)), nil
+	case 0x2b: // SLTU
+		return boolToU32(rs < rt), nil
+	}
+	return 0, fmt.Errorf("invalid instruction %08x", insn)
+}
+
+func (in *Interpreter) loadStore(insn uint32, opcode uint32, addr uint32, rtIdx uint32, rt uint32) error {
+	waddr := addr &^ 3
+	mem := in.Ram[waddr]
+	// byte offset from the most significant byte, memory is big endian
+	off := addr & 3
+	switch opcode {
+	case 0x20: // LB
+		in.setReg(rtIdx, signExtend((mem>>(24-off*8))&0xFF, 8))
+	case 0x24: // LBU
+		in.setReg(rtIdx, (mem>>(24-off*8))&0xFF)
+	case 0x21: // LH
+		in.setReg(rtIdx, signExtend((mem>>(16-(off&2)*8))&0xFFFF, 16))
+	case 0x25: // LHU
+		in.setReg(rtIdx, (mem>>(16-(off&2)*8))&0xFFFF)
+	case 0x23, 0x30: // LW, LL
+		in.setReg(rtIdx, mem)
+	case 0x22: // LWL
+		val := mem << (off * 8)
+		mask := uint32(0xFFFFFFFF) << (off * 8)
+		in.setReg(rtIdx, (rt&^mask)|val)
+	case 0x26: // LWR
+		val := mem >> (24 - off*8)
+		mask := uint32(0xFFFFFFFF) >> (24 - off*8)
+		in.setReg(rtIdx, (rt&^mask)|val)
+	case 0x28: // SB
+		shift := 24 - off*8
+		mask := uint32(0xFF) << shift
+		in.store(waddr, (mem&^mask)|((rt&0xFF)<<shift))
+	case 0x29: // SH
+		shift := 16 - (off&2)*8
+		mask := uint32(0xFFFF) << shift
+		in.store(waddr, (mem&^mask)|((rt&0xFFFF)<<shift))
+	case 0x2b: // SW
+		in.store(waddr, rt)
+	case 0x38: // SC
+		in.store(waddr, rt)
+		in.setReg(rtIdx, 1)
+	case 0x2a: // SWL
+		val := rt >> (off * 8)
+		mask := uint32(0xFFFFFFFF) >> (off * 8)
+		in.store(waddr, (mem&^mask)|val)
+	case 0x2e: // SWR
+		val := rt << (24 - off*8)
+		mask := uint32(0xFFFFFFFF) << (24 - off*8)
+		in.store(waddr, (mem&^mask)|val)
+	default:
+		return fmt.Errorf("invalid instruction %08x", insn)
+	}
+	return nil
+}
+
+// store writes a word stored by the program
+func (in *Interpreter) store(addr uint32, value uint32) {
+	in.writeRam(addr, in.Faults.write(addr, value))
+}
+
+// syscall mirrors the HOOK_INTR handler of GetHookedUnicorn
+func (in *Interpreter) syscall() error {
+	syscallNo := in.reg(2)
+	v0 := uint32(0)
+	switch syscallNo {
+	case 4020:
+		hash := common.Hash{}
+		for i := uint32(0); i < 0x20; i += 4 {
+			binary.BigEndian.PutUint32(hash[i:i+4], in.Ram[ORACLE_ADDR+i])
+		}
+		if in.Oracle != nil {
+			value, err := in.Faults.Oracle(in.Oracle)(hash)
+			if err == nil {
+				in.writeRam(INPUT_ADDR, uint32(len(value)))
+				value = append(value, 0, 0, 0)
+				for i := uint32(0); i < in.Ram[INPUT_ADDR]; i += 4 {
+					in.writeRam(INPUT_ADDR+4+i, binary.BigEndian.Uint32(value[i:i+4]))
+				}
+			}
+		}
+	case 4004:
+		fd := in.reg(4)
+		buf := in.reg(5)
+		count := in.reg(6)
+		in.writeOutput(int(fd), in.readBytes(buf, count))
+	case 4090:
+		a0 := in.reg(4)
+		sz := in.reg(5)
+		if a0 == 0 {
+			if uint64(in.Ram[REG_HEAP])+uint64(sz) > in.MaxHeapSize {
+				return &LayoutError{Region: "heap", Start: HEAP_ADDR, Size: uint64(in.Ram[REG_HEAP]) + uint64(sz), Limit: HEAP_ADDR + in.MaxHeapSize}
+			}
+			v0 = HEAP_ADDR + in.Ram[REG_HEAP]
+			in.writeRam(REG_HEAP, in.Ram[REG_HEAP]+sz)
+		} else {
+			v0 = a0
+		}
+	case 4045:
+		v0 = 0x40000000
+	case 4120:
+		v0 = 1
+	case 4246:
+		// exit group
+		in.writeRam(REG_PC, EXIT_PC)
+	}
+	in.setReg(2, v0)
+	in.setReg(7, 0)
+	return nil
+}
+
+func (in *Interpreter) readBytes(addr uint32, count uint32) []byte {
+	ret := make([]byte, count)
+	for i := uint32(0); i < count; i++ {
+		a := addr + i
+		ret[i] = byte(in.Ram[a&^3] >> (24 - (a&3)*8))
+	}
+	return ret
+}
@@ -0,0 +1,239 @@
+package vm
+
+import (
+	"testing"
+
+	uc "github.com/unicorn-engine/unicorn/bindings/go/unicorn"
+)
+
+const (
+	rZero = 0
+	rV0   = 2
+	rA0   = 4
+	rA1   = 5
+	rT0   = 8
+	rT1   = 9
+	rT2   = 10
+	rT3   = 11
+	rT4   = 12
+	rT5   = 13
+	rT6   = 14
+	rRA   = 31
+)
+
+func rType(rs, rt, rd, shamt, fun uint32) uint32 {
+	return rs<<21 | rt<<16 | rd<<11 | shamt<<6 | fun
+}
+
+func iType(op, rs, rt uint32, imm int32) uint32 {
+	return op<<26 | rs<<21 | rt<<16 | uint32(imm)&0xFFFF
+}
+
+func jType(op, target uint32) uint32 {
+	return op<<26 | (target>>2)&0x03FFFFFF
+}
+
+// sums 10..1, stores the result as a byte, calls a function with a value set in the delay slot,
+// multiplies, maps some heap and exits
+var testProgram = []uint32{
+	iType(0x09, rZero, rT0, 10),     // 0x00 addiu t0, zero, 10
+	iType(0x09, rZero, rT1, 0),      // 0x04 addiu t1, zero, 0
+	rType(rT1, rT0, rT1, 0, 0x21),   // 0x08 addu t1, t1, t0
+	iType(0x09, rT0, rT0, -1),       // 0x0c addiu t0, t0, -1
+	iType(0x05, rT0, rZero, -3),     // 0x10 bne t0, zero, 0x08
+	0,                               // 0x14 nop
+	iType(0x0f, rZero, rT2, 0x3000), // 0x18 lui t2, 0x3000
+	iType(0x28, rT2, rT1, 3),        // 0x1c sb t1, 3(t2)
+	iType(0x23, rT2, rT3, 0),        // 0x20 lw t3, 0(t2)
+	jType(0x03, 0x60),               // 0x24 jal 0x60
+	iType(0x09, rZero, rT4, 7),      // 0x28 addiu t4, zero, 7
+	rType(rT1, rT4, 0, 0, 0x18),     // 0x2c mult t1, t4
+	rType(0, 0, rT5, 0, 0x12),       // 0x30 mflo t5
+	iType(0x09, rZero, rV0, 4090),   // 0x34 addiu v0, zero, 4090
+	iType(0x09, rZero, rA0, 0),      // 0x38 addiu a0, zero, 0
+	iType(0x09, rZero, rA1, 0x1000), // 0x3c addiu a1, zero, 0x1000
+	0xc,                             // 0x40 syscall
+	rType(rV0, 0, rT0, 0, 0x21),     // 0x44 addu t0, v0, zero
+	iType(0x09, rZero, rV0, 4246),   // 0x48 addiu v0, zero, 4246
+	0xc,                             // 0x4c syscall
+	0,                               // 0x50
+	0,                               // 0x54
+	0,                               // 0x58
+	0,                               // 0x5c
+	rType(0, rT4, rT6, 2, 0x00),     // 0x60 sll t6, t4, 2
+	rType(rRA, 0, 0, 0, 0x08),       // 0x64 jr ra
+	0,                               // 0x68 nop
+}
+
+func loadTestProgram() ([]byte, map[uint32](uint32)) {
+	dat := make([]byte, len(testProgram)*4)
+	for i, insn := range testProgram {
+		copy(dat[i*4:], IntToBytes(int(insn)))
+	}
+	ram := make(map[uint32](uint32))
+	ZeroRegisters(ram)
+	LoadData(dat, ram, 0)
+	return dat, ram
+}
+
+func TestInterpreterRun(t *testing.T) {
+	_, ram := loadTestProgram()
+	in := NewInterpreter(ram, nil)
+	if err := in.Run(1000); err != nil {
+		t.Fatal(err)
+	}
+	if !in.Exited() {
+		t.Fatalf("program did not exit, pc %x", in.PC())
+	}
+	expected := map[uint32]uint32{
+		rT0: HEAP_ADDR,
+		rT1: 55,
+		rT3: 55,
+		rT4: 7,
+		rT5: 385,
+		rT6: 28,
+		rRA: 0x2c,
+	}
+	for r, v := range expected {
+		if got := in.reg(r); got != v {
+			t.Errorf("reg %d: got %x, expected %x", r, got, v)
+		}
+	}
+	if ram[REG_HEAP] != 0x1000 {
+		t.Errorf("heap: got %x, expected 0x1000", ram[REG_HEAP])
+	}
+	// 2 setup, 10 loop iterations of 4 steps and 17 more steps until the exit syscall,
+	// the delay slots of branches and jumps are steps of their own
+	if in.Steps != 2+10*4+17 {
+		t.Errorf("steps: got %d", in.Steps)
+	}
+}
+
+func TestInterpreterLoadStore(t *testing.T) {
+	ram := make(map[uint32](uint32))
+	in := NewInterpreter(ram, nil)
+	ram[0x1000] = 0x11223344
+	in.setReg(rT0, 0x1000)
+	in.setReg(rT1, 0xAABBCCDD)
+
+	tests := []struct {
+		insn uint32
+		reg  uint32
+		mem  uint32
+		want uint32
+	}{
+		{iType(0x20, rT0, rT2, 1), rT2, 0x11223344, 0x22},          // lb
+		{iType(0x20, rT0, rT2, 0), rT2, 0x81223344, 0xFFFFFF81},    // lb sign extends
+		{iType(0x24, rT0, rT2, 0), rT2, 0x81223344, 0x81},          // lbu
+		{iType(0x21, rT0, rT2, 2), rT2, 0x1122F344, 0xFFFFF344},    // lh
+		{iType(0x25, rT0, rT2, 2), rT2, 0x1122F344, 0xF344},        // lhu
+		{iType(0x28, rT0, rT1, 2), 0, 0x11223344, 0x1122DD44},      // sb
+		{iType(0x29, rT0, rT1, 0), 0, 0x11223344, 0xCCDD3344},      // sh
+		{iType(0x2a, rT0, rT1, 1), 0, 0x11223344, 0x11AABBCC},      // swl
+		{iType(0x2e, rT0, rT1, 1), 0, 0x11223344, 0xCCDD3344},      // swr
+		{iType(0x22, rT0, rT1, 1), rT1, 0x11223344, 0x223344DD},    // lwl
+		{iType(0x26, rT0, rT1, 1), rT1, 0x11223344, 0xAABB1122},    // lwr
+		{iType(0x38, rT0, rT1, 0), rT1, 0x11223344, 1},             // sc
+		{rType(0, rT1, rT2, 4, 0x00), rT2, 0x11223344, 0xABBCCDD0}, // sll
+		{rType(0, rT1, rT2, 4, 0x03), rT2, 0x11223344, 0xFAABBCCD}, // sra
+	}
+	for i, tt := range tests {
+		ram[0x1000] = tt.mem
+		in.setReg(rT1, 0xAABBCCDD)
+		in.setReg(rT2, 0)
+		ram[0] = tt.insn
+		WriteRam(ram, REG_PC, 0)
+		if err := in.Step(); err != nil {
+			t.Fatalf("%d: %v", i, err)
+		}
+		got := ram[0x1000]
+		if tt.reg != 0 {
+			got = in.reg(tt.reg)
+		}
+		if got != tt.want {
+			t.Errorf("%d: %08x got %08x, expected %08x", i, tt.insn, got, tt.want)
+		}
+	}
+}
+
+// run the same program in unicorn and the interpreter, the final ram, its root and the step
+// count must be the same
+func TestInterpreterMatchUnicorn(t *testing.T) {
+	dat, ram := loadTestProgram()
+	in := NewInterpreter(ram, nil)
+	if err := in.Run(1000); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := uc.NewUnicorn(uc.ARCH_MIPS, uc.MODE_32|uc.MODE_BIG_ENDIAN)
+	if err != nil {
+		t.Skip("unicorn not available: ", err)
+	}
+	m := NewMachine(nil)
+	uram := m.Ram
+	mu, err := m.GetHookedUnicorn("", func(step int, mu uc.Unicorn, ram map[uint32](uint32)) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mu.Close()
+	ZeroRegisters(uram)
+	LoadBytesToUnicorn(mu, dat, uram, 0)
+	mu.Start(0, STOP_PC)
+	m.SyncRegs(mu)
+
+	// unicorn executes one more nop at the exit address
+	if m.Steps != in.Steps+1 {
+		t.Errorf("steps: unicorn %d, interpreter %d", m.Steps-1, in.Steps)
+	}
+	uram[REG_PC] = ram[REG_PC]
+	if RamToTrie(uram) != RamToTrie(ram) {
+		t.Error("root mismatch")
+	}
+	for addr := range uram {
+		if uram[addr] != ram[addr] {
+			t.Errorf("%x: unicorn %x, interpreter %x", addr, uram[addr], ram[addr])
+		}
+	}
+	for addr := range ram {
+		if uram[addr] != ram[addr] {
+			t.Errorf("%x: unicorn %x, interpreter %x", addr, uram[addr], ram[addr])
+		}
+	}
+}
+
+func TestInterpreterDelaySlotStep(t *testing.T) {
+	_, ram := loadTestProgram()
+	in := NewInterpreter(ram, nil)
+	// up to the bne of the first iteration
+	if err := in.Run(5); err != nil {
+		t.Fatal(err)
+	}
+	if in.PC() != 0x14 || in.NextPC() != 0x08 {
+		t.Fatalf("after the branch: pc %x next %x", in.PC(), in.NextPC())
+	}
+	if err := in.Step(); err != nil {
+		t.Fatal(err)
+	}
+	if in.PC() != 0x08 || in.NextPC() != 0x0c || in.Steps != 6 {
+		t.Fatalf("after the delay slot: pc %x next %x step %d", in.PC(), in.NextPC(), in.Steps)
+	}
+
+	// a run resumed in the delay slot ends like the whole run
+	_, ram = loadTestProgram()
+	in = NewInterpreter(ram, nil)
+	in.Run(5)
+	resumed := make(map[uint32](uint32))
+	for addr, v := range ram {
+		resumed[addr] = v
+	}
+	again := NewInterpreter(resumed, nil)
+	again.Steps = in.Steps
+	again.SetNextPC(in.NextPC())
+	in.Run(1000)
+	if err := again.Run(1000); err != nil {
+		t.Fatal(err)
+	}
+	if again.Steps != in.Steps || RamToTrie(resumed) != RamToTrie(ram) {
+		t.Fatalf("resumed run of %d steps differs from the run of %d", again.Steps, in.Steps)
+	}
+}
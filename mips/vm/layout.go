@@ -0,0 +1,133 @@
+package vm
+
+import (
+	"fmt"
+	"os"
+	"sort"
+)
+
+// regions of the mapped memory, unicorn maps [0, MEM_END)
+const (
+	IO_ADDR = 0x30000000 // magic, oracle hash
+	MEM_END = 0x80000000
+
+	MAX_HEAP_SIZE   = IO_ADDR - HEAP_ADDR
+	MAX_INPUT_SIZE  = OUTPUT_ADDR - INPUT_ADDR - 4
+	MAX_OUTPUT_SIZE = MODEL_ADDR - OUTPUT_ADDR - 4
+	MAX_MODEL_SIZE  = MEM_END - MODEL_ADDR - 4
+)
+
+// the node env of mlgo, the input of a node run: the node id and op words, then for each
+// of the two sources a header of type, dims, ne[4], nb[4] and data size words and its data
+const (
+	NODE_ENV_HEADER = 2 * 4
+	TENSOR_HEADER   = (1 + 1 + 4 + 4 + 1) * 4
+)
+
+// shape of the llama graph
+const (
+	LLAMA_EMBD  = 4096
+	LLAMA_HEADS = 32
+)
+
+// NodeEnvSize is the size of the node env whose sources hold src0 and src1 float32
+func NodeEnvSize(src0 uint64, src1 uint64) uint64 {
+	return NODE_ENV_HEADER + 2*TENSOR_HEADER + (src0+src1)*4
+}
+
+// PromptInputSize is the size of the largest node env of the llama graph of n tokens, the
+// KQV node of an attention layer: the values, n rows of LLAMA_EMBD, and the soft max of
+// the scores, n by n for each of the LLAMA_HEADS. The weights are read from the model.
+func PromptInputSize(tokens uint64) uint64 {
+	return NodeEnvSize(tokens*LLAMA_EMBD, tokens*tokens*LLAMA_HEADS)
+}
+
+// MAX_PROMPT_LENGTH is the longest prompt whose tokens, a byte of the prompt at least,
+// and the beginning of sentence token fit the input region
+var MAX_PROMPT_LENGTH = maxPromptLength()
+
+func maxPromptLength() int {
+	// the most tokens that fit
+	tokens := sort.Search(MAX_INPUT_SIZE, func(n int) bool {
+		return PromptInputSize(uint64(n)+1) > MAX_INPUT_SIZE
+	})
+	return tokens - 1
+}
+
+// LayoutError is a region that does not fit in its place of the memory layout
+type LayoutError struct {
+	Region string
+	Start  uint64
+	Size   uint64
+	Limit  uint64
+}
+
+func (e *LayoutError) Error() string {
+	return fmt.Sprintf("%s of %d bytes at %x overruns %x by %d bytes", e.Region, e.Size, e.Start, e.Limit, e.Start+e.Size-e.Limit)
+}
+
+// MemoryLayout is the size of the regions loaded before a run, 0 for the ones not loaded
+type MemoryLayout struct {
+	Program int64
+	Input   int64
+	Model   int64
+}
+
+// LayoutOf reads the size of the files loaded by a run, empty paths are not loaded
+func LayoutOf(programPath string, inputPath string, modelPath string) (MemoryLayout, error) {
+	var l MemoryLayout
+	for _, r := range []struct {
+		what string
+		path string
+		size *int64
+	}{{"program", programPath, &l.Program}, {"input", inputPath, &l.Input}, {"model", modelPath, &l.Model}} {
+		if r.path == "" {
+			continue
+		}
+		fi, err := os.Stat(r.path)
+		if err != nil {
+			return l, &LoadError{What: r.what, Path: r.path, Err: err}
+		}
+		*r.size = fi.Size()
+	}
+	return l, nil
+}
+
+// Validate checks that every region ends before the next one starts:
+// program and heap below IO_ADDR, input with its size word below OUTPUT_ADDR,
+// model with its size word below MEM_END
+func (l MemoryLayout) Validate() error {
+	regions := []struct {
+		name  string
+		start uint64
+		size  int64
+		limit uint64
+	}{
+		{"program", 0, l.Program, HEAP_ADDR},
+		{"input", INPUT_ADDR, l.Input + 4, OUTPUT_ADDR},
+		{"model", MODEL_ADDR, l.Model + 4, MEM_END},
+	}
+	for _, r := range regions {
+		if r.start+uint64(r.size) > r.limit {
+			return &LayoutError{Region: r.name, Start: r.start, Size: uint64(r.size), Limit: r.limit}
+		}
+	}
+	return nil
+}
+
+// CheckLayout validates the layout of the files loaded by a run
+func CheckLayout(programPath string, inputPath string, modelPath string) error {
+	l, err := LayoutOf(programPath, inputPath, modelPath)
+	if err != nil {
+		return err
+	}
+	return l.Validate()
+}
+
+// CheckPrompt checks that the node input of a prompt fits in the input region
+func CheckPrompt(prompt string) error {
+	if len(prompt) > MAX_PROMPT_LENGTH {
+		return &LayoutError{Region: "prompt", Start: INPUT_ADDR, Size: PromptInputSize(uint64(len(prompt))+1) + 4, Limit: OUTPUT_ADDR}
+	}
+	return nil
+}
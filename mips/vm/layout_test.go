@@ -0,0 +1,88 @@
+package vm
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMemoryLayoutValidate(t *testing.T) {
+	tests := []struct {
+		layout MemoryLayout
+		region string
+	}{
+		{MemoryLayout{Program: 1 << 20, Input: 1 << 20, Model: 1 << 30}, ""},
+		{MemoryLayout{Input: MAX_INPUT_SIZE, Model: MAX_MODEL_SIZE}, ""},
+		{MemoryLayout{Program: HEAP_ADDR + 1}, "program"},
+		{MemoryLayout{Input: MAX_INPUT_SIZE + 1}, "input"},
+		{MemoryLayout{Model: MAX_MODEL_SIZE + 1}, "model"},
+	}
+	for _, tt := range tests {
+		err := tt.layout.Validate()
+		var lerr *LayoutError
+		if tt.region == "" {
+			if err != nil {
+				t.Fatalf("%+v: %v", tt.layout, err)
+			}
+		} else if !errors.As(err, &lerr) || lerr.Region != tt.region {
+			t.Fatalf("%+v: expected %s error, got %v", tt.layout, tt.region, err)
+		}
+	}
+}
+
+func TestCheckLayoutFiles(t *testing.T) {
+	dir := t.TempDir()
+	program := filepath.Join(dir, "program")
+	os.WriteFile(program, make([]byte, 64), 0644)
+	if err := CheckLayout(program, "", ""); err != nil {
+		t.Fatal(err)
+	}
+	var lerr *LoadError
+	if err := CheckLayout(program, filepath.Join(dir, "missing"), ""); !errors.As(err, &lerr) || lerr.What != "input" {
+		t.Fatalf("expected input load error, got %v", err)
+	}
+}
+
+func TestCheckPrompt(t *testing.T) {
+	if err := CheckPrompt(strings.Repeat("a", MAX_PROMPT_LENGTH)); err != nil {
+		t.Fatal(err)
+	}
+	if err := CheckPrompt(strings.Repeat("a", MAX_PROMPT_LENGTH+1)); err == nil {
+		t.Fatal("expected a too long prompt")
+	}
+}
+
+func TestPromptInputBoundary(t *testing.T) {
+	// the node env of the longest prompt and its beginning of sentence token fits with its size word
+	fits := MemoryLayout{Input: int64(PromptInputSize(uint64(MAX_PROMPT_LENGTH) + 1))}
+	if err := fits.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	over := MemoryLayout{Input: int64(PromptInputSize(uint64(MAX_PROMPT_LENGTH) + 2))}
+	var lerr *LayoutError
+	if err := over.Validate(); !errors.As(err, &lerr) || lerr.Region != "input" {
+		t.Fatalf("expected input layout error, got %v", err)
+	}
+	if got := NodeEnvSize(3, 5); got != NODE_ENV_HEADER+2*TENSOR_HEADER+32 {
+		t.Fatalf("node env of 8 float32 is %d bytes", got)
+	}
+}
+
+func TestInterpreterHeapLimit(t *testing.T) {
+	_, ram := loadTestProgram()
+	ram[REG_HEAP] = MAX_HEAP_SIZE - 0x10
+	var lerr *LayoutError
+	if err := NewInterpreter(ram, nil).Run(1000); !errors.As(err, &lerr) || lerr.Region != "heap" {
+		t.Fatalf("expected heap layout error, got %v", err)
+	}
+
+	// the heap cap of the config
+	_, ram = loadTestProgram()
+	m := NewMachine(&Config{MaxHeapSize: 0x10})
+	m.Ram = ram
+	if err := m.Interpreter(t.TempDir()).Run(1000); !errors.As(err, &lerr) || lerr.Limit != HEAP_ADDR+0x10 {
+		t.Fatalf("expected heap layout error at %x, got %v", HEAP_ADDR+0x10, err)
+	}
+}
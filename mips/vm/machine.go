@@ -0,0 +1,245 @@
+package vm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+const (
+	DEFAULT_MIPS_PROGRAM = "./mlgo/ml_mips/ml_mips.bin"
+	DEFAULT_MODEL_PATH   = "./llama-7b-fp32.bin"
+)
+
+type Config struct {
+	ProgramPath           string
+	ModelPath             string
+	CheckpointFormat      string
+	CheckpointCompression uint8
+	// Store shares trie nodes and oracle data between runs, if nil the oracle
+	// reads <root>/<hash> of the run and the nodes are only kept in the machine
+	Store PreimageStore
+	// MaxSteps and MaxDuration stop a run with a LimitError, 0 means no limit
+	MaxSteps    int
+	MaxDuration time.Duration
+	// MaxHeapSize fails the allocations past it with a heap LayoutError, at most MAX_HEAP_SIZE
+	MaxHeapSize uint64
+	// runs record the steps in [TraceFrom, TraceTo) to TraceDir if set, TraceTo 0 for no end
+	TraceDir  string
+	TraceFrom int
+	TraceTo   int
+}
+
+func DefaultConfig() *Config {
+	return &Config{
+		ProgramPath:           DEFAULT_MIPS_PROGRAM,
+		ModelPath:             DEFAULT_MODEL_PATH,
+		CheckpointFormat:      FORMAT_JSON,
+		CheckpointCompression: COMPRESSION_ZSTD,
+		MaxHeapSize:           MAX_HEAP_SIZE,
+	}
+}
+
+// Machine owns everything a MIPS run touches: ram, step counter, heap pointer and
+// preimages. Machines share nothing but their read only Config and its Store, so
+// several runs can execute concurrently in one process.
+type Machine struct {
+	Config    *Config
+	Ram       map[uint32](uint32)
+	Steps     int
+	HeapStart uint64
+	Preimages map[common.Hash][]byte
+	// Faults make the machine a dishonest operator, they survive Reset
+	Faults Faults
+
+	programHash common.Hash
+	ramTrie     *RamTrie
+	tracer      *tracer
+	err         error // raised in a unicorn hook
+	stdout      bytes.Buffer
+	stderr      bytes.Buffer
+
+	// pc of the last step, its branch makes the current step a delay slot
+	lastPC  uint32
+	stepped bool
+}
+
+// RunResult is what a run leaves besides its checkpoints: the golden root, the root of
+// the final state if the run ended, the guest writes to fd 1 and 2 and the output region
+type RunResult struct {
+	Root   common.Hash
+	Final  common.Hash
+	Steps  int
+	Stdout []byte
+	Stderr []byte
+	Output []byte
+}
+
+func NewMachine(config *Config) *Machine {
+	if config == nil {
+		config = DefaultConfig()
+	}
+	return &Machine{
+		Config:    config,
+		Ram:       make(map[uint32](uint32)),
+		Preimages: make(map[common.Hash][]byte),
+	}
+}
+
+// Reset clears the memory, counters and preimages before a run, the checkpoints of a run
+// only hold its own trie nodes
+func (m *Machine) Reset() {
+	m.Ram = make(map[uint32](uint32))
+	m.Preimages = make(map[common.Hash][]byte)
+	m.Steps = 0
+	m.HeapStart = 0
+	m.programHash = common.Hash{}
+	m.lastPC, m.stepped = 0, false
+	m.ramTrie = nil
+	m.err = nil
+	m.stdout.Reset()
+	m.stderr.Reset()
+}
+
+// writeOutput captures a write syscall of the guest
+func (m *Machine) writeOutput(fd int, b []byte) {
+	if fd == 1 {
+		m.stdout.Write(b)
+	} else if fd == 2 {
+		m.stderr.Write(b)
+	} else {
+		WriteBytes(fd, b)
+	}
+}
+
+// Result returns the output of the last run, the output region is read from the ram
+func (m *Machine) Result() (*RunResult, error) {
+	output, err := ReadOutput(m.Ram)
+	return &RunResult{
+		Steps:  m.Steps,
+		Stdout: common.CopyBytes(m.stdout.Bytes()),
+		Stderr: common.CopyBytes(m.stderr.Bytes()),
+		Output: output,
+	}, err
+}
+
+// ReadOutput reads the output region, a size word at OUTPUT_ADDR then the data
+func ReadOutput(ram map[uint32](uint32)) ([]byte, error) {
+	size := ram[OUTPUT_ADDR]
+	if size > MAX_OUTPUT_SIZE {
+		return nil, &LayoutError{Region: "output", Start: OUTPUT_ADDR, Size: uint64(size) + 4, Limit: MODEL_ADDR}
+	}
+	output := make([]byte, (size+3)&^3)
+	for i := uint32(0); i < size; i += 4 {
+		binary.BigEndian.PutUint32(output[i:], ram[OUTPUT_ADDR+4+i])
+	}
+	return output[:size], nil
+}
+
+func (m *Machine) WriteRam(addr uint32, value uint32) {
+	WriteRam(m.Ram, addr, value)
+	if m.ramTrie != nil {
+		m.ramTrie.MarkDirty(addr)
+	}
+	// the registers are traced by the instructions
+	if m.tracer != nil && addr < MEM_END {
+		m.tracer.memWrite(addr, value)
+	}
+}
+
+// the most words of ram tracked by a RamTrie, a node of it costs many times the streaming
+// trie rebuilt at each checkpoint, the words of a large model never change
+var ramTrieMaxWords = 1 << 22
+
+// TrackRam builds the incremental trie of the current ram, later writes only rehash their
+// paths. A ram of more words than ramTrieMaxWords is not tracked, its root is rebuilt.
+func (m *Machine) TrackRam() {
+	if len(m.Ram) > ramTrieMaxWords {
+		m.ramTrie = nil
+		return
+	}
+	m.ramTrie = NewRamTrie(m.Ram, m.preimageWriter())
+}
+
+func (m *Machine) preimageWriter() PreimageKeyValueWriter {
+	return PreimageKeyValueWriter{Preimages: m.Preimages, Store: m.Config.Store}
+}
+
+func (m *Machine) preimageStore(root string) PreimageStore {
+	if m.Config.Store != nil {
+		return m.Config.Store
+	}
+	return NewDiskPreimageStore(root)
+}
+
+// Interpreter steps the machine ram in pure go, with the same oracle as the unicorn hook
+func (m *Machine) Interpreter(root string) *Interpreter {
+	in := NewInterpreter(m.Ram, StoreOracle(m.preimageStore(root)))
+	in.writeRam = m.WriteRam
+	in.Faults = m.Faults
+	in.writeOutput = m.writeOutput
+	in.MaxHeapSize = m.maxHeapSize()
+	in.stepped = func(pc uint32) {
+		m.lastPC, m.stepped = pc, true
+	}
+	return in
+}
+
+// maxHeapSize is the heap cap of the config, MAX_HEAP_SIZE if unset or past the layout
+func (m *Machine) maxHeapSize() uint64 {
+	if m.Config.MaxHeapSize == 0 || m.Config.MaxHeapSize > MAX_HEAP_SIZE {
+		return MAX_HEAP_SIZE
+	}
+	return m.Config.MaxHeapSize
+}
+
+func (m *Machine) RamRoot() (common.Hash, error) {
+	var root common.Hash
+	var err error
+	if m.ramTrie != nil {
+		root, err = m.ramTrie.Root(m.Ram)
+	} else {
+		root, err = RamToTrieWith(m.Ram, m.preimageWriter())
+	}
+	if err != nil {
+		return root, &TrieError{Op: "commit", Err: err}
+	}
+	return root, nil
+}
+
+// NextPC is the pc after the one in the ram, the target of the branch of the last step if
+// the current one is its delay slot, the registers of the ram must be synced
+func (m *Machine) NextPC() uint32 {
+	pc := m.Ram[REG_PC]
+	if m.stepped && pc == m.lastPC+4 && isBranch(m.Ram[m.lastPC]) {
+		return NewInterpreter(m.Ram, nil).branchTarget(m.lastPC)
+	}
+	return pc + 4
+}
+
+// WriteCheckpoint appends the extension of the checkpoint format to fn and returns the root
+func (m *Machine) WriteCheckpoint(fn string, step int, nodeID int, nodeCount int) (common.Hash, error) {
+	trieroot, err := m.RamRoot()
+	if err != nil {
+		return trieroot, err
+	}
+	c := &Checkpoint{
+		Root:        trieroot,
+		Step:        step,
+		NodeID:      nodeID,
+		NodeCount:   nodeCount,
+		ProgramHash: m.programHash,
+		Preimages:   m.Preimages,
+		NextPC:      m.NextPC(),
+	}
+	fn += CheckpointExt(m.Config.CheckpointFormat)
+	size, err := WriteCheckpointFile(c, fn, m.Config.CheckpointFormat, m.Config.CheckpointCompression)
+	if err != nil {
+		return trieroot, fmt.Errorf("write checkpoint %s: %w", fn, err)
+	}
+	fmt.Printf("writing %s len %d with root %s\n", fn, size, trieroot)
+	return trieroot, nil
+}
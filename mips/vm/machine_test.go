@@ -0,0 +1,115 @@
+package vm
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	uc "github.com/unicorn-engine/unicorn/bindings/go/unicorn"
+)
+
+func TestMachinesRunConcurrently(t *testing.T) {
+	_, ram := loadTestProgram()
+	want := RamToTrie(runTestProgram(t, ram))
+
+	store := NewMemoryPreimageStore()
+	config := DefaultConfig()
+	config.Store = store
+	for i := 0; i < 8; i++ {
+		t.Run(fmt.Sprint(i), func(t *testing.T) {
+			t.Parallel()
+			m := NewMachine(config)
+			_, m.Ram = loadTestProgram()
+			m.TrackRam()
+			if err := m.Interpreter("").Run(1000); err != nil {
+				t.Fatal(err)
+			}
+			fn := filepath.Join(t.TempDir(), "checkpoint")
+			root, err := m.WriteCheckpoint(fn, m.Steps, 0, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if root != want {
+				t.Fatalf("got root %s, expected %s", root, want)
+			}
+			c, err := ReadCheckpoint(fn + CheckpointExt(config.CheckpointFormat))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if c.Root != root || c.Step != m.Steps {
+				t.Fatalf("got checkpoint %s at %d", c.Root, c.Step)
+			}
+			if !store.Has(root) {
+				t.Fatal("root not in the shared store")
+			}
+		})
+	}
+}
+
+func runTestProgram(t *testing.T, ram map[uint32](uint32)) map[uint32](uint32) {
+	in := NewInterpreter(ram, nil)
+	if err := in.Run(1000); err != nil {
+		t.Fatal(err)
+	}
+	return ram
+}
+
+func TestMachineReset(t *testing.T) {
+	m := NewMachine(nil)
+	m.WriteRam(0x1000, 1)
+	m.Steps = 10
+	m.HeapStart = 0x100
+	m.programHash = common.Hash{1}
+	m.Reset()
+	if len(m.Ram) != 0 || m.Steps != 0 || m.HeapStart != 0 || m.programHash != (common.Hash{}) {
+		t.Fatal("machine not reset")
+	}
+
+	// the checkpoint of a reused machine has the nodes of its run only
+	dir := t.TempDir()
+	m.WriteRam(0x1000, 1)
+	if _, err := m.WriteCheckpoint(filepath.Join(dir, "first"), 0, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	m.Reset()
+	m.WriteRam(0x2000, 2)
+	root, err := m.WriteCheckpoint(filepath.Join(dir, "second"), 0, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fresh := NewMachine(nil)
+	fresh.WriteRam(0x2000, 2)
+	fresh.WriteCheckpoint(filepath.Join(dir, "fresh"), 0, 0, 0)
+	c, err := ReadCheckpoint(filepath.Join(dir, "second"+CheckpointExt(m.Config.CheckpointFormat)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Root != root || len(c.Preimages) != len(fresh.Preimages) {
+		t.Fatalf("got %d preimages, expected %d", len(c.Preimages), len(fresh.Preimages))
+	}
+}
+
+func TestMachineStepLimit(t *testing.T) {
+	config := DefaultConfig()
+	config.MaxSteps = 100
+	m := NewMachine(config)
+	mu, err := m.GetHookedUnicorn("", func(step int, mu uc.Unicorn, ram map[uint32](uint32)) {})
+	if err != nil {
+		t.Skip("unicorn not available: ", err)
+	}
+	defer mu.Close()
+	// j 0; nop
+	loop := append(IntToBytes(int(jType(0x02, 0))), IntToBytes(0)...)
+	LoadBytesToUnicorn(mu, loop, m.Ram, 0)
+
+	err = m.Start(mu, 0, STOP_PC)
+	var limit *LimitError
+	if !errors.As(err, &limit) || limit.Limit != "steps" {
+		t.Fatalf("expected step limit, got %v", err)
+	}
+	if limit.PC >= 8 {
+		t.Fatalf("stopped outside the loop at %x", limit.PC)
+	}
+}
@@ -0,0 +1,35 @@
+package vm
+
+import (
+	"errors"
+	"expvar"
+	"time"
+)
+
+// run counters, published by expvar at /debug/vars
+var (
+	metricRuns           = expvar.NewInt("mips_runs")
+	metricRunErrors      = expvar.NewInt("mips_run_errors")
+	metricSteps          = expvar.NewInt("mips_steps")
+	metricRunTime        = expvar.NewInt("mips_run_ms")
+	metricStepLimits     = expvar.NewInt("mips_step_limit_exceeded")
+	metricDurationLimits = expvar.NewInt("mips_duration_limit_exceeded")
+)
+
+func recordRun(steps int, elapsed time.Duration, err error) {
+	metricRuns.Add(1)
+	metricSteps.Add(int64(steps))
+	metricRunTime.Add(elapsed.Milliseconds())
+	if err == nil {
+		return
+	}
+	metricRunErrors.Add(1)
+	var limit *LimitError
+	if errors.As(err, &limit) {
+		if limit.Limit == "duration" {
+			metricDurationLimits.Add(1)
+		} else {
+			metricStepLimits.Add(1)
+		}
+	}
+}
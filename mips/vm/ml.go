@@ -4,74 +4,351 @@ import (
 	"fmt"
 	"io/ioutil"
 	"runtime"
+	"strings"
+	"sync"
 
 	llama "mlgo/examples/llama/llama_go"
 	"mlgo/examples/mnist"
 	"mlgo/ml"
 )
 
-func LLAMA(nodeID int, modelFile string, prompt string) ([]byte, int, error) {
+// names of the registered graph models
+const (
+	MODEL_LLAMA = "LLAMA"
+	MODEL_MNIST = "MNIST"
+)
+
+func init() {
+	RegisterGraphModel(MODEL_LLAMA, func() GraphModel { return &llamaModel{threads: 32} })
+	RegisterGraphModel(MODEL_MNIST, func() GraphModel { return &mnistModel{threads: 1} })
+}
+
+type llamaModel struct {
+	threads int
+	ctx     *llama.Context
+	tokens  []uint32
+	// tokens before tokens, in the key value cache of ctx
+	past  uint32
+	graph *ml.Graph
+	mlctx *ml.Context
+}
+
+func (l *llamaModel) Load(modelFile string) error {
 	if modelFile == "" {
 		modelFile = "./mlgo/examples/llama/models/llama-7b-fp32.bin"
 	}
+	ctx, err := llama.LoadModel(modelFile, true)
+	fmt.Println("Load Model Finish")
+	if err != nil {
+		fmt.Println("load model error: ", err)
+		return err
+	}
+	l.ctx = ctx
+	return nil
+}
+
+// vocabs of the llama models by file, kept from the first graph of a model or loaded once
+// if its answers are tokenized first
+var (
+	vocabMu sync.Mutex
+	vocabs  = make(map[string]*vocabEntry)
+)
+
+type vocabEntry struct {
+	mu    sync.Mutex
+	vocab *ml.Vocab
+}
+
+func vocabOf(modelFile string) *vocabEntry {
+	vocabMu.Lock()
+	defer vocabMu.Unlock()
+	e, ok := vocabs[modelFile]
+	if !ok {
+		e = &vocabEntry{}
+		vocabs[modelFile] = e
+	}
+	return e
+}
+
+func keepVocab(modelFile string, vocab *ml.Vocab) {
+	e := vocabOf(modelFile)
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.vocab == nil {
+		e.vocab = vocab
+	}
+}
+
+// llamaVocab returns the vocab of the model, the concurrent first calls load the model once
+func llamaVocab(modelFile string) (*ml.Vocab, error) {
+	e := vocabOf(modelFile)
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.vocab != nil {
+		return e.vocab, nil
+	}
+	l := &llamaModel{}
+	if err := l.Load(modelFile); err != nil {
+		return nil, err
+	}
+	defer l.Close()
+	e.vocab = l.ctx.Vocab
+	return e.vocab, nil
+}
+
+// AnswerTokens tokenizes the text generated by llama.cpp for the prompt, after the echoed
+// prompt, with the vocab of the mlgo model. The text is tokenized after the prompt, as
+// the graph would generate it.
+func AnswerTokens(modelFile string, prompt string, promptTokens []uint32, answer string) ([]uint32, error) {
+	vocab, err := llamaVocab(modelFile)
+	if err != nil {
+		return nil, err
+	}
+	if i := strings.Index(answer, prompt); i >= 0 {
+		answer = answer[i+len(prompt):]
+	}
+	tokens := ml.Tokenize(vocab, prompt+answer, true)
+	if len(tokens) >= len(promptTokens) && equalTokens(tokens[:len(promptTokens)], promptTokens) {
+		return tokens[len(promptTokens):], nil
+	}
+	// the answer merged with the end of the prompt
+	return ml.Tokenize(vocab, answer, false), nil
+}
+
+func equalTokens(a []uint32, b []uint32) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func (l *llamaModel) Encode(params *Params) error {
+	prompt := params.Prompt
 	if prompt == "" {
 		prompt = "How to combine AI and blockchain?"
 	}
+	l.tokens = ml.Tokenize(l.ctx.Vocab, prompt, true)
+	return nil
+}
 
-	threadCount := 32
-	ctx, err := llama.LoadModel(modelFile, true)
-	fmt.Println("Load Model Finish")
+func (l *llamaModel) ExpandGraph() error {
+	graph, mlctx, err := llama.ExpandGraph(l.ctx, l.tokens, uint32(len(l.tokens)), l.past, l.threads)
 	if err != nil {
-		fmt.Println("load model error: ", err)
-		return nil, 0, err
-	}
-	defer func() {
-		ctx.Model = nil
-		ctx.Vocab = nil
-		ctx.Embedding = nil
-		ctx.Logits = nil
-		ctx = nil
-		runtime.GC()
-	}()
-	embd := ml.Tokenize(ctx.Vocab, prompt, true)
-	graph, mlctx, err := llama.ExpandGraph(ctx, embd, uint32(len(embd)), 0, threadCount)
-	ml.GraphComputeByNodes(mlctx, graph, nodeID)
-	envBytes := ml.SaveComputeNodeEnvToBytes(uint32(nodeID), graph.Nodes[nodeID], graph, true)
-	return envBytes, int(graph.NodesCount), nil
-}
-
-func MNIST(nodeID int, modelFile string, dataFile string) ([]byte, int, error) {
-	threadCount := 1
+		return err
+	}
+	l.graph, l.mlctx = graph, mlctx
+	return nil
+}
+
+func (l *llamaModel) NodeCount() int {
+	return int(l.graph.NodesCount)
+}
+
+func (l *llamaModel) Compute(nodeID int) error {
+	ml.GraphComputeByNodes(l.mlctx, l.graph, nodeID)
+	return nil
+}
+
+func (l *llamaModel) Graph() *ml.Graph {
+	return l.graph
+}
+
+func (l *llamaModel) NodeEnv(nodeID int) []byte {
+	return ml.SaveComputeNodeEnvToBytes(uint32(nodeID), l.graph.Nodes[nodeID], l.graph, true)
+}
+
+func (l *llamaModel) Close() {
+	if l.ctx != nil {
+		l.ctx.Model = nil
+		l.ctx.Vocab = nil
+		l.ctx.Embedding = nil
+		l.ctx.Logits = nil
+		l.ctx = nil
+	}
+	l.graph, l.mlctx = nil, nil
+	runtime.GC()
+}
+
+// the end of text token of the llama vocab
+const LLAMA_EOS = 2
+
+// GraphAnswer is the greedy answer of the graph of a prompt, the node count is the one of
+// the graph of the prompt
+type GraphAnswer struct {
+	PromptTokens []uint32
+	Tokens       []uint32
+	Text         string
+	NodeCount    int
+}
+
+// LLAMAAnswer computes the whole graph of the prompt and returns the most likely next
+// tokens, up to count or the end of text. The first token is attested by the state of the
+// graph committed for the prompt, each next one is the best of the graph of the token
+// before it, over the key value cache of the prompt and the tokens before.
+func LLAMAAnswer(modelFile string, prompt string, count int) (*GraphAnswer, error) {
+	model, err := expandGraphModel(MODEL_LLAMA, &Params{ModelPath: modelFile, Prompt: prompt})
+	if err != nil {
+		return nil, err
+	}
+	defer model.Close()
+	l := model.(*llamaModel)
+	keepVocab(modelFile, l.ctx.Vocab)
+	answer := &GraphAnswer{
+		PromptTokens: l.tokens,
+		NodeCount:    l.NodeCount(),
+	}
+	var text strings.Builder
+	for i := 0; i < count || i == 0; i++ {
+		if i > 0 {
+			l.past += uint32(len(l.tokens))
+			l.tokens = answer.Tokens[len(answer.Tokens)-1:]
+			if err := l.ExpandGraph(); err != nil {
+				return nil, err
+			}
+		}
+		best, err := l.nextToken()
+		if err != nil {
+			return nil, err
+		}
+		if best == LLAMA_EOS {
+			break
+		}
+		answer.Tokens = append(answer.Tokens, best)
+		text.WriteString(l.ctx.Vocab.ID2Token[best].Token)
+	}
+	answer.Text = text.String()
+	return answer, nil
+}
+
+// nextToken computes the graph and returns the best token of the last row of the logits of
+// the output node, which has a row for every token of the graph
+func (l *llamaModel) nextToken() (uint32, error) {
+	last := l.NodeCount() - 1
+	l.Compute(last)
+	logits := l.graph.Nodes[last].Data
+	vocabSize := len(l.ctx.Vocab.ID2Token)
+	if vocabSize == 0 || len(logits) < vocabSize {
+		return 0, fmt.Errorf("output node of %d values for a vocab of %d tokens", len(logits), vocabSize)
+	}
+	return uint32(argmax(logits[len(logits)-vocabSize:])), nil
+}
+
+type mnistModel struct {
+	threads int
+	model   *mnist.Model
+	input   []float32
+	graph   *ml.Graph
+	mlctx   *ml.Context
+}
+
+func (m *mnistModel) Load(modelFile string) error {
 	if modelFile == "" {
 		modelFile = "../../mlgo/examples/mnist/models/mnist/ggml-model-small-f32.bin"
 	}
-	if dataFile == "" {
-		dataFile = "../../mlgo/examples/mnist/models/mnist/input_7"
-	}
 	model, err := mnist.LoadModel(modelFile)
 	if err != nil {
 		fmt.Println("Load model error: ", err)
-		return nil, 0, err
+		return err
+	}
+	m.model = model
+	return nil
+}
+
+func (m *mnistModel) Encode(params *Params) error {
+	dataFile := params.InputPath
+	if dataFile == "" {
+		dataFile = "../../mlgo/examples/mnist/models/mnist/input_7"
 	}
-	// load input
 	input, err := MNIST_Input(dataFile, false)
 	if err != nil {
 		fmt.Println("Load input data error: ", err)
-		return nil, 0, err
+		return err
 	}
-	graph, ctx := mnist.ExpandGraph(model, threadCount, input)
-	ml.GraphComputeByNodes(ctx, graph, nodeID)
-	envBytes := ml.SaveComputeNodeEnvToBytes(uint32(nodeID), graph.Nodes[nodeID], graph, true)
-	return envBytes, int(graph.NodesCount), nil
+	m.input = input
+	return nil
+}
+
+func (m *mnistModel) ExpandGraph() error {
+	m.graph, m.mlctx = mnist.ExpandGraph(m.model, m.threads, m.input)
+	return nil
+}
+
+func (m *mnistModel) NodeCount() int {
+	return int(m.graph.NodesCount)
+}
+
+func (m *mnistModel) Compute(nodeID int) error {
+	ml.GraphComputeByNodes(m.mlctx, m.graph, nodeID)
+	return nil
 }
 
+func (m *mnistModel) Graph() *ml.Graph {
+	return m.graph
+}
+
+func (m *mnistModel) NodeEnv(nodeID int) []byte {
+	return ml.SaveComputeNodeEnvToBytes(uint32(nodeID), m.graph.Nodes[nodeID], m.graph, true)
+}
+
+func (m *mnistModel) Close() {
+	m.model, m.graph, m.mlctx = nil, nil, nil
+}
+
+// MNISTAnswer computes the whole graph of the image and returns the predicted digit
+func MNISTAnswer(modelFile string, image []byte) (int, error) {
+	input, err := MNIST_Image(image, false)
+	if err != nil {
+		return 0, err
+	}
+	m := &mnistModel{threads: 1, input: input}
+	defer m.Close()
+	if err := m.Load(modelFile); err != nil {
+		return 0, err
+	}
+	m.ExpandGraph()
+	last := m.NodeCount() - 1
+	m.Compute(last)
+	// the output node holds the probability of each digit
+	probs := m.graph.Nodes[last].Data
+	if len(probs) == 0 {
+		return 0, fmt.Errorf("empty output node")
+	}
+	return argmax(probs), nil
+}
+
+func argmax(values []float32) int {
+	best := 0
+	for i, v := range values {
+		if v > values[best] {
+			best = i
+		}
+	}
+	return best
+}
+
+// size of the 28x28 grayscale images of MNIST
+const MNIST_IMAGE_SIZE = 28 * 28
+
 func MNIST_Input(dataFile string, show bool) ([]float32, error) {
 	buf, err := ioutil.ReadFile(dataFile)
 	if err != nil {
 		fmt.Println(err)
 		return nil, err
 	}
-	digits := make([]float32, 784)
+	return MNIST_Image(buf, show)
+}
+
+// MNIST_Image reads the pixels of an image, a byte each
+func MNIST_Image(buf []byte, show bool) ([]float32, error) {
+	if len(buf) < MNIST_IMAGE_SIZE {
+		return nil, fmt.Errorf("image of %d bytes, expected %d", len(buf), MNIST_IMAGE_SIZE)
+	}
+	digits := make([]float32, MNIST_IMAGE_SIZE)
 
 	// render the digit in ASCII
 	var c string
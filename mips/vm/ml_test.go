@@ -0,0 +1,35 @@
+package vm
+
+import (
+	"testing"
+
+	"mlgo/ml"
+)
+
+func TestMNISTImage(t *testing.T) {
+	image := make([]byte, MNIST_IMAGE_SIZE)
+	image[MNIST_IMAGE_SIZE-1] = 255
+	digits, err := MNIST_Image(image, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(digits) != MNIST_IMAGE_SIZE || digits[0] != 0 || digits[MNIST_IMAGE_SIZE-1] != 255 {
+		t.Fatalf("got %d pixels", len(digits))
+	}
+	if _, err := MNIST_Image(image[1:], false); err == nil {
+		t.Fatal("expected an error for a short image")
+	}
+}
+
+func TestLlamaVocabKept(t *testing.T) {
+	vocab := &ml.Vocab{}
+	keepVocab("kept-model.bin", vocab)
+	keepVocab("kept-model.bin", &ml.Vocab{})
+	got, err := llamaVocab("kept-model.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != vocab {
+		t.Fatal("vocab loaded again")
+	}
+}
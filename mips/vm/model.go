@@ -0,0 +1,107 @@
+package vm
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"mlgo/ml"
+)
+
+// GraphModel computes the graph of an mlgo model for one input, LayerRun runs the
+// model registered under the name of the params
+type GraphModel interface {
+	// Load reads the model file, the default one of the model if empty
+	Load(modelFile string) error
+	// Encode turns the input of the params into the input of the graph, tokens of the
+	// prompt or pixels of the data file
+	Encode(params *Params) error
+	ExpandGraph() error
+	NodeCount() int
+	// Compute computes the graph nodes up to nodeID
+	Compute(nodeID int) error
+	Graph() *ml.Graph
+	// NodeEnv serializes the env of nodeID, the input of its mips run
+	NodeEnv(nodeID int) []byte
+	// Close drops the model
+	Close()
+}
+
+var (
+	graphModelsMu sync.Mutex
+	graphModels   = make(map[string]func() GraphModel)
+)
+
+// RegisterGraphModel makes a model available to LayerRun by name
+func RegisterGraphModel(name string, newModel func() GraphModel) {
+	graphModelsMu.Lock()
+	defer graphModelsMu.Unlock()
+	if _, ok := graphModels[name]; ok {
+		panic("graph model registered twice: " + name)
+	}
+	graphModels[name] = newModel
+}
+
+func NewGraphModel(name string) (GraphModel, error) {
+	graphModelsMu.Lock()
+	defer graphModelsMu.Unlock()
+	newModel, ok := graphModels[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown graph model %s", name)
+	}
+	return newModel(), nil
+}
+
+// GraphModels lists the registered models
+func GraphModels() []string {
+	graphModelsMu.Lock()
+	defer graphModelsMu.Unlock()
+	names := make([]string, 0, len(graphModels))
+	for name := range graphModels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// expandGraphModel loads the model of the params and expands its graph
+func expandGraphModel(name string, params *Params) (GraphModel, error) {
+	model, err := NewGraphModel(name)
+	if err != nil {
+		return nil, err
+	}
+	if err := model.Load(params.ModelPath); err != nil {
+		model.Close()
+		return nil, fmt.Errorf("load model: %w", err)
+	}
+	if err := model.Encode(params); err != nil {
+		model.Close()
+		return nil, fmt.Errorf("encode input: %w", err)
+	}
+	if err := model.ExpandGraph(); err != nil {
+		model.Close()
+		return nil, fmt.Errorf("expand graph: %w", err)
+	}
+	return model, nil
+}
+
+// RunGraphNode computes the graph of the model up to nodeID, applies the node faults of
+// the params and returns the env of the node and the node count of the graph
+func RunGraphNode(name string, nodeID int, params *Params) ([]byte, int, error) {
+	model, err := expandGraphModel(name, params)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer model.Close()
+	nodeCount := model.NodeCount()
+	if nodeID < 0 || nodeID >= nodeCount {
+		return nil, nodeCount, fmt.Errorf("no node %d in a graph of %d nodes", nodeID, nodeCount)
+	}
+	if err := model.Compute(nodeID); err != nil {
+		return nil, nodeCount, err
+	}
+	if err := params.Faults.ApplyNodeFaults(model.Graph()); err != nil {
+		return nil, nodeCount, err
+	}
+	return model.NodeEnv(nodeID), nodeCount, nil
+}
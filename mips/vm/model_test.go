@@ -0,0 +1,66 @@
+package vm
+
+import (
+	"bytes"
+	"testing"
+
+	"mlgo/ml"
+)
+
+// a graph of two nodes, the env of a node is its data as bytes
+type testGraphModel struct {
+	graph *ml.Graph
+}
+
+func (m *testGraphModel) Load(modelFile string) error { return nil }
+
+func (m *testGraphModel) Encode(params *Params) error { return nil }
+
+func (m *testGraphModel) ExpandGraph() error {
+	m.graph = &ml.Graph{NodesCount: 2}
+	m.graph.Nodes[0] = &ml.Tensor{Data: []float32{1}}
+	m.graph.Nodes[1] = &ml.Tensor{Data: []float32{0}}
+	return nil
+}
+
+func (m *testGraphModel) NodeCount() int { return int(m.graph.NodesCount) }
+
+func (m *testGraphModel) Compute(nodeID int) error {
+	for i := 1; i <= nodeID; i++ {
+		m.graph.Nodes[i].Data[0] = m.graph.Nodes[i-1].Data[0] + 1
+	}
+	return nil
+}
+
+func (m *testGraphModel) Graph() *ml.Graph { return m.graph }
+
+func (m *testGraphModel) NodeEnv(nodeID int) []byte {
+	return []byte{byte(m.graph.Nodes[nodeID].Data[0])}
+}
+
+func (m *testGraphModel) Close() {}
+
+func TestRunGraphNode(t *testing.T) {
+	RegisterGraphModel("TEST", func() GraphModel { return &testGraphModel{} })
+	env, nodeCount, err := RunGraphNode("TEST", 1, &Params{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nodeCount != 2 || !bytes.Equal(env, []byte{2}) {
+		t.Fatalf("got %v of %d nodes", env, nodeCount)
+	}
+
+	// the node faults apply to the computed nodes
+	faults := Faults{{Kind: FAULT_NODE, Node: 1, Value: 0x00800000}}
+	env, _, err = RunGraphNode("TEST", 1, &Params{Faults: faults})
+	if err != nil || !bytes.Equal(env, []byte{4}) {
+		t.Fatalf("got %v %v", env, err)
+	}
+
+	if _, _, err := RunGraphNode("TEST", 2, &Params{}); err == nil {
+		t.Fatal("expected an error for a missing node")
+	}
+	if _, _, err := RunGraphNode("GPT", 0, &Params{}); err == nil {
+		t.Fatal("expected an error for an unknown model")
+	}
+}
@@ -0,0 +1,57 @@
+package vm
+
+import (
+	"bytes"
+	"testing"
+)
+
+// writes the bytes at 0x100 to stdout, then to stderr, and exits
+var writeProgram = []uint32{
+	iType(0x09, rZero, rV0, 4004),  // 0x00 addiu v0, zero, 4004
+	iType(0x09, rZero, rA0, 1),     // 0x04 addiu a0, zero, 1
+	iType(0x09, rZero, rA1, 0x100), // 0x08 addiu a1, zero, 0x100
+	iType(0x09, rZero, 6, 3),       // 0x0c addiu a2, zero, 3
+	0xc,                            // 0x10 syscall
+	iType(0x09, rZero, rV0, 4004),  // 0x14 addiu v0, zero, 4004
+	iType(0x09, rZero, rA0, 2),     // 0x18 addiu a0, zero, 2
+	0xc,                            // 0x1c syscall
+	iType(0x09, rZero, rV0, 4246),  // 0x20 addiu v0, zero, 4246
+	0xc,                            // 0x24 syscall
+}
+
+func TestMachineCapturesOutput(t *testing.T) {
+	m := NewMachine(nil)
+	ZeroRegisters(m.Ram)
+	for i, insn := range writeProgram {
+		m.Ram[uint32(i*4)] = insn
+	}
+	m.Ram[0x100] = 0x68690a00 // "hi\n"
+	m.Ram[OUTPUT_ADDR] = 5
+	m.Ram[OUTPUT_ADDR+4] = 0x01020304
+	m.Ram[OUTPUT_ADDR+8] = 0x05ffffff
+	if err := m.Interpreter("").Run(100); err != nil {
+		t.Fatal(err)
+	}
+	result, err := m.Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(result.Stdout) != "hi\n" || string(result.Stderr) != "hi\n" {
+		t.Fatalf("got stdout %q stderr %q", result.Stdout, result.Stderr)
+	}
+	if !bytes.Equal(result.Output, []byte{1, 2, 3, 4, 5}) {
+		t.Fatalf("got output %x", result.Output)
+	}
+
+	m.Reset()
+	if result, _ := m.Result(); len(result.Stdout) != 0 || len(result.Output) != 0 {
+		t.Fatalf("output kept after reset: %+v", result)
+	}
+}
+
+func TestReadOutputTooLarge(t *testing.T) {
+	ram := map[uint32](uint32){OUTPUT_ADDR: MAX_OUTPUT_SIZE + 1}
+	if _, err := ReadOutput(ram); err == nil {
+		t.Fatal("expected a layout error")
+	}
+}
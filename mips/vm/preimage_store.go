@@ -0,0 +1,217 @@
+package vm
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+var ErrPreimageNotFound = errors.New("preimage not found")
+
+// PreimageStore is a keccak addressed store of trie nodes and oracle data
+type PreimageStore interface {
+	Get(hash common.Hash) ([]byte, error)
+	Put(value []byte) (common.Hash, error)
+	Has(hash common.Hash) bool
+}
+
+// StoreOracle answers syscall 4020 from a preimage store
+func StoreOracle(store PreimageStore) Oracle {
+	return store.Get
+}
+
+type MemoryPreimageStore struct {
+	mu        sync.RWMutex
+	preimages map[common.Hash][]byte
+}
+
+func NewMemoryPreimageStore() *MemoryPreimageStore {
+	return &MemoryPreimageStore{
+		preimages: make(map[common.Hash][]byte),
+	}
+}
+
+func (s *MemoryPreimageStore) Get(hash common.Hash) ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	value, ok := s.preimages[hash]
+	if !ok {
+		return nil, ErrPreimageNotFound
+	}
+	return value, nil
+}
+
+func (s *MemoryPreimageStore) Put(value []byte) (common.Hash, error) {
+	hash := crypto.Keccak256Hash(value)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.preimages[hash]; !ok {
+		s.preimages[hash] = common.CopyBytes(value)
+	}
+	return hash, nil
+}
+
+func (s *MemoryPreimageStore) Has(hash common.Hash) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	_, ok := s.preimages[hash]
+	return ok
+}
+
+// DiskPreimageStore keeps one file per preimage, named <dir>/<hash> like the oracle files
+type DiskPreimageStore struct {
+	dir string
+}
+
+func NewDiskPreimageStore(dir string) *DiskPreimageStore {
+	return &DiskPreimageStore{dir: dir}
+}
+
+func (s *DiskPreimageStore) path(hash common.Hash) string {
+	return fmt.Sprintf("%s/%s", s.dir, hash)
+}
+
+func (s *DiskPreimageStore) Get(hash common.Hash) ([]byte, error) {
+	value, err := ioutil.ReadFile(s.path(hash))
+	if os.IsNotExist(err) {
+		return nil, ErrPreimageNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if crypto.Keccak256Hash(value) != hash {
+		return nil, fmt.Errorf("corrupted preimage %s", hash)
+	}
+	return value, nil
+}
+
+func (s *DiskPreimageStore) Put(value []byte) (common.Hash, error) {
+	hash := crypto.Keccak256Hash(value)
+	if s.Has(hash) {
+		return hash, nil
+	}
+	err := os.MkdirAll(s.dir, os.ModePerm)
+	if err != nil {
+		return hash, err
+	}
+	// write and rename, so a concurrent reader never sees a partial preimage
+	tmp, err := ioutil.TempFile(s.dir, ".tmp-")
+	if err != nil {
+		return hash, err
+	}
+	_, err = tmp.Write(value)
+	tmp.Close()
+	if err == nil {
+		err = os.Rename(tmp.Name(), s.path(hash))
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return hash, err
+}
+
+func (s *DiskPreimageStore) Has(hash common.Hash) bool {
+	_, err := os.Stat(s.path(hash))
+	return err == nil
+}
+
+// GC removes every preimage that is not reachable from roots, following the
+// hashes referenced by trie nodes. Oracle data must be passed as a root to be kept.
+func (s *DiskPreimageStore) GC(roots []common.Hash) (int, error) {
+	reachable := make(map[common.Hash]bool)
+	for _, root := range roots {
+		walkPreimages(root, s.Get, reachable)
+	}
+
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return 0, err
+	}
+	removed := 0
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || len(name) != 2+2*common.HashLength || name[:2] != "0x" {
+			continue
+		}
+		if reachable[common.HexToHash(name)] {
+			continue
+		}
+		if err := os.Remove(filepath.Join(s.dir, name)); err != nil {
+			return removed, err
+		}
+		removed += 1
+	}
+	return removed, nil
+}
+
+// CheckpointRoots returns the roots of the checkpoints under dir, in either format
+func CheckpointRoots(dir string) ([]common.Hash, error) {
+	var roots []common.Hash
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		ext := filepath.Ext(path)
+		if ext != CheckpointExt(FORMAT_BINARY) && ext != CheckpointExt(FORMAT_JSON) {
+			return nil
+		}
+		c, err := ReadCheckpoint(path)
+		if err != nil {
+			// other json files
+			if ext == CheckpointExt(FORMAT_JSON) {
+				return nil
+			}
+			return fmt.Errorf("checkpoint %s: %w", path, err)
+		}
+		if c.Root != (common.Hash{}) {
+			roots = append(roots, c.Root)
+		}
+		return nil
+	})
+	return roots, err
+}
+
+// walkPreimages marks hash and every preimage referenced by it through trie nodes
+func walkPreimages(hash common.Hash, get func(common.Hash) ([]byte, error), seen map[common.Hash]bool) {
+	if seen[hash] {
+		return
+	}
+	value, err := get(hash)
+	if err != nil {
+		return
+	}
+	seen[hash] = true
+	elems, _, err := rlp.SplitList(value)
+	if err != nil {
+		// not a trie node
+		return
+	}
+	walkNodeRefs(elems, func(child common.Hash) {
+		walkPreimages(child, get, seen)
+	})
+}
+
+func walkNodeRefs(elems []byte, fn func(common.Hash)) {
+	rest := elems
+	for len(rest) > 0 {
+		kind, val, lrest, err := rlp.Split(rest)
+		if err != nil {
+			return
+		}
+		rest = lrest
+		if kind == rlp.String && len(val) == common.HashLength {
+			fn(common.BytesToHash(val))
+		}
+		if kind == rlp.List && len(val) > 0 {
+			walkNodeRefs(val, fn)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package vm
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+func TestDiskPreimageStore(t *testing.T) {
+	store := NewDiskPreimageStore(t.TempDir())
+	value := []byte("preimage")
+	hash, err := store.Put(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hash != crypto.Keccak256Hash(value) {
+		t.Fatalf("got hash %s", hash)
+	}
+	if _, err := store.Put(value); err != nil {
+		t.Fatal(err)
+	}
+	got, err := store.Get(hash)
+	if err != nil || !bytes.Equal(got, value) {
+		t.Fatalf("got %q, %v", got, err)
+	}
+	if _, err := store.Get(common.Hash{}); err != ErrPreimageNotFound {
+		t.Fatalf("expected not found, got %v", err)
+	}
+}
+
+func TestDiskPreimageStoreGC(t *testing.T) {
+	store := NewDiskPreimageStore(t.TempDir())
+	kw := PreimageKeyValueWriter{Preimages: make(map[common.Hash][]byte), Store: store}
+
+	_, ram := loadTestProgram()
+	root, err := RamToTrieWith(ram, kw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kept := len(kw.Preimages)
+
+	ram[0x1000] = 0x12345678
+	kw.Preimages = make(map[common.Hash][]byte)
+	RamToTrieWith(ram, kw)
+
+	oracleData, _ := store.Put([]byte("oracle data"))
+	store.Put([]byte("garbage"))
+
+	// the second trie shares most nodes with the first one
+	removed, err := store.GC([]common.Hash{root, oracleData})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed == 0 {
+		t.Fatal("nothing removed")
+	}
+	for hash := range kw.Preimages {
+		if !store.Has(hash) {
+			continue
+		}
+		walked := make(map[common.Hash]bool)
+		walkPreimages(root, store.Get, walked)
+		if !walked[hash] {
+			t.Fatalf("unreachable node %s kept", hash)
+		}
+	}
+	walked := make(map[common.Hash]bool)
+	walkPreimages(root, store.Get, walked)
+	if len(walked) != kept {
+		t.Fatalf("got %d reachable nodes, expected %d", len(walked), kept)
+	}
+	if !store.Has(oracleData) {
+		t.Fatal("oracle data removed")
+	}
+}
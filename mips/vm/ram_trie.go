@@ -0,0 +1,240 @@
+package vm
+
+import (
+	"encoding/binary"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethdb"
+)
+
+// RamTrie is a merkle patricia trie of the ram that keeps the encoding of every node,
+// so after some words are written only the paths to them are hashed again.
+// It yields the same root and preimages as RamToTrie.
+type RamTrie struct {
+	root  ramNode
+	db    ethdb.KeyValueWriter
+	dirty map[uint32]bool
+	err   error // first failed write to db
+}
+
+type ramNode interface{}
+
+type ramShortNode struct {
+	Key []byte // nibbles, a leaf key ends with the terminator 16
+	Val ramNode
+	ramNodeCache
+}
+
+type ramFullNode struct {
+	Children [17]ramNode
+	ramNodeCache
+}
+
+// encoding of the node and its hash if it is not embedded in the parent, valid while not dirty
+type ramNodeCache struct {
+	enc   []byte
+	hash  []byte
+	dirty bool
+}
+
+type ramValueNode []byte
+
+var emptyTrieRoot = crypto.Keccak256Hash([]byte{0x80})
+
+func NewRamTrie(ram map[uint32](uint32), db ethdb.KeyValueWriter) *RamTrie {
+	t := &RamTrie{
+		db:    db,
+		dirty: make(map[uint32]bool),
+	}
+	for addr, v := range ram {
+		t.update(addr, v)
+	}
+	return t
+}
+
+func (t *RamTrie) MarkDirty(addr uint32) {
+	t.dirty[addr] = true
+}
+
+// Root applies the dirty words of ram, writes the new nodes to the preimages and returns the root
+func (t *RamTrie) Root(ram map[uint32](uint32)) (common.Hash, error) {
+	for addr := range t.dirty {
+		t.update(addr, ram[addr])
+	}
+	t.dirty = make(map[uint32]bool)
+	if t.root == nil {
+		return emptyTrieRoot, nil
+	}
+	c := t.encode(t.root)
+	if c.hash != nil {
+		return common.BytesToHash(c.hash), t.err
+	}
+	// the root is always hashed and written, even if it is shorter than a hash
+	hash := crypto.Keccak256Hash(c.enc)
+	t.put(hash[:], c.enc)
+	return hash, t.err
+}
+
+func (t *RamTrie) put(key []byte, value []byte) {
+	if err := t.db.Put(key, value); err != nil && t.err == nil {
+		t.err = err
+	}
+}
+
+func (t *RamTrie) update(addr uint32, value uint32) {
+	k := make([]byte, 4)
+	binary.BigEndian.PutUint32(k, addr>>2)
+	v := make([]byte, 4)
+	binary.BigEndian.PutUint32(v, value)
+	t.root = t.insert(t.root, keyToNibbles(k), ramValueNode(v))
+}
+
+func keyToNibbles(key []byte) []byte {
+	nibbles := make([]byte, len(key)*2+1)
+	for i, b := range key {
+		nibbles[i*2] = b / 16
+		nibbles[i*2+1] = b % 16
+	}
+	nibbles[len(nibbles)-1] = 16
+	return nibbles
+}
+
+func prefixLen(a, b []byte) int {
+	i := 0
+	for ; i < len(a) && i < len(b); i++ {
+		if a[i] != b[i] {
+			break
+		}
+	}
+	return i
+}
+
+func (t *RamTrie) insert(n ramNode, key []byte, value ramNode) ramNode {
+	if len(key) == 0 {
+		return value
+	}
+	switch n := n.(type) {
+	case *ramShortNode:
+		m := prefixLen(key, n.Key)
+		if m == len(n.Key) {
+			n.Val = t.insert(n.Val, key[m:], value)
+			n.dirty = true
+			return n
+		}
+		branch := &ramFullNode{ramNodeCache: ramNodeCache{dirty: true}}
+		branch.Children[n.Key[m]] = t.insert(nil, n.Key[m+1:], n.Val)
+		branch.Children[key[m]] = t.insert(nil, key[m+1:], value)
+		if m == 0 {
+			return branch
+		}
+		return &ramShortNode{Key: common.CopyBytes(key[:m]), Val: branch, ramNodeCache: ramNodeCache{dirty: true}}
+	case *ramFullNode:
+		n.Children[key[0]] = t.insert(n.Children[key[0]], key[1:], value)
+		n.dirty = true
+		return n
+	case nil:
+		return &ramShortNode{Key: common.CopyBytes(key), Val: value, ramNodeCache: ramNodeCache{dirty: true}}
+	}
+	panic("invalid ram trie node")
+}
+
+// encode returns the cached rlp of n, recomputed if n is dirty
+func (t *RamTrie) encode(n ramNode) *ramNodeCache {
+	switch n := n.(type) {
+	case *ramShortNode:
+		if !n.dirty {
+			return &n.ramNodeCache
+		}
+		payload := rlpString(nil, hexToCompact(n.Key))
+		if v, ok := n.Val.(ramValueNode); ok {
+			payload = rlpString(payload, v)
+		} else {
+			payload = append(payload, t.ref(n.Val)...)
+		}
+		t.commit(&n.ramNodeCache, rlpList(payload))
+		return &n.ramNodeCache
+	case *ramFullNode:
+		if !n.dirty {
+			return &n.ramNodeCache
+		}
+		var payload []byte
+		for i := 0; i < 16; i++ {
+			if n.Children[i] == nil {
+				payload = append(payload, 0x80)
+			} else {
+				payload = append(payload, t.ref(n.Children[i])...)
+			}
+		}
+		if v, ok := n.Children[16].(ramValueNode); ok {
+			payload = rlpString(payload, v)
+		} else {
+			payload = append(payload, 0x80)
+		}
+		t.commit(&n.ramNodeCache, rlpList(payload))
+		return &n.ramNodeCache
+	}
+	panic("invalid ram trie node")
+}
+
+// commit caches enc, nodes of 32 bytes or more are hashed and written to the preimages
+func (t *RamTrie) commit(c *ramNodeCache, enc []byte) {
+	c.enc = enc
+	c.hash = nil
+	c.dirty = false
+	if len(enc) >= 32 {
+		c.hash = crypto.Keccak256(enc)
+		t.put(c.hash, enc)
+	}
+}
+
+// ref is how a parent references n: its hash, or its encoding when shorter than a hash
+func (t *RamTrie) ref(n ramNode) []byte {
+	c := t.encode(n)
+	if c.hash == nil {
+		return c.enc
+	}
+	return rlpString(nil, c.hash)
+}
+
+func hexToCompact(hex []byte) []byte {
+	terminator := byte(0)
+	if len(hex) > 0 && hex[len(hex)-1] == 16 {
+		terminator = 1
+		hex = hex[:len(hex)-1]
+	}
+	buf := make([]byte, len(hex)/2+1)
+	buf[0] = terminator << 5
+	if len(hex)&1 == 1 {
+		buf[0] |= 1 << 4
+		buf[0] |= hex[0]
+		hex = hex[1:]
+	}
+	for i := 0; i < len(hex); i += 2 {
+		buf[i/2+1] = hex[i]<<4 | hex[i+1]
+	}
+	return buf
+}
+
+func rlpString(dst []byte, b []byte) []byte {
+	if len(b) == 1 && b[0] < 0x80 {
+		return append(dst, b[0])
+	}
+	return append(rlpHeader(dst, 0x80, len(b)), b...)
+}
+
+func rlpList(payload []byte) []byte {
+	return append(rlpHeader(make([]byte, 0, len(payload)+9), 0xc0, len(payload)), payload...)
+}
+
+func rlpHeader(dst []byte, offset byte, size int) []byte {
+	if size < 56 {
+		return append(dst, offset+byte(size))
+	}
+	var sizeBytes []byte
+	for s := size; s > 0; s >>= 8 {
+		sizeBytes = append([]byte{byte(s)}, sizeBytes...)
+	}
+	dst = append(dst, offset+55+byte(len(sizeBytes)))
+	return append(dst, sizeBytes...)
+}
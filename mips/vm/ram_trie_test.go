@@ -0,0 +1,116 @@
+package vm
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/oracle"
+)
+
+func randomRam(r *rand.Rand, n int) map[uint32](uint32) {
+	ram := make(map[uint32](uint32))
+	for i := 0; i < n; i++ {
+		// cluster the addresses like program, heap and registers to get shared prefixes
+		base := []uint32{0, 0x20000000, 0x31000000, 0xC0000000}[r.Intn(4)]
+		ram[base+uint32(r.Intn(1<<16))*4] = r.Uint32()
+	}
+	return ram
+}
+
+// the incremental root must match a full rebuild after any sequence of writes
+func TestRamTrieMatchesRamToTrie(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for round := 0; round < 20; round++ {
+		ram := randomRam(r, 1+r.Intn(2000))
+		rt := NewRamTrie(ram, PreimageKeyValueWriter{})
+		for checkpoint := 0; checkpoint < 5; checkpoint++ {
+			for i := r.Intn(200); i > 0; i-- {
+				var addr uint32
+				if r.Intn(2) == 0 {
+					// overwrite an existing word
+					for a := range ram {
+						addr = a
+						break
+					}
+				} else {
+					addr = uint32(r.Intn(1<<20)) * 4
+				}
+				ram[addr] = r.Uint32()
+				rt.MarkDirty(addr)
+			}
+			Preimages = make(map[common.Hash][]byte)
+			expected := RamToTrie(ram)
+			full := Preimages
+			Preimages = make(map[common.Hash][]byte)
+			got, err := rt.Root(ram)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != expected {
+				t.Fatalf("round %d checkpoint %d: got root %s, expected %s", round, checkpoint, got, expected)
+			}
+			// only the changed nodes are written, and they belong to the full trie
+			for k := range Preimages {
+				if _, ok := full[k]; !ok {
+					t.Fatalf("round %d checkpoint %d: unexpected node %s", round, checkpoint, k)
+				}
+			}
+		}
+	}
+}
+
+func TestRamTriePreimages(t *testing.T) {
+	r := rand.New(rand.NewSource(2))
+	ram := randomRam(r, 500)
+	Preimages = make(map[common.Hash][]byte)
+	root, err := NewRamTrie(ram, PreimageKeyValueWriter{}).Root(ram)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	oracle.SetRoot(t.TempDir())
+	rram, err := RamFromTrie(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rram) != len(ram) {
+		t.Fatalf("got %d words, expected %d", len(rram), len(ram))
+	}
+	for addr, v := range ram {
+		if rram[addr] != v {
+			t.Fatalf("%x: got %x, expected %x", addr, rram[addr], v)
+		}
+	}
+}
+
+func TestRamTrieWriteRam(t *testing.T) {
+	_, ram := loadTestProgram()
+	m := NewMachine(nil)
+	m.Ram = ram
+	m.TrackRam()
+	if err := m.Interpreter("").Run(1000); err != nil {
+		t.Fatal(err)
+	}
+	if root, _ := m.RamRoot(); root != RamToTrie(ram) {
+		t.Fatal("root mismatch after run")
+	}
+}
+
+func TestLargeRamNotTracked(t *testing.T) {
+	defer func(n int) { ramTrieMaxWords = n }(ramTrieMaxWords)
+	_, ram := loadTestProgram()
+	ramTrieMaxWords = len(ram) - 1
+	m := NewMachine(nil)
+	m.Ram = ram
+	m.TrackRam()
+	if m.ramTrie != nil {
+		t.Fatal("large ram tracked")
+	}
+	if err := m.Interpreter("").Run(1000); err != nil {
+		t.Fatal(err)
+	}
+	if root, _ := m.RamRoot(); root != RamToTrie(ram) {
+		t.Fatal("root mismatch after run")
+	}
+}
@@ -0,0 +1,177 @@
+package vm
+
+import (
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/ethereum/go-ethereum/common"
+	uc "github.com/unicorn-engine/unicorn/bindings/go/unicorn"
+)
+
+// CheckResumable checks that a run can resume from the ram of a checkpoint and the pc after
+// it. Unicorn counts the delay slot of a branch as a step of its own, a checkpoint written
+// before the next pc was recorded can not tell where the branch goes, so its pc after a
+// branch is rejected, even the target of another jump.
+func CheckResumable(ram map[uint32](uint32), step int, nextPC uint32) error {
+	pc := ram[REG_PC]
+	if pc == EXIT_PC || pc == STOP_PC {
+		return &ResumeError{Step: step, PC: pc, Reason: "the program exited"}
+	}
+	if nextPC == 0 && pc >= 4 && isBranch(ram[pc-4]) {
+		return &ResumeError{Step: step, PC: pc, Reason: "in the delay slot of a branch, without the next pc"}
+	}
+	return nil
+}
+
+// Replay resumes the checkpoint fn in a fresh unicorn, with its memory, registers and heap
+// pointer, and runs steps more instructions. The checkpoint of the step it stops at is
+// written to basedir, or the final one if the program exits first, its root and step are
+// the Final root and the Steps of the result.
+func (m *Machine) Replay(basedir string, fn string, steps int) (*RunResult, error) {
+	c, err := ReadCheckpoint(fn)
+	if err != nil {
+		return nil, err
+	}
+	// the oracle writes the nodes it reads under its root, /tmp/cannon, made here with the
+	// default basedir
+	if err := os.MkdirAll(basedir, os.ModePerm); err != nil {
+		return nil, err
+	}
+	ram, err := RamFromTrieWith(c.Root, c.Preimages, m.Config.Store)
+	if err != nil {
+		return nil, err
+	}
+	// golden checkpoints are the state before step 0
+	start := c.Step
+	if start < 0 {
+		start = 0
+	}
+	if err := CheckResumable(ram, start, c.NextPC); err != nil {
+		return nil, err
+	}
+
+	m.Reset()
+	m.Ram = ram
+	m.Steps = start
+	m.programHash = c.ProgramHash
+	regs := RegistersFromRam(ram)
+	m.HeapStart = uint64(regs.Heap)
+	// a delay slot follows the branch before it
+	delaySlot := c.NextPC != 0 && c.NextPC != regs.PC+4
+	if delaySlot {
+		m.lastPC, m.stepped = regs.PC-4, true
+	}
+
+	target := start + steps
+	stopped := false
+	var final common.Hash
+	last := target
+	mu, err := m.GetHookedUnicorn(basedir, func(step int, mu uc.Unicorn, ram map[uint32](uint32)) {
+		if step == target {
+			stopped = true
+			m.SyncRegs(mu)
+			root, err := m.WriteCheckpoint(fmt.Sprintf("%s/checkpoint_%d_%d", basedir, c.NodeID, step), step, c.NodeID, c.NodeCount)
+			if err != nil {
+				m.fail(mu, err)
+				return
+			}
+			final = root
+			mu.RegWrite(uc.MIPS_REG_PC, STOP_PC)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer mu.Close()
+
+	if err := restoreUnicorn(mu, ram, regs); err != nil {
+		return nil, err
+	}
+	m.TrackRam()
+	if err := m.startTrace(c.NodeID, start); err != nil {
+		return nil, err
+	}
+	defer m.stopTrace(mu)
+	begin := uint64(regs.PC)
+	if delaySlot {
+		// unicorn runs the delay slot alone, as the next instruction, then the branch target
+		if err := m.startStep(mu, begin); err != nil {
+			result, _ := m.Result()
+			return result, err
+		}
+		begin = uint64(c.NextPC)
+		if pc, _ := mu.RegRead(uc.MIPS_REG_PC); pc == EXIT_PC || pc == STOP_PC {
+			begin = pc
+		}
+	}
+	if begin != STOP_PC {
+		if err := m.Start(mu, begin, STOP_PC); err != nil {
+			result, _ := m.Result()
+			return result, err
+		}
+	}
+	if !stopped {
+		last = m.Steps
+		m.SyncRegs(mu)
+		final, err = m.WriteCheckpoint(fmt.Sprintf("%s/checkpoint_%d_final", basedir, c.NodeID), last, c.NodeID, c.NodeCount)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := m.stopTrace(mu); err != nil {
+		return nil, err
+	}
+	result, err := m.Result()
+	if result != nil {
+		result.Final = final
+		result.Steps = last
+	}
+	return result, err
+}
+
+// restoreUnicorn writes the mapped ram to the unicorn memory and sets the registers
+func restoreUnicorn(mu uc.Unicorn, ram map[uint32](uint32), regs Registers) error {
+	for _, r := range ramRuns(ram) {
+		if err := mu.MemWrite(uint64(r.addr), r.data); err != nil {
+			return fmt.Errorf("restore memory at %x: %w", r.addr, err)
+		}
+	}
+	for i := 1; i < len(regs.GPR); i++ {
+		if err := mu.RegWrite(uc.MIPS_REG_ZERO+i, uint64(regs.GPR[i])); err != nil {
+			return fmt.Errorf("restore register %s: %w", REG_NAMES[i], err)
+		}
+	}
+	if err := mu.RegWrite(uc.MIPS_REG_HI, uint64(regs.HI)); err != nil {
+		return err
+	}
+	return mu.RegWrite(uc.MIPS_REG_LO, uint64(regs.LO))
+}
+
+// ramRun is consecutive words of the ram
+type ramRun struct {
+	addr uint32
+	data []byte
+}
+
+// ramRuns splits the mapped ram in runs of consecutive words, written at once
+func ramRuns(ram map[uint32](uint32)) []ramRun {
+	addrs := make([]uint32, 0, len(ram))
+	for addr := range ram {
+		if addr < MEM_END {
+			addrs = append(addrs, addr)
+		}
+	}
+	sort.Slice(addrs, func(i, j int) bool { return addrs[i] < addrs[j] })
+	var runs []ramRun
+	for _, addr := range addrs {
+		v := ram[addr]
+		word := []byte{byte(v >> 24), byte(v >> 16), byte(v >> 8), byte(v)}
+		if n := len(runs); n > 0 && runs[n-1].addr+uint32(len(runs[n-1].data)) == addr {
+			runs[n-1].data = append(runs[n-1].data, word...)
+		} else {
+			runs = append(runs, ramRun{addr: addr, data: word})
+		}
+	}
+	return runs
+}
@@ -0,0 +1,74 @@
+package vm
+
+import (
+	"bytes"
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func TestRamRuns(t *testing.T) {
+	runs := ramRuns(map[uint32](uint32){
+		0x100:         0x01020304,
+		0x104:         0x05060708,
+		0x10c:         0x090a0b0c,
+		REG_OFFSET:    1, // not mapped
+		HEAP_ADDR - 4: 0xffffffff,
+		HEAP_ADDR:     0,
+	})
+	if len(runs) != 3 {
+		t.Fatalf("got %d runs", len(runs))
+	}
+	if runs[0].addr != 0x100 || !bytes.Equal(runs[0].data, []byte{1, 2, 3, 4, 5, 6, 7, 8}) {
+		t.Fatalf("got %x %x", runs[0].addr, runs[0].data)
+	}
+	if runs[1].addr != 0x10c || len(runs[1].data) != 4 || runs[2].addr != HEAP_ADDR-4 || len(runs[2].data) != 8 {
+		t.Fatalf("got %v", runs)
+	}
+}
+
+func TestCheckResumable(t *testing.T) {
+	const beq = 0x10000003 // beq $0, $0, 3
+	ram := map[uint32](uint32){0x100: beq, 0x104: 0, 0x108: 0}
+	var rerr *ResumeError
+	for pc, resumable := range map[uint32]bool{0: true, 0x100: true, 0x104: false, 0x108: true, EXIT_PC: false} {
+		ram[REG_PC] = pc
+		err := CheckResumable(ram, 10, 0)
+		if resumable && err != nil {
+			t.Fatalf("pc %x: %v", pc, err)
+		}
+		if !resumable && !errors.As(err, &rerr) {
+			t.Fatalf("pc %x: got %v", pc, err)
+		}
+	}
+	// the delay slot of a checkpoint with its next pc
+	ram[REG_PC] = 0x104
+	if err := CheckResumable(ram, 10, 0x110); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCheckpointNextPC(t *testing.T) {
+	_, ram := loadTestProgram()
+	m := NewMachine(nil)
+	m.Ram = ram
+	in := m.Interpreter("")
+	// the delay slot of the bne of the first iteration, then the step after it
+	for _, step := range []struct {
+		steps int
+		want  uint32
+	}{{5, 0x08}, {1, 0x0c}} {
+		in.Run(step.steps)
+		fn := filepath.Join(t.TempDir(), "checkpoint")
+		if _, err := m.WriteCheckpoint(fn, in.Steps, 0, 0); err != nil {
+			t.Fatal(err)
+		}
+		c, err := ReadCheckpoint(fn + CheckpointExt(m.Config.CheckpointFormat))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.NextPC != step.want || in.NextPC() != step.want {
+			t.Fatalf("pc %x: next pc %x in the checkpoint, %x in the interpreter, expected %x", in.PC(), c.NextPC, in.NextPC(), step.want)
+		}
+	}
+}
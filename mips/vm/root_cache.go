@@ -0,0 +1,235 @@
+package vm
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"golang.org/x/sync/singleflight"
+)
+
+// RootCache remembers the golden root computed for a (program, model, prompt),
+// so a repeated question does not expand the graph and build the trie again.
+// Program and model are identified by their keccak, which is only recomputed
+// when the file size or modification time changes, outside the lock.
+type RootCache struct {
+	hashing singleflight.Group
+	mu      sync.Mutex
+	path    string
+	maxSize int
+	clock   int64
+	Files   map[string]*fileFingerprint `json:"files"`
+	Entries map[common.Hash]*RootEntry  `json:"entries"`
+}
+
+type fileFingerprint struct {
+	Size    int64       `json:"size"`
+	ModTime int64       `json:"modTime"`
+	Hash    common.Hash `json:"hash"`
+}
+
+type RootEntry struct {
+	ProgramHash common.Hash `json:"programHash"`
+	ModelHash   common.Hash `json:"modelHash"`
+	Root        common.Hash `json:"root"`
+	NodeCount   int         `json:"nodeCount"`
+	Answer      string      `json:"answer,omitempty"` // answer of the graph, if computed
+	Tokens      []uint32    `json:"tokens,omitempty"` // tokens of the answer of the graph
+	// tokens the answer was generated for, fewer if it ended with the end of text
+	MaxTokens int `json:"maxTokens,omitempty"`
+	// prompt tokens and final node roots of the transcripts of the answers, if run
+	PromptTokens []uint32      `json:"promptTokens,omitempty"`
+	NodeRoots    []common.Hash `json:"nodeRoots,omitempty"`
+	LastUsed     int64         `json:"lastUsed"`
+}
+
+// NewRootCache loads the cache persisted at path, an empty path keeps it in memory only.
+// maxSize <= 0 means unbounded.
+func NewRootCache(path string, maxSize int) (*RootCache, error) {
+	c := &RootCache{
+		path:    path,
+		maxSize: maxSize,
+		Files:   make(map[string]*fileFingerprint),
+		Entries: make(map[common.Hash]*RootEntry),
+	}
+	if path == "" {
+		return c, nil
+	}
+	dat, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(dat, c); err != nil {
+		return nil, err
+	}
+	for _, e := range c.Entries {
+		if e.LastUsed > c.clock {
+			c.clock = e.LastUsed
+		}
+	}
+	return c, nil
+}
+
+func rootCacheKey(programHash common.Hash, modelHash common.Hash, prompt string) common.Hash {
+	return crypto.Keccak256Hash(programHash[:], modelHash[:], []byte(prompt))
+}
+
+// fileHash returns the keccak of the file, entries of a previous version of the file are
+// dropped. A changed file is hashed once for the concurrent lookups, without the lock.
+func (c *RootCache) fileHash(fn string) (common.Hash, error) {
+	abs, err := filepath.Abs(fn)
+	if err != nil {
+		return common.Hash{}, err
+	}
+	fi, err := os.Stat(abs)
+	if err != nil {
+		return common.Hash{}, err
+	}
+	c.mu.Lock()
+	fp, ok := c.Files[abs]
+	c.mu.Unlock()
+	if ok && fp.Size == fi.Size() && fp.ModTime == fi.ModTime().UnixNano() {
+		return fp.Hash, nil
+	}
+	version := fmt.Sprintf("%s:%d:%d", abs, fi.Size(), fi.ModTime().UnixNano())
+	v, err, _ := c.hashing.Do(version, func() (interface{}, error) {
+		return HashFile(abs)
+	})
+	if err != nil {
+		return common.Hash{}, err
+	}
+	hash := v.(common.Hash)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fp, ok = c.Files[abs]
+	if ok && fp.Hash != hash {
+		for k, e := range c.Entries {
+			if e.ProgramHash == fp.Hash || e.ModelHash == fp.Hash {
+				delete(c.Entries, k)
+			}
+		}
+	}
+	c.Files[abs] = &fileFingerprint{Size: fi.Size(), ModTime: fi.ModTime().UnixNano(), Hash: hash}
+	return hash, nil
+}
+
+// HashFile streams the file through keccak256
+func HashFile(fn string) (common.Hash, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return common.Hash{}, err
+	}
+	defer f.Close()
+	h := crypto.NewKeccakState()
+	if _, err := io.Copy(h, f); err != nil {
+		return common.Hash{}, err
+	}
+	var hash common.Hash
+	h.Read(hash[:])
+	return hash, nil
+}
+
+func (c *RootCache) Get(programPath string, modelPath string, prompt string) (*RootEntry, bool, error) {
+	key, _, _, err := c.key(programPath, modelPath, prompt)
+	if err != nil {
+		return nil, false, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.Entries[key]
+	if !ok {
+		return nil, false, nil
+	}
+	c.clock += 1
+	e.LastUsed = c.clock
+	ret := *e
+	return &ret, true, nil
+}
+
+// Put caches the root, node count, answer and transcript of the entry
+func (c *RootCache) Put(programPath string, modelPath string, prompt string, entry RootEntry) error {
+	key, programHash, modelHash, err := c.key(programPath, modelPath, prompt)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.clock += 1
+	entry.ProgramHash = programHash
+	entry.ModelHash = modelHash
+	entry.LastUsed = c.clock
+	c.Entries[key] = &entry
+	c.evict()
+	return c.save()
+}
+
+func (c *RootCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.Entries)
+}
+
+// LiveRoots returns the golden and final node roots of the entries, whose preimages are kept
+// by the preimage gc
+func (c *RootCache) LiveRoots() []common.Hash {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	roots := make([]common.Hash, 0, len(c.Entries))
+	for _, e := range c.Entries {
+		roots = append(roots, e.Root)
+		roots = append(roots, e.NodeRoots...)
+	}
+	return roots
+}
+
+// key returns the key of the entry and the hashes of the program and model, without the lock
+func (c *RootCache) key(programPath string, modelPath string, prompt string) (common.Hash, common.Hash, common.Hash, error) {
+	programHash, err := c.fileHash(programPath)
+	if err != nil {
+		return common.Hash{}, common.Hash{}, common.Hash{}, err
+	}
+	modelHash, err := c.fileHash(modelPath)
+	if err != nil {
+		return common.Hash{}, common.Hash{}, common.Hash{}, err
+	}
+	return rootCacheKey(programHash, modelHash, prompt), programHash, modelHash, nil
+}
+
+// evict drops the least recently used entries above maxSize
+func (c *RootCache) evict() {
+	for c.maxSize > 0 && len(c.Entries) > c.maxSize {
+		var oldest common.Hash
+		var oldestUsed int64 = -1
+		for k, e := range c.Entries {
+			if oldestUsed < 0 || e.LastUsed < oldestUsed {
+				oldest, oldestUsed = k, e.LastUsed
+			}
+		}
+		delete(c.Entries, oldest)
+	}
+}
+
+func (c *RootCache) save() error {
+	if c.path == "" {
+		return nil
+	}
+	dat, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	tmp := c.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, dat, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, c.path)
+}
@@ -0,0 +1,96 @@
+package vm
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func TestRootCache(t *testing.T) {
+	dir := t.TempDir()
+	program := filepath.Join(dir, "program.bin")
+	model := filepath.Join(dir, "model.bin")
+	ioutil.WriteFile(program, []byte("program"), 0644)
+	ioutil.WriteFile(model, []byte("model"), 0644)
+	cachePath := filepath.Join(dir, "cache.json")
+
+	c, err := NewRootCache(cachePath, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, _ := c.Get(program, model, "a"); ok {
+		t.Fatal("unexpected hit")
+	}
+	c.Put(program, model, "a", RootEntry{Root: common.HexToHash("0x0a"), NodeCount: 10})
+	c.Put(program, model, "b", RootEntry{Root: common.HexToHash("0x0b"), NodeCount: 11})
+	e, ok, err := c.Get(program, model, "a")
+	if err != nil || !ok || e.Root != common.HexToHash("0x0a") || e.NodeCount != 10 {
+		t.Fatalf("got %+v %v %v", e, ok, err)
+	}
+
+	// b is the least recently used
+	c.Put(program, model, "c", RootEntry{Root: common.HexToHash("0x0c"), NodeCount: 12, Answer: " world"})
+	if _, ok, _ := c.Get(program, model, "b"); ok {
+		t.Fatal("b not evicted")
+	}
+
+	c, err = NewRootCache(cachePath, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, ok, _ := c.Get(program, model, "c"); !ok || e.Answer != " world" || c.Len() != 2 {
+		t.Fatal("cache not persisted")
+	}
+
+	// a new model invalidates its entries
+	ioutil.WriteFile(model, []byte("model v2"), 0644)
+	future := time.Now().Add(time.Hour)
+	setModTime(t, model, future)
+	if _, ok, _ := c.Get(program, model, "c"); ok {
+		t.Fatal("hit after model change")
+	}
+	if c.Len() != 0 {
+		t.Fatalf("%d stale entries", c.Len())
+	}
+}
+
+func setModTime(t *testing.T, fn string, mtime time.Time) {
+	if err := os.Chtimes(fn, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRootCacheConcurrentLookups(t *testing.T) {
+	dir := t.TempDir()
+	program := filepath.Join(dir, "program.bin")
+	model := filepath.Join(dir, "model.bin")
+	ioutil.WriteFile(program, []byte("program"), 0644)
+	ioutil.WriteFile(model, make([]byte, 1<<20), 0644)
+	c, err := NewRootCache("", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Put(program, model, "a", RootEntry{Root: common.HexToHash("0x0a")})
+
+	// concurrent lookups of a changed model share its hash and drop its entries
+	ioutil.WriteFile(model, make([]byte, 2<<20), 0644)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, ok, err := c.Get(program, model, "a"); ok || err != nil {
+				t.Errorf("hit after model change: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if c.Len() != 0 || len(c.Files) != 2 {
+		t.Fatalf("%d entries, %d files", c.Len(), len(c.Files))
+	}
+}
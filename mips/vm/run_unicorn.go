@@ -3,26 +3,18 @@ package vm
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"os"
+	"time"
 
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/fatih/color"
 	uc "github.com/unicorn-engine/unicorn/bindings/go/unicorn"
 )
 
-// SHOULD BE GO BUILTIN
-func check(err error) {
-	if err != nil {
-		log.Fatal(err)
-	}
-}
-
-var steps int = 0
-var heap_start uint64 = 0
-
 func WriteBytes(fd int, bytes []byte) {
 	printer := color.New(color.FgWhite).SprintFunc()
 	if fd == 1 {
@@ -49,35 +41,41 @@ var REG_OFFSET uint32 = 0xc0000000
 var REG_PC uint32 = REG_OFFSET + 0x20*4
 var REG_HEAP uint32 = REG_OFFSET + 0x23*4
 
-func SyncRegs(mu uc.Unicorn, ram map[uint32](uint32)) {
+func (m *Machine) SyncRegs(mu uc.Unicorn) {
 	pc, _ := mu.RegRead(uc.MIPS_REG_PC)
 	//fmt.Printf("%d uni %x\n", step, pc)
-	WriteRam(ram, 0xc0000080, uint32(pc))
+	m.WriteRam(0xc0000080, uint32(pc))
 
 	addr := uint32(0xc0000000)
 	for i := uc.MIPS_REG_ZERO; i < uc.MIPS_REG_ZERO+32; i++ {
 		reg, _ := mu.RegRead(i)
-		WriteRam(ram, addr, uint32(reg))
+		m.WriteRam(addr, uint32(reg))
 		addr += 4
 	}
 
 	reg_hi, _ := mu.RegRead(uc.MIPS_REG_HI)
 	reg_lo, _ := mu.RegRead(uc.MIPS_REG_LO)
-	WriteRam(ram, REG_OFFSET+0x21*4, uint32(reg_hi))
-	WriteRam(ram, REG_OFFSET+0x22*4, uint32(reg_lo))
+	m.WriteRam(REG_OFFSET+0x21*4, uint32(reg_hi))
+	m.WriteRam(REG_OFFSET+0x22*4, uint32(reg_lo))
 
-	WriteRam(ram, REG_HEAP, uint32(heap_start))
+	m.WriteRam(REG_HEAP, uint32(m.HeapStart))
 }
 
-func GetHookedUnicorn(root string, ram map[uint32](uint32), callback func(int, uc.Unicorn, map[uint32](uint32))) uc.Unicorn {
+// GetHookedUnicorn returns an emulator over the machine ram, errors raised in the
+// hooks stop it and are returned by Start
+func (m *Machine) GetHookedUnicorn(root string, callback func(int, uc.Unicorn, map[uint32](uint32))) (uc.Unicorn, error) {
 	mu, err := uc.NewUnicorn(uc.ARCH_MIPS, uc.MODE_32|uc.MODE_BIG_ENDIAN)
-	check(err)
+	if err != nil {
+		return nil, fmt.Errorf("create unicorn: %w", err)
+	}
 
-	_, outputfault := os.LookupEnv("OUTPUTFAULT")
+	oracle := m.Faults.Oracle(StoreOracle(m.preimageStore(root)))
 
 	mu.HookAdd(uc.HOOK_INTR, func(mu uc.Unicorn, intno uint32) {
 		if intno != 17 {
-			log.Fatal("invalid interrupt ", intno, " at step ", steps)
+			pc, _ := mu.RegRead(uc.MIPS_REG_PC)
+			m.fail(mu, &InterruptError{Intno: intno, Step: m.Steps, PC: uint32(pc)})
+			return
 		}
 		syscall_no, _ := mu.RegRead(uc.MIPS_REG_V0)
 		v0 := uint64(0)
@@ -87,8 +85,7 @@ func GetHookedUnicorn(root string, ram map[uint32](uint32), callback func(int, u
 			// unless we need to load some data, for example, parameters in DNN?
 			oracle_hash, _ := mu.MemRead(0x30001000, 0x20)
 			hash := common.BytesToHash(oracle_hash)
-			key := fmt.Sprintf("%s/%s", root, hash)
-			value, err := ioutil.ReadFile(key)
+			value, err := oracle(hash)
 			// check(err)
 			if err == nil {
 				tmp := []byte{0, 0, 0, 0}
@@ -96,10 +93,10 @@ func GetHookedUnicorn(root string, ram map[uint32](uint32), callback func(int, u
 				mu.MemWrite(0x31000000, tmp)
 				mu.MemWrite(0x31000004, value)
 	
-				WriteRam(ram, 0x31000000, uint32(len(value)))
+				m.WriteRam(0x31000000, uint32(len(value)))
 				value = append(value, 0, 0, 0)
-				for i := uint32(0); i < ram[0x31000000]; i += 4 {
-					WriteRam(ram, 0x31000004+i, binary.BigEndian.Uint32(value[i:i+4]))
+				for i := uint32(0); i < m.Ram[0x31000000]; i += 4 {
+					m.WriteRam(0x31000004+i, binary.BigEndian.Uint32(value[i:i+4]))
 				}
 			}
 
@@ -108,13 +105,17 @@ func GetHookedUnicorn(root string, ram map[uint32](uint32), callback func(int, u
 			buf, _ := mu.RegRead(uc.MIPS_REG_A1)
 			count, _ := mu.RegRead(uc.MIPS_REG_A2)
 			bytes, _ := mu.MemRead(buf, count)
-			WriteBytes(int(fd), bytes)
+			m.writeOutput(int(fd), bytes)
 		} else if syscall_no == 4090 {
 			a0, _ := mu.RegRead(uc.MIPS_REG_A0)
 			sz, _ := mu.RegRead(uc.MIPS_REG_A1)
 			if a0 == 0 {
-				v0 = 0x20000000 + heap_start
-				heap_start += sz
+				if m.HeapStart+sz > m.maxHeapSize() {
+					m.fail(mu, &LayoutError{Region: "heap", Start: HEAP_ADDR, Size: m.HeapStart + sz, Limit: HEAP_ADDR + m.maxHeapSize()})
+					return
+				}
+				v0 = 0x20000000 + m.HeapStart
+				m.HeapStart += sz
 			} else {
 				v0 = a0
 			}
@@ -130,51 +131,137 @@ func GetHookedUnicorn(root string, ram map[uint32](uint32), callback func(int, u
 		}
 		mu.RegWrite(uc.MIPS_REG_V0, v0)
 		mu.RegWrite(uc.MIPS_REG_A3, 0)
+		if m.tracer != nil {
+			m.tracer.syscall(uint32(syscall_no), uint32(v0))
+		}
 	}, 0, 0)
 
 	if callback != nil {
 		mu.HookAdd(uc.HOOK_MEM_WRITE, func(mu uc.Unicorn, access int, addr64 uint64, size int, value int64) {
-			rt := value
-			rs := addr64 & 3
-			addr := uint32(addr64 & 0xFFFFFFFC)
-			if outputfault && addr == 0x30000804 {
-				fmt.Printf("injecting output fault over %x\n", rt)
-				rt = 0xbabababa
-			}
-			//fmt.Printf("%X(%d) = %x (at step %d)\n", addr, size, value, steps)
-			if size == 1 {
-				mem := ram[addr]
-				val := uint32((rt & 0xFF) << (24 - (rs&3)*8))
-				mask := 0xFFFFFFFF ^ uint32(0xFF<<(24-(rs&3)*8))
-				WriteRam(ram, uint32(addr), (mem&mask)|val)
-			} else if size == 2 {
-				mem := ram[addr]
-				val := uint32((rt & 0xFFFF) << (16 - (rs&2)*8))
-				mask := 0xFFFFFFFF ^ uint32(0xFFFF<<(16-(rs&2)*8))
-				WriteRam(ram, uint32(addr), (mem&mask)|val)
-			} else if size == 4 {
-				WriteRam(ram, uint32(addr), uint32(rt))
-			} else {
-				log.Fatal("bad size write to ram")
+			//fmt.Printf("%X(%d) = %x (at step %d)\n", addr64, size, value, steps)
+			if err := m.memWrite(addr64, size, value); err != nil {
+				m.fail(mu, err)
 			}
-
 		}, 0, 0x80000000)
 
 		mu.HookAdd(uc.HOOK_CODE, func(mu uc.Unicorn, addr uint64, size uint32) {
-			callback(steps, mu, ram)
-			steps += 1
+			if m.tracer != nil {
+				if err := m.tracer.finishStep(mu, m); err != nil {
+					m.fail(mu, err)
+					return
+				}
+			}
+			m.Faults.applyUnicorn(m.Steps, mu, m)
+			callback(m.Steps, mu, m.Ram)
+			if m.tracer != nil {
+				m.tracer.startStep(m.Steps, uint32(addr), mu, m)
+			}
+			m.lastPC, m.stepped = uint32(addr), true
+			m.Steps += 1
 		}, 0, 0x80000000)
 	}
 
-	check(mu.MemMap(0, 0x80000000))
-	return mu
+	if err := mu.MemMap(0, 0x80000000); err != nil {
+		mu.Close()
+		return nil, fmt.Errorf("map unicorn memory: %w", err)
+	}
+	return mu, nil
+}
+
+// memWrite merges a store of size bytes into the word of the ram, the write faults apply to
+// the merged word like in the interpreter
+func (m *Machine) memWrite(addr64 uint64, size int, value int64) error {
+	rt := value
+	rs := addr64 & 3
+	addr := uint32(addr64 & 0xFFFFFFFC)
+	var word uint32
+	if size == 1 {
+		mem := m.Ram[addr]
+		val := uint32((rt & 0xFF) << (24 - (rs&3)*8))
+		mask := 0xFFFFFFFF ^ uint32(0xFF<<(24-(rs&3)*8))
+		word = (mem & mask) | val
+	} else if size == 2 {
+		mem := m.Ram[addr]
+		val := uint32((rt & 0xFFFF) << (16 - (rs&2)*8))
+		mask := 0xFFFFFFFF ^ uint32(0xFFFF<<(16-(rs&2)*8))
+		word = (mem & mask) | val
+	} else if size == 4 {
+		word = uint32(rt)
+	} else {
+		return &WriteSizeError{Size: size, Addr: addr, Step: m.Steps}
+	}
+	m.WriteRam(addr, m.Faults.write(addr, word))
+	return nil
+}
+
+// fail records the first error of a hook and stops the emulation
+func (m *Machine) fail(mu uc.Unicorn, err error) {
+	if m.err == nil {
+		m.err = err
+	}
+	mu.Stop()
+}
+
+// Start runs the emulator until the address within the limits of the Config,
+// and returns the error that stopped it
+func (m *Machine) Start(mu uc.Unicorn, begin uint64, until uint64) error {
+	options := &uc.UcOptions{}
+	if m.Config.MaxSteps > 0 {
+		options.Count = uint64(m.Config.MaxSteps)
+	}
+	if m.Config.MaxDuration > 0 {
+		options.Timeout = uint64(m.Config.MaxDuration / time.Microsecond)
+	}
+	start := time.Now()
+	err := mu.StartWithOptions(begin, until, options)
+	if err == nil && m.err == nil && (options.Count > 0 || options.Timeout > 0) {
+		// unicorn returns quietly when a limit is hit, the pc tells it did not finish
+		pc, _ := mu.RegRead(uc.MIPS_REG_PC)
+		if pc != until {
+			limit := "steps"
+			if options.Timeout > 0 && time.Since(start) >= m.Config.MaxDuration {
+				limit = "duration"
+			}
+			err = &LimitError{Limit: limit, Step: m.Steps, PC: uint32(pc)}
+		}
+	}
+	if m.err != nil {
+		err = m.err
+	}
+	recordRun(m.Steps, time.Since(start), err)
+	return err
+}
+
+// startStep runs the instruction at begin alone, unicorn goes on at the next word
+func (m *Machine) startStep(mu uc.Unicorn, begin uint64) error {
+	err := mu.StartWithOptions(begin, STOP_PC, &uc.UcOptions{Count: 1})
+	if m.err != nil {
+		err = m.err
+	}
+	return err
 }
 
-func LoadMappedFileUnicorn(mu uc.Unicorn, fn string, ram map[uint32](uint32), base uint32) {
+func LoadMappedFileUnicorn(mu uc.Unicorn, fn string, ram map[uint32](uint32), base uint32) error {
 	dat, err := ioutil.ReadFile(fn)
-	check(err)
+	if err != nil {
+		return &LoadError{What: "file", Path: fn, Err: err}
+	}
 	LoadData(dat, ram, base)
-	mu.MemWrite(uint64(base), dat)
+	return mu.MemWrite(uint64(base), dat)
+}
+
+// LoadProgramUnicorn maps the program at 0 and records its hash for the checkpoint header
+func (m *Machine) LoadProgramUnicorn(mu uc.Unicorn, fn string) error {
+	dat, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return &LoadError{What: "program", Path: fn, Err: err}
+	}
+	m.programHash = crypto.Keccak256Hash(dat)
+	LoadData(dat, m.Ram, 0)
+	if err := mu.MemWrite(0, dat); err != nil {
+		return &LoadError{What: "program", Path: fn, Err: err}
+	}
+	return nil
 }
 
 func LoadBytesToUnicorn(mu uc.Unicorn, dat []byte, ram map[uint32](uint32), base uint32) {
@@ -183,16 +270,25 @@ func LoadBytesToUnicorn(mu uc.Unicorn, dat []byte, ram map[uint32](uint32), base
 }
 
 // reimplement simple.py in go
-func RunUnicorn(fn string, ram map[uint32](uint32), checkIO bool, callback func(int, uc.Unicorn, map[uint32](uint32))) {
+func RunUnicorn(fn string, ram map[uint32](uint32), checkIO bool, callback func(int, uc.Unicorn, map[uint32](uint32))) error {
 	root := "/tmp/cannon/0_13284469"
-	mu := GetHookedUnicorn(root, ram, callback)
+	m := NewMachine(nil)
+	m.Ram = ram
+	mu, err := m.GetHookedUnicorn(root, callback)
+	if err != nil {
+		return err
+	}
+	defer mu.Close()
 
 	// loop forever to match EVM
 	//mu.MemMap(0x5ead0000, 0x1000)
 	//mu.MemWrite(0xdead0000, []byte{0x08, 0x10, 0x00, 0x00})
 
 	// program
-	dat, _ := ioutil.ReadFile(fn)
+	dat, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return &LoadError{What: "program", Path: fn, Err: err}
+	}
 	mu.MemWrite(0, dat)
 
 	// inputs
@@ -206,12 +302,15 @@ func RunUnicorn(fn string, ram map[uint32](uint32), checkIO bool, callback func(
 		if checkIO {
 			LoadData(inputs[0:0xc0], ram, 0x30000000)
 		}
-	
-		mu.Start(0, 0x5ead0004)
+
+		err = m.Start(mu, 0, 0x5ead0004)
 	} else {
 		// load into ram
 		LoadData(dat, ram, 0)
-		mu.Start(0, 0x5ead0004)
+		err = m.Start(mu, 0, 0x5ead0004)
+	}
+	if err != nil {
+		return err
 	}
 
 
@@ -223,10 +322,11 @@ func RunUnicorn(fn string, ram map[uint32](uint32), checkIO bool, callback func(
 			real := append([]byte{0x13, 0x37, 0xf0, 0x0d}, outputs...)
 			output, _ := mu.MemRead(0x30000800, 0x44)
 			if bytes.Compare(real, output) != 0 {
-				log.Fatal("mismatch output")
+				return errors.New("mismatch output")
 			} else {
 				fmt.Println("output match")
 			}
 		}
 	}
+	return nil
 }
@@ -0,0 +1,401 @@
+package vm
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+
+	uc "github.com/unicorn-engine/unicorn/bindings/go/unicorn"
+)
+
+// execution trace layout, all integers are big endian
+//
+//	magic   [8]byte "OPMLTRCE"
+//	version uint16
+//	records, each
+//	  step    uvarint
+//	  pc      uint32
+//	  insn    uint32
+//	  flags   uint8, TRACE_SYSCALL if the record ends with a syscall
+//	  regs    uint8, then regs * (reg uint8, value uint32), reg indexes REG_NAMES
+//	  mems    uvarint, then mems * (addr uint32, value uint32), the word after the write
+//	  syscall number uint32, v0 uint32
+//	index   (step int64, offset int64) of every TRACE_INDEX_INTERVAL-th record
+//	entries uint64, of the index
+//	offset  uint64, of the index
+var traceMagic = []byte("OPMLTRCE")
+
+const (
+	TRACE_VERSION        = 1
+	TRACE_INDEX_INTERVAL = 1024
+
+	TRACE_SYSCALL uint8 = 1
+)
+
+// TraceRecord is an executed instruction and what it wrote
+type TraceRecord struct {
+	Step    int
+	PC      uint32
+	Insn    uint32
+	Regs    []RegWrite
+	Mems    []MemWrite
+	Syscall *TraceSyscall
+}
+
+type RegWrite struct {
+	Reg   uint8
+	Value uint32
+}
+
+type MemWrite struct {
+	Addr  uint32
+	Value uint32
+}
+
+type TraceSyscall struct {
+	Number uint32
+	V0     uint32
+}
+
+type traceIndexEntry struct {
+	Step   int64
+	Offset int64
+}
+
+type TraceWriter struct {
+	f       *os.File
+	w       *bufio.Writer
+	buf     bytes.Buffer
+	offset  int64
+	records int
+	index   []traceIndexEntry
+}
+
+func CreateTrace(fn string) (*TraceWriter, error) {
+	f, err := os.Create(fn)
+	if err != nil {
+		return nil, err
+	}
+	t := &TraceWriter{f: f, w: bufio.NewWriter(f)}
+	t.w.Write(traceMagic)
+	binary.Write(t.w, binary.BigEndian, uint16(TRACE_VERSION))
+	t.offset = int64(len(traceMagic)) + 2
+	return t, nil
+}
+
+func (t *TraceWriter) Write(r *TraceRecord) error {
+	if t.records%TRACE_INDEX_INTERVAL == 0 {
+		t.index = append(t.index, traceIndexEntry{Step: int64(r.Step), Offset: t.offset})
+	}
+	t.records++
+
+	b := &t.buf
+	b.Reset()
+	var flags uint8
+	if r.Syscall != nil {
+		flags |= TRACE_SYSCALL
+	}
+	putUvarint(b, uint64(r.Step))
+	binary.Write(b, binary.BigEndian, r.PC)
+	binary.Write(b, binary.BigEndian, r.Insn)
+	b.WriteByte(flags)
+	b.WriteByte(uint8(len(r.Regs)))
+	for _, w := range r.Regs {
+		b.WriteByte(w.Reg)
+		binary.Write(b, binary.BigEndian, w.Value)
+	}
+	putUvarint(b, uint64(len(r.Mems)))
+	for _, w := range r.Mems {
+		binary.Write(b, binary.BigEndian, w.Addr)
+		binary.Write(b, binary.BigEndian, w.Value)
+	}
+	if r.Syscall != nil {
+		binary.Write(b, binary.BigEndian, r.Syscall.Number)
+		binary.Write(b, binary.BigEndian, r.Syscall.V0)
+	}
+	n, err := t.w.Write(b.Bytes())
+	t.offset += int64(n)
+	return err
+}
+
+// Close writes the index
+func (t *TraceWriter) Close() error {
+	binary.Write(t.w, binary.BigEndian, t.index)
+	binary.Write(t.w, binary.BigEndian, uint64(len(t.index)))
+	binary.Write(t.w, binary.BigEndian, uint64(t.offset))
+	err := t.w.Flush()
+	if cerr := t.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func putUvarint(b *bytes.Buffer, v uint64) {
+	var tmp [binary.MaxVarintLen64]byte
+	b.Write(tmp[:binary.PutUvarint(tmp[:], v)])
+}
+
+type TraceReader struct {
+	f     *os.File
+	index []traceIndexEntry
+	end   int64 // of the records
+}
+
+func OpenTrace(fn string) (*TraceReader, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	t, err := readTraceIndex(f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %w", fn, err)
+	}
+	return t, nil
+}
+
+func readTraceIndex(f *os.File) (*TraceReader, error) {
+	header := make([]byte, len(traceMagic)+2)
+	if _, err := io.ReadFull(f, header); err != nil || !bytes.Equal(header[:len(traceMagic)], traceMagic) {
+		return nil, errors.New("not a trace")
+	}
+	if v := binary.BigEndian.Uint16(header[len(traceMagic):]); v != TRACE_VERSION {
+		return nil, fmt.Errorf("unsupported trace version %d", v)
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	var footer struct {
+		Entries uint64
+		Offset  uint64
+	}
+	if fi.Size() < int64(len(header))+16 {
+		return nil, errors.New("trace truncated")
+	}
+	if err := binary.Read(io.NewSectionReader(f, fi.Size()-16, 16), binary.BigEndian, &footer); err != nil {
+		return nil, err
+	}
+	if footer.Offset < uint64(len(header)) || footer.Offset+footer.Entries*16+16 != uint64(fi.Size()) {
+		return nil, errors.New("trace truncated")
+	}
+	index := make([]traceIndexEntry, footer.Entries)
+	if err := binary.Read(io.NewSectionReader(f, int64(footer.Offset), int64(footer.Entries)*16), binary.BigEndian, index); err != nil {
+		return nil, err
+	}
+	return &TraceReader{f: f, index: index, end: int64(footer.Offset)}, nil
+}
+
+// Range calls fn with the records of the steps in [from, to), to < 0 for no end
+func (t *TraceReader) Range(from int, to int, fn func(*TraceRecord) error) error {
+	// the last indexed record at or before from
+	i := sort.Search(len(t.index), func(i int) bool { return t.index[i].Step > int64(from) })
+	if i == 0 {
+		if len(t.index) == 0 {
+			return nil
+		}
+		i = 1
+	}
+	start := t.index[i-1].Offset
+	r := bufio.NewReader(io.NewSectionReader(t.f, start, t.end-start))
+	for {
+		rec, err := readTraceRecord(r)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if to >= 0 && rec.Step >= to {
+			return nil
+		}
+		if rec.Step < from {
+			continue
+		}
+		if err := fn(rec); err != nil {
+			return err
+		}
+	}
+}
+
+func (t *TraceReader) Close() error {
+	return t.f.Close()
+}
+
+func readTraceRecord(r *bufio.Reader) (*TraceRecord, error) {
+	step, err := binary.ReadUvarint(r)
+	if err != nil {
+		// a clean end is at a record boundary
+		return nil, err
+	}
+	rec := &TraceRecord{Step: int(step)}
+	var head struct {
+		PC    uint32
+		Insn  uint32
+		Flags uint8
+		Regs  uint8
+	}
+	if err := binary.Read(r, binary.BigEndian, &head); err != nil {
+		return nil, truncated(err)
+	}
+	rec.PC, rec.Insn = head.PC, head.Insn
+	if head.Regs > 0 {
+		rec.Regs = make([]RegWrite, head.Regs)
+		if err := binary.Read(r, binary.BigEndian, rec.Regs); err != nil {
+			return nil, truncated(err)
+		}
+	}
+	mems, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, truncated(err)
+	}
+	// the count is not trusted with an allocation
+	for i := uint64(0); i < mems; i++ {
+		var w MemWrite
+		if err := binary.Read(r, binary.BigEndian, &w); err != nil {
+			return nil, truncated(err)
+		}
+		rec.Mems = append(rec.Mems, w)
+	}
+	if head.Flags&TRACE_SYSCALL != 0 {
+		rec.Syscall = &TraceSyscall{}
+		if err := binary.Read(r, binary.BigEndian, rec.Syscall); err != nil {
+			return nil, truncated(err)
+		}
+	}
+	return rec, nil
+}
+
+func truncated(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// ReadTrace returns the records of the steps in [from, to) of the trace fn, to < 0 for no end
+func ReadTrace(fn string, from int, to int) ([]*TraceRecord, error) {
+	t, err := OpenTrace(fn)
+	if err != nil {
+		return nil, err
+	}
+	defer t.Close()
+	var records []*TraceRecord
+	err = t.Range(from, to, func(r *TraceRecord) error {
+		records = append(records, r)
+		return nil
+	})
+	return records, err
+}
+
+// tracer records the steps of a unicorn run in [from, to). The registers an instruction
+// wrote are the ones that changed when the hook of the next instruction runs.
+type tracer struct {
+	w       *TraceWriter
+	from    int
+	to      int
+	pending *TraceRecord
+	regs    [len(REG_NAMES)]uint32
+}
+
+func (t *tracer) inRange(step int) bool {
+	return step >= t.from && (t.to <= 0 || step < t.to)
+}
+
+// readRegs reads the registers by their REG_NAMES index, the pc is left out
+func readRegs(mu uc.Unicorn, m *Machine) [len(REG_NAMES)]uint32 {
+	var regs [len(REG_NAMES)]uint32
+	for i := 1; i < 32; i++ {
+		reg, _ := mu.RegRead(uc.MIPS_REG_ZERO + i)
+		regs[i] = uint32(reg)
+	}
+	hi, _ := mu.RegRead(uc.MIPS_REG_HI)
+	lo, _ := mu.RegRead(uc.MIPS_REG_LO)
+	regs[0x21], regs[0x22] = uint32(hi), uint32(lo)
+	regs[0x23] = uint32(m.HeapStart)
+	return regs
+}
+
+// finishStep writes the record of the last instruction with the registers it changed
+func (t *tracer) finishStep(mu uc.Unicorn, m *Machine) error {
+	if t.pending == nil {
+		return nil
+	}
+	regs := readRegs(mu, m)
+	for i := range regs {
+		if regs[i] != t.regs[i] {
+			t.pending.Regs = append(t.pending.Regs, RegWrite{Reg: uint8(i), Value: regs[i]})
+		}
+	}
+	err := t.w.Write(t.pending)
+	t.pending = nil
+	return err
+}
+
+// startStep starts the record of the instruction at pc, unless the hooks moved the pc
+func (t *tracer) startStep(step int, pc uint32, mu uc.Unicorn, m *Machine) {
+	if !t.inRange(step) {
+		return
+	}
+	if cur, _ := mu.RegRead(uc.MIPS_REG_PC); uint32(cur) != pc {
+		return
+	}
+	t.regs = readRegs(mu, m)
+	t.pending = &TraceRecord{Step: step, PC: pc, Insn: m.Ram[pc]}
+}
+
+func (t *tracer) memWrite(addr uint32, value uint32) {
+	if t.pending != nil {
+		t.pending.Mems = append(t.pending.Mems, MemWrite{Addr: addr, Value: value})
+	}
+}
+
+func (t *tracer) syscall(number uint32, v0 uint32) {
+	if t.pending != nil {
+		t.pending.Syscall = &TraceSyscall{Number: number, V0: v0}
+	}
+}
+
+// TracePath is the trace of the run of nodeID starting at step start
+func TracePath(dir string, nodeID int, start int) string {
+	return filepath.Join(dir, fmt.Sprintf("trace_%d_%d.trace", nodeID, start))
+}
+
+// startTrace records the run in the trace dir of the config, if set
+func (m *Machine) startTrace(nodeID int, start int) error {
+	if m.Config.TraceDir == "" {
+		return nil
+	}
+	if err := os.MkdirAll(m.Config.TraceDir, os.ModePerm); err != nil {
+		return err
+	}
+	w, err := CreateTrace(TracePath(m.Config.TraceDir, nodeID, start))
+	if err != nil {
+		return err
+	}
+	m.tracer = &tracer{w: w, from: m.Config.TraceFrom, to: m.Config.TraceTo}
+	return nil
+}
+
+// stopTrace writes the last record and the index, later calls do nothing
+func (m *Machine) stopTrace(mu uc.Unicorn) error {
+	t := m.tracer
+	if t == nil {
+		return nil
+	}
+	m.tracer = nil
+	err := t.finishStep(mu, m)
+	if cerr := t.w.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("write trace: %w", err)
+	}
+	return nil
+}
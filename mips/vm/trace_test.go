@@ -0,0 +1,62 @@
+package vm
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestTraceRange(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "trace_0_0.trace")
+	w, err := CreateTrace(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var written []*TraceRecord
+	for step := 100; step < 100+3*TRACE_INDEX_INTERVAL+10; step++ {
+		r := &TraceRecord{Step: step, PC: uint32(step * 4), Insn: 0x24020fa4}
+		if step%3 == 0 {
+			r.Regs = []RegWrite{{Reg: 2, Value: uint32(step)}, {Reg: 0x23, Value: 0x1000}}
+		}
+		if step%5 == 0 {
+			r.Mems = []MemWrite{{Addr: HEAP_ADDR, Value: uint32(step)}}
+		}
+		if step%7 == 0 {
+			r.Syscall = &TraceSyscall{Number: 4004, V0: 1}
+		}
+		if err := w.Write(r); err != nil {
+			t.Fatal(err)
+		}
+		written = append(written, r)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct{ from, to, first, n int }{
+		{0, -1, 100, len(written)},
+		{100 + TRACE_INDEX_INTERVAL - 1, 100 + TRACE_INDEX_INTERVAL + 2, 100 + TRACE_INDEX_INTERVAL - 1, 3},
+		{2000, 2001, 2000, 1},
+		{5000, -1, 0, 0},
+	} {
+		records, err := ReadTrace(fn, c.from, c.to)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(records) != c.n {
+			t.Fatalf("[%d, %d): got %d records", c.from, c.to, len(records))
+		}
+		for i, r := range records {
+			if !reflect.DeepEqual(r, written[c.first-100+i]) {
+				t.Fatalf("[%d, %d): got %+v, expected %+v", c.from, c.to, r, written[c.first-100+i])
+			}
+		}
+	}
+
+	dat, _ := os.ReadFile(fn)
+	os.WriteFile(fn, dat[:len(dat)-1], 0644)
+	if _, err := OpenTrace(fn); err == nil {
+		t.Fatal("expected an error for a truncated trace")
+	}
+}
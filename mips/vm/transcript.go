@@ -0,0 +1,165 @@
+package vm
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// kinds of the transcript leaves, in the order of the leaves
+const (
+	LEAF_PROMPT     = byte(iota) // a prompt token
+	LEAF_TOKEN                   // a generated token
+	LEAF_NODE_COUNT              // the node count of the graph
+	LEAF_NODE_ROOT               // the final state root of a graph node
+)
+
+// Transcript is the commitment of an inference, a merkle tree with a leaf for each prompt
+// token, each generated token, the node count of the graph and the final state root of
+// each graph node, so a challenger can dispute any of them with its proof
+type Transcript struct {
+	PromptTokens []uint32      `json:"promptTokens"`
+	Tokens       []uint32      `json:"tokens"`
+	NodeCount    int           `json:"nodeCount"`
+	NodeRoots    []common.Hash `json:"nodeRoots"`
+}
+
+// TranscriptLeaf hashes the value of the index-th leaf of a kind
+func TranscriptLeaf(kind byte, index int, value []byte) common.Hash {
+	return crypto.Keccak256Hash([]byte{kind}, IntToBytes(index), value)
+}
+
+// LeafIndex is the position in the tree of the index-th leaf of a kind
+func (t *Transcript) LeafIndex(kind byte, index int) int {
+	switch kind {
+	case LEAF_PROMPT:
+		return index
+	case LEAF_TOKEN:
+		return len(t.PromptTokens) + index
+	case LEAF_NODE_COUNT:
+		return len(t.PromptTokens) + len(t.Tokens)
+	}
+	return len(t.PromptTokens) + len(t.Tokens) + 1 + index
+}
+
+func (t *Transcript) Leaves() []common.Hash {
+	leaves := make([]common.Hash, 0, len(t.PromptTokens)+len(t.Tokens)+1+len(t.NodeRoots))
+	for i, token := range t.PromptTokens {
+		leaves = append(leaves, TranscriptLeaf(LEAF_PROMPT, i, IntToBytes(int(token))))
+	}
+	for i, token := range t.Tokens {
+		leaves = append(leaves, TranscriptLeaf(LEAF_TOKEN, i, IntToBytes(int(token))))
+	}
+	leaves = append(leaves, TranscriptLeaf(LEAF_NODE_COUNT, 0, IntToBytes(t.NodeCount)))
+	for i, root := range t.NodeRoots {
+		leaves = append(leaves, TranscriptLeaf(LEAF_NODE_ROOT, i, root[:]))
+	}
+	return leaves
+}
+
+// merkleLevels returns the levels of the tree from the leaves, padded with zero hashes
+// to a power of two, up to the root
+func merkleLevels(leaves []common.Hash) [][]common.Hash {
+	size := 1
+	for size < len(leaves) {
+		size *= 2
+	}
+	level := make([]common.Hash, size)
+	copy(level, leaves)
+	levels := [][]common.Hash{level}
+	for len(level) > 1 {
+		next := make([]common.Hash, len(level)/2)
+		for i := range next {
+			next[i] = crypto.Keccak256Hash(level[2*i][:], level[2*i+1][:])
+		}
+		levels = append(levels, next)
+		level = next
+	}
+	return levels
+}
+
+func (t *Transcript) Root() common.Hash {
+	levels := merkleLevels(t.Leaves())
+	return levels[len(levels)-1][0]
+}
+
+// Proof returns the siblings of the leaf at index, from the leaves up
+func (t *Transcript) Proof(index int) ([]common.Hash, error) {
+	leaves := t.Leaves()
+	if index < 0 || index >= len(leaves) {
+		return nil, fmt.Errorf("no transcript leaf %d of %d", index, len(leaves))
+	}
+	levels := merkleLevels(leaves)
+	proof := make([]common.Hash, 0, len(levels)-1)
+	for _, level := range levels[:len(levels)-1] {
+		proof = append(proof, level[index^1])
+		index /= 2
+	}
+	return proof, nil
+}
+
+// VerifyTranscriptProof checks that leaf is at index in the transcript of root
+func VerifyTranscriptProof(root common.Hash, leaf common.Hash, index int, proof []common.Hash) bool {
+	hash := leaf
+	for _, sibling := range proof {
+		if index%2 == 0 {
+			hash = crypto.Keccak256Hash(hash[:], sibling[:])
+		} else {
+			hash = crypto.Keccak256Hash(sibling[:], hash[:])
+		}
+		index /= 2
+	}
+	return index == 0 && hash == root
+}
+
+// WriteTranscript saves the transcript in dir as <root>.json, for the challengers to get
+// the leaves and proofs of a committed answer
+func WriteTranscript(t *Transcript, dir string) (common.Hash, error) {
+	root := t.Root()
+	dat, err := json.Marshal(t)
+	if err != nil {
+		return root, err
+	}
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return root, err
+	}
+	return root, ioutil.WriteFile(filepath.Join(dir, root.Hex()+".json"), dat, 0644)
+}
+
+func ReadTranscript(fn string) (*Transcript, error) {
+	dat, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	var t Transcript
+	if err := json.Unmarshal(dat, &t); err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// RunNodeRoots runs every graph node of the prompt to its final state, the node roots of
+// the transcripts of the answers to the prompt
+func (m *Machine) RunNodeRoots(prompt string, nodeCount int) ([]common.Hash, error) {
+	tmpDir, err := os.MkdirTemp(os.TempDir(), "opml")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmpDir)
+	roots := make([]common.Hash, nodeCount)
+	for nodeID := 0; nodeID < nodeCount; nodeID++ {
+		basedir := fmt.Sprintf("%s/%d", tmpDir, nodeID)
+		result, err := m.RunNode(basedir, prompt, nodeID, -1)
+		if err != nil {
+			return nil, fmt.Errorf("node %d: %w", nodeID, err)
+		}
+		roots[nodeID] = result.Final
+		os.RemoveAll(basedir)
+	}
+	return roots, nil
+}
@@ -0,0 +1,80 @@
+package vm
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func TestTranscriptProofs(t *testing.T) {
+	tr := &Transcript{
+		PromptTokens: []uint32{1, 15043},
+		Tokens:       []uint32{3186},
+		NodeCount:    2,
+		NodeRoots:    []common.Hash{common.HexToHash("0x0a"), common.HexToHash("0x0b")},
+	}
+	root := tr.Root()
+	leaves := tr.Leaves()
+	if len(leaves) != 6 {
+		t.Fatalf("got %d leaves", len(leaves))
+	}
+	for i, leaf := range leaves {
+		proof, err := tr.Proof(i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !VerifyTranscriptProof(root, leaf, i, proof) {
+			t.Fatalf("leaf %d not verified", i)
+		}
+	}
+
+	// a challenger disputes the generated token
+	index := tr.LeafIndex(LEAF_TOKEN, 0)
+	proof, _ := tr.Proof(index)
+	if !VerifyTranscriptProof(root, TranscriptLeaf(LEAF_TOKEN, 0, IntToBytes(3186)), index, proof) {
+		t.Fatal("token leaf not verified")
+	}
+	if VerifyTranscriptProof(root, TranscriptLeaf(LEAF_TOKEN, 0, IntToBytes(3187)), index, proof) {
+		t.Fatal("other token verified")
+	}
+	if VerifyTranscriptProof(root, leaves[index], index+1, proof) {
+		t.Fatal("token verified at another index")
+	}
+	if _, err := tr.Proof(len(leaves)); err == nil {
+		t.Fatal("expected an error for a missing leaf")
+	}
+
+	dir := t.TempDir()
+	written, err := WriteTranscript(tr, dir)
+	if err != nil || written != root {
+		t.Fatalf("got %s %v", written, err)
+	}
+	read, err := ReadTranscript(filepath.Join(dir, root.Hex()+".json"))
+	if err != nil || read.Root() != root {
+		t.Fatalf("transcript not persisted: %v", err)
+	}
+}
+
+func TestTranscriptCommitsEveryToken(t *testing.T) {
+	tr := &Transcript{
+		PromptTokens: []uint32{1, 15043},
+		Tokens:       []uint32{3186, 29892, 920, 526},
+		NodeCount:    1,
+		NodeRoots:    []common.Hash{common.HexToHash("0x0a")},
+	}
+	root := tr.Root()
+	for i := range tr.Tokens {
+		changed := *tr
+		changed.Tokens = append([]uint32(nil), tr.Tokens...)
+		changed.Tokens[i]++
+		if changed.Root() == root {
+			t.Errorf("token %d not committed", i)
+		}
+	}
+	longer := *tr
+	longer.Tokens = append(append([]uint32(nil), tr.Tokens...), 2)
+	if longer.Root() == root {
+		t.Error("extra token not committed")
+	}
+}
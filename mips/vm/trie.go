@@ -6,16 +6,24 @@ import (
 	"fmt"
 	"sort"
 	"strings"
+	"sync"
 
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethdb"
 	"github.com/ethereum/go-ethereum/oracle"
 	"github.com/ethereum/go-ethereum/rlp"
 	"github.com/ethereum/go-ethereum/trie"
 )
 
-type PreimageKeyValueWriter struct{}
+// PreimageKeyValueWriter collects trie nodes into Preimages and the Store,
+// the zero value writes to the package Preimages used by the helpers below
+type PreimageKeyValueWriter struct {
+	Preimages map[common.Hash][]byte
+	Store     PreimageStore
+}
 
+// Preimages backs RamToTrie, RamFromTrie and the json helpers, a Machine has its own
 var Preimages = make(map[common.Hash][]byte)
 
 type Jtree struct {
@@ -24,44 +32,55 @@ type Jtree struct {
 	NodeID	  int                    `json:"nodeid"`
 	NodeCount int                    `json:"nodeCount"`
 	Preimages map[common.Hash][]byte `json:"preimages"`
+	NextPC    uint32                 `json:"nextpc,omitempty"`
 }
 
-func TrieToJson(root common.Hash, step int) []byte {
-	b, err := json.Marshal(Jtree{Preimages: Preimages, Step: step, Root: root})
-	check(err)
-	return b
+func TrieToJson(root common.Hash, step int) ([]byte, error) {
+	return json.Marshal(Jtree{Preimages: Preimages, Step: step, Root: root})
 }
 
-func TrieToJsonWithNodeID(root common.Hash, step int, nodeID int, nodeCount int) []byte {
-	b, err := json.Marshal(Jtree{Preimages: Preimages, Step: step, NodeID: nodeID, NodeCount: nodeCount, Root: root})
-	check(err)
-	return b
+func TrieToJsonWithNodeID(root common.Hash, step int, nodeID int, nodeCount int) ([]byte, error) {
+	return json.Marshal(Jtree{Preimages: Preimages, Step: step, NodeID: nodeID, NodeCount: nodeCount, Root: root})
 }
 
-func TrieFromJson(dat []byte) (common.Hash, int) {
+func TrieFromJson(dat []byte) (common.Hash, int, error) {
 	var j Jtree
 	err := json.Unmarshal(dat, &j)
-	check(err)
+	if err != nil {
+		return common.Hash{}, 0, err
+	}
 	Preimages = j.Preimages
-	return j.Root, j.Step
+	return j.Root, j.Step, nil
 }
 
 // TODO: this is copied from the oracle
 func (kw PreimageKeyValueWriter) Put(key []byte, value []byte) error {
 	hash := crypto.Keccak256Hash(value)
 	if hash != common.BytesToHash(key) {
-		panic("bad preimage value write")
+		return &TrieError{Op: "put", Err: fmt.Errorf("bad preimage value write %x", key)}
+	}
+	kw.preimages()[hash] = common.CopyBytes(value)
+	if kw.Store != nil {
+		if _, err := kw.Store.Put(value); err != nil {
+			return &TrieError{Op: "put", Err: err}
+		}
 	}
-	Preimages[hash] = common.CopyBytes(value)
 	return nil
 }
 
 func (kw PreimageKeyValueWriter) Delete(key []byte) error {
-	delete(Preimages, common.BytesToHash(key))
+	delete(kw.preimages(), common.BytesToHash(key))
 	return nil
 }
 
-func ParseNodeInternal(elems []byte, depth int, callback func(common.Hash) []byte) {
+func (kw PreimageKeyValueWriter) preimages() map[common.Hash][]byte {
+	if kw.Preimages == nil {
+		return Preimages
+	}
+	return kw.Preimages
+}
+
+func ParseNodeInternal(elems []byte, depth int, callback func(common.Hash) []byte) error {
 	sprefix := strings.Repeat("  ", depth)
 	c, _ := rlp.CountValues(elems)
 	fmt.Println(sprefix, "parsing", depth, "elements", c)
@@ -69,46 +88,86 @@ func ParseNodeInternal(elems []byte, depth int, callback func(common.Hash) []byt
 	for i := 0; i < c; i++ {
 		kind, val, lrest, err := rlp.Split(rest)
 		rest = lrest
-		check(err)
+		if err != nil {
+			return err
+		}
 		if len(val) > 0 {
 			fmt.Println(sprefix, i, kind, val, len(val))
 		}
 		if len(val) == 32 {
 			hh := common.BytesToHash(val)
 			//fmt.Println(sprefix, "node found with len", len(Preimages[hh]))
-			ParseNode(hh, depth+1, callback)
+			if err := ParseNode(hh, depth+1, callback); err != nil {
+				return err
+			}
 		}
 		if kind == rlp.List && len(val) > 0 && len(val) < 32 {
-			ParseNodeInternal(val, depth+1, callback)
+			if err := ParseNodeInternal(val, depth+1, callback); err != nil {
+				return err
+			}
 		}
 	}
+	return nil
 }
 
 // full nodes / BRANCH_NODE have 17 values, each a hash
 // LEAF or EXTENSION nodes have 2 values, a path and value
-func ParseNode(node common.Hash, depth int, callback func(common.Hash) []byte) {
+func ParseNode(node common.Hash, depth int, callback func(common.Hash) []byte) error {
 	if depth > 4 {
-		return
+		return nil
 	}
 	buf := callback(node)
 	//fmt.Println("callback", node, len(buf), hex.EncodeToString(buf))
 	elems, _, err := rlp.SplitList(buf)
-	check(err)
-	ParseNodeInternal(elems, depth, callback)
+	if err != nil {
+		return err
+	}
+	return ParseNodeInternal(elems, depth, callback)
 }
 
-func RamFromTrie(root common.Hash) map[uint32](uint32) {
-	ram := make(map[uint32](uint32))
+func RamFromTrie(root common.Hash) (map[uint32](uint32), error) {
+	return RamFromTrieWith(root, Preimages, nil)
+}
+
+// the minigeth oracle is a process global, tries are read one at a time
+var oracleMu sync.Mutex
+
+// RamFromTrieWith rebuilds the ram from preimages, nodes missing from them come from store if not nil
+func RamFromTrieWith(root common.Hash, preimages map[common.Hash][]byte, store PreimageStore) (ram map[uint32](uint32), err error) {
+	ram = make(map[uint32](uint32))
+
+	oracleMu.Lock()
+	defer oracleMu.Unlock()
+	// the minigeth oracle panics on missing or corrupted nodes
+	defer func() {
+		if r := recover(); r != nil {
+			ram, err = nil, &TrieError{Op: "read", Err: fmt.Errorf("%v", r)}
+		}
+	}()
 
 	// load into oracle
 	pp := oracle.Preimages()
-	for k, v := range Preimages {
+	for k, v := range preimages {
 		pp[k] = v
 	}
+	if store != nil {
+		walkPreimages(root, func(hash common.Hash) ([]byte, error) {
+			if v, ok := pp[hash]; ok {
+				return v, nil
+			}
+			v, err := store.Get(hash)
+			if err == nil {
+				pp[hash] = v
+			}
+			return v, err
+		}, make(map[common.Hash]bool))
+	}
 
 	triedb := trie.Database{Root: root}
 	tt, err := trie.New(root, &triedb)
-	check(err)
+	if err != nil {
+		return nil, &TrieError{Op: "read", Err: err}
+	}
 	tni := tt.NodeIterator([]byte{})
 	for tni.Next(true) {
 		if tni.Leaf() {
@@ -117,11 +176,35 @@ func RamFromTrie(root common.Hash) map[uint32](uint32) {
 			ram[tk*4] = tv
 		}
 	}
-	return ram
+	if err := tni.Error(); err != nil {
+		return nil, &TrieError{Op: "read", Err: err}
+	}
+	return ram, nil
 }
 
+// RamToTrie writes to the package Preimages, which can not fail
 func RamToTrie(ram map[uint32](uint32)) common.Hash {
-	mt := trie.NewStackTrie(PreimageKeyValueWriter{})
+	root, _ := RamToTrieWith(ram, PreimageKeyValueWriter{})
+	return root
+}
+
+// the stack trie drops write errors, keep the first one
+type errKeyValueWriter struct {
+	ethdb.KeyValueWriter
+	err error
+}
+
+func (w *errKeyValueWriter) Put(key []byte, value []byte) error {
+	err := w.KeyValueWriter.Put(key, value)
+	if err != nil && w.err == nil {
+		w.err = err
+	}
+	return err
+}
+
+func RamToTrieWith(ram map[uint32](uint32), kw PreimageKeyValueWriter) (common.Hash, error) {
+	w := &errKeyValueWriter{KeyValueWriter: kw}
+	mt := trie.NewStackTrie(w)
 
 	sram := make([]uint64, len(ram))
 
@@ -146,5 +229,5 @@ func RamToTrie(ram map[uint32](uint32)) common.Hash {
 	/*fmt.Println("ram hash", mt.Hash())
 	fmt.Println("hash count", len(Preimages))
 	parseNode(mt.Hash(), 0)*/
-	return mt.Hash()
+	return mt.Hash(), w.err
 }
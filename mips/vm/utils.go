@@ -15,6 +15,10 @@ func ZeroRegisters(ram map[uint32](uint32)) {
 }
 
 func LoadData(dat []byte, ram map[uint32](uint32), base uint32) {
+	if len(dat)%4 != 0 {
+		// the last word is zero padded, like the mapped memory
+		dat = append(dat[:len(dat):len(dat)], make([]byte, 4-len(dat)%4)...)
+	}
 	for i := 0; i < len(dat); i += 4 {
 		value := binary.BigEndian.Uint32(dat[i : i+4])
 		if value != 0 {
@@ -23,8 +27,11 @@ func LoadData(dat []byte, ram map[uint32](uint32), base uint32) {
 	}
 }
 
-func LoadMappedFile(fn string, ram map[uint32](uint32), base uint32) {
+func LoadMappedFile(fn string, ram map[uint32](uint32), base uint32) error {
 	dat, err := ioutil.ReadFile(fn)
-	check(err)
+	if err != nil {
+		return &LoadError{What: "file", Path: fn, Err: err}
+	}
 	LoadData(dat, ram, base)
+	return nil
 }
\ No newline at end of file
@@ -10,34 +10,13 @@ import (
 	"os"
 	"path/filepath"
 	"runtime"
-	"strconv"
+	"strings"
+	"time"
 
 	"github.com/ethereum/go-ethereum/common"
 	uc "github.com/unicorn-engine/unicorn/bindings/go/unicorn"
 )
 
-func WriteCheckpoint(ram map[uint32](uint32), fn string, step int) {
-	trieroot := RamToTrie(ram)
-	dat := TrieToJson(trieroot, step)
-	fmt.Printf("writing %s len %d with root %s\n", fn, len(dat), trieroot)
-	ioutil.WriteFile(fn, dat, 0644)
-}
-
-func WriteCheckpointWithNodeIDRoot(ram map[uint32](uint32), fn string, step int, nodeID int, nodeCount int) common.Hash {
-	trieroot := RamToTrie(ram)
-	dat := TrieToJsonWithNodeID(trieroot, step, nodeID, nodeCount)
-	fmt.Printf("writing %s len %d with root %s\n", fn, len(dat), trieroot)
-	ioutil.WriteFile(fn, dat, 0644)
-	return trieroot
-}
-
-func WriteCheckpointWithNodeID(ram map[uint32](uint32), fn string, step int, nodeID int, nodeCount int) {
-	trieroot := RamToTrie(ram)
-	dat := TrieToJsonWithNodeID(trieroot, step, nodeID, nodeCount)
-	fmt.Printf("writing %s len %d with root %s\n", fn, len(dat), trieroot)
-	ioutil.WriteFile(fn, dat, 0644)
-}
-
 // memory layout in MIPS
 const (
 	INPUT_ADDR  = 0x31000000
@@ -46,10 +25,6 @@ const (
 	MAGIC_ADDR  = 0x30000800
 )
 
-var MIPS_PROGRAM = "./mlgo/ml_mips/ml_mips.bin"
-
-var ModelPath = "./llama-7b-fp32.bin"
-
 const (
 	READ_FROM_BIDENDIAN = true
 	OUTPUT_TO_BIDENDIAN = true
@@ -67,31 +42,31 @@ func IntToBytes(n int) []byte {
 	return bytesBuffer.Bytes()
 }
 
-func LoadModel(mu uc.Unicorn, file string, ram map[uint32](uint32)) {
+func LoadModel(mu uc.Unicorn, file string, ram map[uint32](uint32)) error {
 	modelBytes, err := ioutil.ReadFile(file)
 	if err != nil {
-		fmt.Println(err)
-		return
+		return &LoadError{What: "model", Path: file, Err: err}
 	}
 	modelSize := len(modelBytes)
+	if modelSize > MAX_MODEL_SIZE {
+		return &LayoutError{Region: "model", Start: MODEL_ADDR, Size: uint64(modelSize) + 4, Limit: MEM_END}
+	}
 	fmt.Println("modelSize: ", modelSize)
 	rawSize := IntToBytes(modelSize)
 	fmt.Println("rawSize: ", rawSize)
 	LoadBytesToUnicorn(mu, rawSize, ram, MODEL_ADDR)
 	LoadBytesToUnicorn(mu, modelBytes, ram, MODEL_ADDR+4)
+	return nil
 }
 
 func LoadInputData(mu uc.Unicorn, file string, ram map[uint32](uint32)) error {
 	// load a random test digit
 	buf, err := ioutil.ReadFile(file)
 	if err != nil {
-		fmt.Println(err)
-		return err
+		return &LoadError{What: "input", Path: file, Err: err}
 	}
-	if len(buf) >= 10*1024*1024 {
-		fmt.Println("data too large")
-		buf = buf[:1024]
-		// return errors.New("data too large")
+	if len(buf) > MAX_INPUT_SIZE {
+		return &LayoutError{Region: "input", Start: INPUT_ADDR, Size: uint64(len(buf)) + 4, Limit: OUTPUT_ADDR}
 	}
 	//buf is the data
 	inputSize := len(buf)
@@ -116,6 +91,14 @@ type Params struct {
 
 	MIPSVMCompatible bool
 	Prompt           string
+
+	CheckpointFormat      string
+	CheckpointCompression string
+
+	MaxSteps    int
+	MaxDuration time.Duration
+
+	Faults Faults
 }
 
 func ParseParams() *Params {
@@ -134,24 +117,37 @@ func ParseParams() *Params {
 	var mipsVMCompatible bool
 	var prompt string
 
+	var checkpointFormat string
+	var checkpointCompression string
+
+	var maxSteps int
+	var maxDuration time.Duration
+	var faults Faults
+
 	defaultBasedir := os.Getenv("BASEDIR")
 	if len(defaultBasedir) == 0 {
 		defaultBasedir = "/tmp/cannon"
 	}
 	flag.StringVar(&basedir, "basedir", defaultBasedir, "Directory to read inputs, write outputs, and cache preimage oracle data.")
 	flag.IntVar(&target, "target", -1, "Target number of instructions to execute in the trace. If < 0 will execute until termination")
-	flag.StringVar(&programPath, "program", MIPS_PROGRAM, "Path to binary file containing the program to run")
+	flag.StringVar(&programPath, "program", DEFAULT_MIPS_PROGRAM, "Path to binary file containing the program to run")
 	flag.StringVar(&modelPath, "model", "", "Path to binary file containing the AI model")
 	flag.StringVar(&inputPath, "data", "", "Path to binary file containing the input of AI model")
 	flag.BoolVar(&outputGolden, "outputGolden", false, "Do not read any inputs and instead produce a snapshot of the state prior to execution. Written to <basedir>/golden.json")
 
 	flag.BoolVar(&lastLayer, "lastLayer", false, "In the lastLayer, we run computation in VM")
 	flag.IntVar(&curLayer, "curLayer", 0, "The current layer")
-	flag.StringVar(&modelName, "modelName", "MNIST", "run MNIST or LLAMA")
+	flag.StringVar(&modelName, "modelName", MODEL_MNIST, "graph model: "+strings.Join(GraphModels(), ", "))
 	flag.IntVar(&nodeID, "nodeID", 0, "The current nodeID")
 
 	flag.BoolVar(&mipsVMCompatible, "mipsVMCompatible", false, "compatible for MIPS VM")
 	flag.StringVar(&prompt, "prompt", "How to combine AI and blockchain?", "prompt for LLaMA")
+
+	flag.StringVar(&checkpointFormat, "checkpointFormat", FORMAT_JSON, "checkpoint format, json or binary (smaller, written as .ckpt)")
+	flag.StringVar(&checkpointCompression, "checkpointCompression", "zstd", "compression of binary checkpoints: none, snappy or zstd")
+	flag.IntVar(&maxSteps, "maxSteps", 0, "stop the run with an error after this many instructions, 0 for no limit")
+	flag.DurationVar(&maxDuration, "maxDuration", 0, "stop the run with an error after this long, 0 for no limit")
+	flag.Var(&faults, "fault", "inject a fault, repeatable: reg:<step>:<reg>:<value>, mem:<step>:<addr>[:<mask>], write:<addr>:<value>, oracle:<hash|*>[:<mask>] or node:<node>:<index>[:<mask>]")
 	flag.Parse()
 
 	params := &Params{
@@ -167,46 +163,110 @@ func ParseParams() *Params {
 		NodeID:           nodeID,
 		MIPSVMCompatible: mipsVMCompatible,
 		Prompt:           prompt,
+
+		CheckpointFormat:      checkpointFormat,
+		CheckpointCompression: checkpointCompression,
+
+		MaxSteps:    maxSteps,
+		MaxDuration: maxDuration,
+
+		Faults: faults,
 	}
 
 	return params
 }
 
-func RunCheckPointZeroRoot(prompt string) (common.Hash, error) {
+// RunCheckPointZeroRoot returns the golden root of the prompt and the node count of the graph
+func (m *Machine) RunCheckPointZeroRoot(prompt string) (common.Hash, int, error) {
 	tmpDir, err := os.MkdirTemp(os.TempDir(), "opml")
 	if err != nil {
 		log.Errorf("make tmp dir error %v", err)
-		return common.Hash{}, err
+		return common.Hash{}, 0, err
 	}
 	defer os.RemoveAll(tmpDir)
 	params := &Params{
 		Target:           0,
-		ProgramPath:      MIPS_PROGRAM,
-		ModelPath:        ModelPath,
+		ProgramPath:      m.Config.ProgramPath,
+		ModelPath:        m.Config.ModelPath,
 		InputPath:        "",
 		Basedir:          tmpDir,
 		OutputGolden:     true,
 		CurLayer:         0,
 		LastLayer:        false,
-		ModelName:        "LLAMA",
+		ModelName:        MODEL_LLAMA,
 		NodeID:           0,
 		MIPSVMCompatible: true,
 		Prompt:           prompt,
+		Faults:           m.Faults,
 	}
-	nodeFile, nodeCount, err := LayerRun(params.Basedir+"/data", params.Target, "LLAMA", params)
+	nodeFile, nodeCount, err := LayerRun(params.Basedir+"/data", params.Target, params.ModelName, params)
 	if err != nil {
 		log.Errorf("layer run error: %v", err)
-		return common.Hash{}, err
+		return common.Hash{}, 0, err
 	}
-	return MIPSRunRoot(params.Basedir+"/checkpoint", 0, params.Target, MIPS_PROGRAM, nodeFile, nodeCount)
+	root, err := m.MIPSRunRoot(params.Basedir+"/checkpoint", 0, params.Target, m.Config.ProgramPath, nodeFile, nodeCount)
+	return root, nodeCount, err
 }
 
-func Run() {
+// RunMNISTRoot returns the golden root of the image and the node count of the graph
+func (m *Machine) RunMNISTRoot(image []byte) (common.Hash, int, error) {
+	tmpDir, err := os.MkdirTemp(os.TempDir(), "opml")
+	if err != nil {
+		return common.Hash{}, 0, err
+	}
+	defer os.RemoveAll(tmpDir)
+	inputPath := tmpDir + "/image"
+	if err := saveDataToFile(image, inputPath); err != nil {
+		return common.Hash{}, 0, err
+	}
+	params := &Params{
+		ModelPath: m.Config.ModelPath,
+		InputPath: inputPath,
+		Basedir:   tmpDir,
+		ModelName: MODEL_MNIST,
+		Faults:    m.Faults,
+	}
+	nodeFile, nodeCount, err := LayerRun(tmpDir+"/data", 0, params.ModelName, params)
+	if err != nil {
+		return common.Hash{}, 0, err
+	}
+	root, err := m.MIPSRunRoot(tmpDir+"/checkpoint", 0, 0, m.Config.ProgramPath, nodeFile, nodeCount)
+	return root, nodeCount, err
+}
+
+// RunNode computes the env of graph node nodeID for the prompt and runs the program on it,
+// writing the golden checkpoint and the one of step target, or the final one if target is -1
+func (m *Machine) RunNode(basedir string, prompt string, nodeID int, target int) (*RunResult, error) {
+	params := &Params{
+		ProgramPath: m.Config.ProgramPath,
+		ModelPath:   m.Config.ModelPath,
+		Basedir:     basedir,
+		ModelName:   MODEL_LLAMA,
+		NodeID:      nodeID,
+		Prompt:      prompt,
+		Faults:      m.Faults,
+	}
+	nodeFile, nodeCount, err := LayerRun(basedir+"/data", nodeID, params.ModelName, params)
+	if err != nil {
+		return nil, err
+	}
+	root, err := m.MIPSRunRoot(basedir+"/checkpoint", 0, nodeID, m.Config.ProgramPath, nodeFile, nodeCount)
+	if err != nil {
+		return nil, err
+	}
+	result, err := m.MIPSRun(basedir+"/checkpoint", target, nodeID, m.Config.ProgramPath, nodeFile, false, nodeCount)
+	if result != nil {
+		result.Root = root
+	}
+	return result, err
+}
+
+func Run() error {
 	params := ParseParams()
-	RunWithParams(params)
+	return RunWithParams(params)
 }
 
-func RunWithParams(params *Params) {
+func RunWithParams(params *Params) error {
 
 	target := params.Target
 	programPath := params.ProgramPath
@@ -219,43 +279,54 @@ func RunWithParams(params *Params) {
 	modelName := params.ModelName
 	nodeID := params.NodeID
 
-	if params.MIPSVMCompatible {
-		MIPSRunCompatible(basedir, target, programPath, modelPath, inputPath, outputGolden)
-		return
+	config := DefaultConfig()
+	config.ProgramPath = programPath
+	config.ModelPath = modelPath
+	config.MaxSteps = params.MaxSteps
+	config.MaxDuration = params.MaxDuration
+	if params.CheckpointFormat != "" {
+		config.CheckpointFormat = params.CheckpointFormat
 	}
+	if params.CheckpointCompression != "" {
+		compression, err := ParseCompression(params.CheckpointCompression)
+		if err != nil {
+			return err
+		}
+		config.CheckpointCompression = compression
+	}
+	m := NewMachine(config)
+	m.Faults = params.Faults
 
-	if !lastLayer {
+	var result *RunResult
+	var err error
+	if params.MIPSVMCompatible {
+		result, err = m.MIPSRunCompatible(basedir, target, programPath, modelPath, inputPath, outputGolden)
+	} else if !lastLayer {
 		id := target
-		nodeFile, nodeCount, err := LayerRun(basedir+"/data", id, modelName, params)
-		if err != nil {
-			fmt.Println("layer run error: ", err)
-			return
+		nodeFile, nodeCount, lerr := LayerRun(basedir+"/data", id, modelName, params)
+		if lerr != nil {
+			return fmt.Errorf("layer run: %w", lerr)
 		}
-		MIPSRun(basedir+"/checkpoint", 0, id, programPath, nodeFile, true, nodeCount)
+		result, err = m.MIPSRun(basedir+"/checkpoint", 0, id, programPath, nodeFile, true, nodeCount)
 	} else {
 		// the lastLayer
-		MIPSRun(basedir+"/checkpoint", target, nodeID, programPath, inputPath, outputGolden, 0)
+		result, err = m.MIPSRun(basedir+"/checkpoint", target, nodeID, programPath, inputPath, outputGolden, 0)
+	}
+	if result != nil {
+		os.Stdout.Write(result.Stdout)
+		os.Stderr.Write(result.Stderr)
 	}
+	return err
 
 	// step 2 (optional), validate each 1 million chunk in EVM
 
 	// step 3 (super optional) validate each 1 million chunk on chain
 
 	//RunWithRam(ram, steps, debug, nil)
-
 }
 
 func LayerRun(basedir string, nodeID int, modelName string, params *Params) (string, int, error) {
-	var envBytes []byte
-	var err error
-	var nodeCount int
-
-	if modelName == "MNIST" {
-		envBytes, nodeCount, err = MNIST(nodeID, params.ModelPath, params.InputPath)
-	} else { // if modelName == "LLAMA"
-		envBytes, nodeCount, err = LLAMA(nodeID, params.ModelPath, params.Prompt)
-	}
-
+	envBytes, nodeCount, err := RunGraphNode(modelName, nodeID, params)
 	if err != nil {
 		fmt.Println("Layer run error: ", err)
 		return "", nodeCount, err
@@ -291,75 +362,73 @@ func saveDataToFile(data []byte, filename string) error {
 	return nil
 }
 
-func MIPSRunRoot(basedir string, target int, nodeID int, programPath string, inputPath string, nodeCount int) (common.Hash, error) {
-	regfault := -1
-	regfault_str, regfault_valid := os.LookupEnv("REGFAULT")
-	if regfault_valid {
-		regfault, _ = strconv.Atoi(regfault_str)
-	}
-
+func (m *Machine) MIPSRunRoot(basedir string, target int, nodeID int, programPath string, inputPath string, nodeCount int) (common.Hash, error) {
 	// step 1, generate the checkpoints every million steps using unicorn
-	ram := make(map[uint32](uint32))
-	mu := GetHookedUnicorn(basedir, ram, func(step int, mu uc.Unicorn, ram map[uint32](uint32)) {
-		if step == regfault {
-			fmt.Printf("regfault at step %d\n", step)
-			mu.RegWrite(uc.MIPS_REG_V0, 0xbabababa)
-		}
+	m.Reset()
+	if err := CheckLayout(programPath, inputPath, ""); err != nil {
+		return common.Hash{}, err
+	}
+	mu, err := m.GetHookedUnicorn(basedir, func(step int, mu uc.Unicorn, ram map[uint32](uint32)) {
 		if step == target {
-			SyncRegs(mu, ram)
-			fn := fmt.Sprintf("%s/checkpoint_%d_%d.json", basedir, nodeID, step)
+			m.SyncRegs(mu)
+			fn := fmt.Sprintf("%s/checkpoint_%d_%d", basedir, nodeID, step)
 			err := os.MkdirAll(filepath.Dir(fn), os.ModePerm)
 			if err != nil {
-				println(err.Error())
+				m.fail(mu, err)
+				return
+			}
+			if _, err := m.WriteCheckpoint(fn, step, nodeID, nodeCount); err != nil {
+				m.fail(mu, err)
 				return
 			}
-			WriteCheckpointWithNodeID(ram, fn, step, nodeID, nodeCount)
 			if step == target {
 				// done
 				mu.RegWrite(uc.MIPS_REG_PC, 0x5ead0004)
 			}
 		}
 	})
+	if err != nil {
+		return common.Hash{}, err
+	}
 	defer func() {
 		mu.Close()
 		runtime.GC()
 	}()
 
-	ZeroRegisters(ram)
+	ZeroRegisters(m.Ram)
 	// not ready for golden yet
-	LoadMappedFileUnicorn(mu, programPath, ram, 0)
+	if err := m.LoadProgramUnicorn(mu, programPath); err != nil {
+		return common.Hash{}, err
+	}
 	// load input
 	if inputPath != "" {
-		LoadInputData(mu, inputPath, ram)
+		if err := LoadInputData(mu, inputPath, m.Ram); err != nil {
+			return common.Hash{}, err
+		}
 	}
 
-	hash := WriteCheckpointWithNodeIDRoot(ram, fmt.Sprintf("%s/%d_golden.json", basedir, nodeID), -1, nodeID, nodeCount)
-	return hash, nil
+	return m.WriteCheckpoint(fmt.Sprintf("%s/%d_golden", basedir, nodeID), -1, nodeID, nodeCount)
 }
 
-func MIPSRun(basedir string, target int, nodeID int, programPath string, inputPath string, outputGolden bool, nodeCount int) {
-	regfault := -1
-	regfault_str, regfault_valid := os.LookupEnv("REGFAULT")
-	if regfault_valid {
-		regfault, _ = strconv.Atoi(regfault_str)
-	}
-
+func (m *Machine) MIPSRun(basedir string, target int, nodeID int, programPath string, inputPath string, outputGolden bool, nodeCount int) (*RunResult, error) {
 	// step 1, generate the checkpoints every million steps using unicorn
-	ram := make(map[uint32](uint32))
+	m.Reset()
+	if err := CheckLayout(programPath, inputPath, ""); err != nil {
+		return nil, err
+	}
 
 	lastStep := 1
 	reachFinalState := true // if the target >= total step, the targt will not be saved
 
-	mu := GetHookedUnicorn(basedir, ram, func(step int, mu uc.Unicorn, ram map[uint32](uint32)) {
-		if step == regfault {
-			fmt.Printf("regfault at step %d\n", step)
-			mu.RegWrite(uc.MIPS_REG_V0, 0xbabababa)
-		}
+	mu, err := m.GetHookedUnicorn(basedir, func(step int, mu uc.Unicorn, ram map[uint32](uint32)) {
 		if step == target {
 			reachFinalState = false
-			SyncRegs(mu, ram)
-			fn := fmt.Sprintf("%s/checkpoint_%d_%d.json", basedir, nodeID, step)
-			WriteCheckpointWithNodeID(ram, fn, step, nodeID, nodeCount)
+			m.SyncRegs(mu)
+			fn := fmt.Sprintf("%s/checkpoint_%d_%d", basedir, nodeID, step)
+			if _, err := m.WriteCheckpoint(fn, step, nodeID, nodeCount); err != nil {
+				m.fail(mu, err)
+				return
+			}
 			if step == target {
 				// done
 				mu.RegWrite(uc.MIPS_REG_PC, 0x5ead0004)
@@ -367,62 +436,91 @@ func MIPSRun(basedir string, target int, nodeID int, programPath string, inputPa
 		}
 		lastStep = step + 1
 	})
+	if err != nil {
+		return nil, err
+	}
+	defer mu.Close()
 
-	ZeroRegisters(ram)
+	ZeroRegisters(m.Ram)
 	// not ready for golden yet
-	LoadMappedFileUnicorn(mu, programPath, ram, 0)
+	if err := m.LoadProgramUnicorn(mu, programPath); err != nil {
+		return nil, err
+	}
 	// load input
 	if inputPath != "" {
-		LoadInputData(mu, inputPath, ram)
+		if err := LoadInputData(mu, inputPath, m.Ram); err != nil {
+			return nil, err
+		}
 	}
+	m.TrackRam()
 
 	if outputGolden {
-		WriteCheckpointWithNodeID(ram, fmt.Sprintf("%s/%d_golden.json", basedir, nodeID), -1, nodeID, nodeCount)
+		if _, err := m.WriteCheckpoint(fmt.Sprintf("%s/%d_golden", basedir, nodeID), -1, nodeID, nodeCount); err != nil {
+			return nil, err
+		}
 		fmt.Println("Writing golden snapshot and exiting early without execution")
-		return
+		return m.Result()
 	}
 
 	// do not need if we just run pure computation task
 	// LoadMappedFileUnicorn(mu, fmt.Sprintf("%s/input", basedir), ram, 0x30000000)
 
-	mu.Start(0, 0x5ead0004)
+	if err := m.startTrace(nodeID, 0); err != nil {
+		return nil, err
+	}
+	defer m.stopTrace(mu)
+	if err := m.Start(mu, 0, 0x5ead0004); err != nil {
+		// what the guest wrote before failing
+		result, _ := m.Result()
+		return result, err
+	}
 
+	var final common.Hash
 	if reachFinalState {
 		fmt.Printf("reach the final state, total step: %d, target: %d\n", lastStep, target)
-		WriteCheckpointWithNodeID(ram, fmt.Sprintf("%s/checkpoint_%d_%d.json", basedir, nodeID, lastStep), lastStep, nodeID, nodeCount)
+		final, err = m.WriteCheckpoint(fmt.Sprintf("%s/checkpoint_%d_%d", basedir, nodeID, lastStep), lastStep, nodeID, nodeCount)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	if target == -1 {
 
 		fmt.Println("lastStep: ", lastStep)
-		WriteCheckpointWithNodeID(ram, fmt.Sprintf("%s/checkpoint_%d_final.json", basedir, nodeID), lastStep, nodeID, nodeCount)
+		if _, err := m.WriteCheckpoint(fmt.Sprintf("%s/checkpoint_%d_final", basedir, nodeID), lastStep, nodeID, nodeCount); err != nil {
+			return nil, err
+		}
 
 	}
-}
-
-func MIPSRunCompatible(basedir string, target int, programPath string, modelPath string, inputPath string, outputGolden bool) {
-	regfault := -1
-	regfault_str, regfault_valid := os.LookupEnv("REGFAULT")
-	if regfault_valid {
-		regfault, _ = strconv.Atoi(regfault_str)
+	if err := m.stopTrace(mu); err != nil {
+		return nil, err
+	}
+	result, err := m.Result()
+	if result != nil {
+		result.Final = final
 	}
+	return result, err
+}
 
+func (m *Machine) MIPSRunCompatible(basedir string, target int, programPath string, modelPath string, inputPath string, outputGolden bool) (*RunResult, error) {
 	// step 1, generate the checkpoints every million steps using unicorn
-	ram := make(map[uint32](uint32))
+	m.Reset()
+	if err := CheckLayout(programPath, inputPath, modelPath); err != nil {
+		return nil, err
+	}
 
 	lastStep := 1
 	reachFinalState := true // if the target >= total step, the targt will not be saved
 
-	mu := GetHookedUnicorn(basedir, ram, func(step int, mu uc.Unicorn, ram map[uint32](uint32)) {
-		if step == regfault {
-			fmt.Printf("regfault at step %d\n", step)
-			mu.RegWrite(uc.MIPS_REG_V0, 0xbabababa)
-		}
+	mu, err := m.GetHookedUnicorn(basedir, func(step int, mu uc.Unicorn, ram map[uint32](uint32)) {
 		if step == target {
 			reachFinalState = false
-			SyncRegs(mu, ram)
-			fn := fmt.Sprintf("%s/checkpoint_%d.json", basedir, step)
-			WriteCheckpoint(ram, fn, step)
+			m.SyncRegs(mu)
+			fn := fmt.Sprintf("%s/checkpoint_%d", basedir, step)
+			if _, err := m.WriteCheckpoint(fn, step, 0, 0); err != nil {
+				m.fail(mu, err)
+				return
+			}
 			if step == target {
 				// done
 				mu.RegWrite(uc.MIPS_REG_PC, 0x5ead0004)
@@ -430,38 +528,67 @@ func MIPSRunCompatible(basedir string, target int, programPath string, modelPath
 		}
 		lastStep = step + 1
 	})
+	if err != nil {
+		return nil, err
+	}
+	defer mu.Close()
 
-	ZeroRegisters(ram)
+	ZeroRegisters(m.Ram)
 	// not ready for golden yet
-	LoadMappedFileUnicorn(mu, programPath, ram, 0)
+	if err := m.LoadProgramUnicorn(mu, programPath); err != nil {
+		return nil, err
+	}
 	// load input
 	if inputPath != "" {
-		LoadInputData(mu, inputPath, ram)
+		if err := LoadInputData(mu, inputPath, m.Ram); err != nil {
+			return nil, err
+		}
+	}
+	if err := LoadModel(mu, modelPath, m.Ram); err != nil {
+		return nil, err
 	}
-	LoadModel(mu, modelPath, ram)
+	m.TrackRam()
 
 	if outputGolden {
-		WriteCheckpoint(ram, fmt.Sprintf("%s/golden.json", basedir), -1)
+		if _, err := m.WriteCheckpoint(fmt.Sprintf("%s/golden", basedir), -1, 0, 0); err != nil {
+			return nil, err
+		}
 		fmt.Println("Writing golden snapshot and exiting early without execution")
-		return
+		return m.Result()
 	}
 
 	// do not need if we just run pure computation task
 	// LoadMappedFileUnicorn(mu, fmt.Sprintf("%s/input", basedir), ram, 0x30000000)
 
-	SyncRegs(mu, ram)
-	mu.Start(0, 0x5ead0004)
-	SyncRegs(mu, ram)
+	if err := m.startTrace(0, 0); err != nil {
+		return nil, err
+	}
+	defer m.stopTrace(mu)
+	m.SyncRegs(mu)
+	if err := m.Start(mu, 0, 0x5ead0004); err != nil {
+		// what the guest wrote before failing
+		result, _ := m.Result()
+		return result, err
+	}
+	m.SyncRegs(mu)
 
 	if reachFinalState {
 		fmt.Printf("reach the final state, total step: %d, target: %d\n", lastStep, target)
-		WriteCheckpoint(ram, fmt.Sprintf("%s/checkpoint_%d.json", basedir, lastStep), lastStep)
+		if _, err := m.WriteCheckpoint(fmt.Sprintf("%s/checkpoint_%d", basedir, lastStep), lastStep, 0, 0); err != nil {
+			return nil, err
+		}
 	}
 
 	if target == -1 {
 
 		fmt.Println("lastStep: ", lastStep)
-		WriteCheckpoint(ram, fmt.Sprintf("%s/checkpoint_final.json", basedir), lastStep)
-		fmt.Printf("PC: %x\n", ram[0xC0000080])
+		if _, err := m.WriteCheckpoint(fmt.Sprintf("%s/checkpoint_final", basedir), lastStep, 0, 0); err != nil {
+			return nil, err
+		}
+		fmt.Printf("PC: %x\n", m.Ram[0xC0000080])
+	}
+	if err := m.stopTrace(mu); err != nil {
+		return nil, err
 	}
+	return m.Result()
 }
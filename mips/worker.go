@@ -1,46 +1,80 @@
 package mips
 
 import (
-	"bufio"
-	"bytes"
-	"errors"
 	"fmt"
 	"opml-opt/callback"
 	"opml-opt/common"
 	"opml-opt/log"
 	"opml-opt/mips/vm"
-	"os"
-	"os/exec"
-	"strings"
+	"opml-opt/models"
+	"runtime/debug"
+	"strconv"
 	"sync"
-
-	ethCommon "github.com/ethereum/go-ethereum/common"
 )
 
-var ConfigPath string
-
 var MipsWork *Worker
 
 type Worker struct {
 	ModelName string
-	ModelPath string
+	Config    *vm.Config
 	JobsNum   int32
 	MaxJobs   int32
 	mut       sync.Mutex
+	rootCache *vm.RootCache
+	// transcripts of the answers are committed and saved here if not empty
+	TranscriptDir string
+	// tokens of the answers of the mlgo graph
+	AnswerTokens int
 }
 
-func InitWorker(modelName string, modelPath string, programPath string) error {
+const (
+	DefaultRootCacheSize = 1024
+	DefaultAnswerTokens  = 8
+)
+
+// InitWorker runs up to maxJobs machines at once in process, 1 if maxJobs is 0
+func InitWorker(modelName string, config *vm.Config, maxJobs int32) error {
+	if maxJobs <= 0 {
+		maxJobs = 1
+	}
 	MipsWork = &Worker{
 		ModelName: modelName,
-		ModelPath: modelPath,
+		Config:    config,
 		JobsNum:   0,
-		MaxJobs:   1,
+		MaxJobs:   maxJobs,
+
+		AnswerTokens: DefaultAnswerTokens,
 	}
-	vm.ModelPath = modelPath
-	vm.MIPS_PROGRAM = programPath
+	callback.Finish = finish
 	return nil
 }
 
+// InitRootCache enables the golden root cache, persisted at path if it is not empty
+func InitRootCache(path string, size int) error {
+	if size == 0 {
+		size = DefaultRootCacheSize
+	}
+	cache, err := vm.NewRootCache(path, size)
+	if err != nil {
+		return err
+	}
+	MipsWork.rootCache = cache
+	return nil
+}
+
+// InitAnswerTokens generates mlgo answers of up to tokens tokens, compared token by token
+// with the llama.cpp answers in the check modes
+func InitAnswerTokens(tokens int) {
+	if tokens > 0 {
+		MipsWork.AnswerTokens = tokens
+	}
+}
+
+// InitTranscripts commits the transcript of every answer, saved in dir
+func InitTranscripts(dir string) {
+	MipsWork.TranscriptDir = dir
+}
+
 func Status() int {
 	jobsNum := MipsWork.JobsNum
 	if jobsNum > MipsWork.MaxJobs {
@@ -50,47 +84,218 @@ func Status() int {
 	}
 }
 
-func Inference(qa common.OptQA) error {
+// startJob takes a job slot, false if they are all taken
+func (w *Worker) startJob() bool {
+	w.mut.Lock()
+	defer w.mut.Unlock()
+	if w.JobsNum >= w.MaxJobs {
+		return false
+	}
+	w.JobsNum++
+	return true
+}
+
+func (w *Worker) doneJob() {
+	w.mut.Lock()
+	w.JobsNum -= 1
+	w.mut.Unlock()
+}
+
+// configFor runs the program and model of a registered model
+func (w *Worker) configFor(model *models.Model) *vm.Config {
+	config := *w.Config
+	config.ModelPath = model.Model.Path
+	if model.Program.Path != "" {
+		config.ProgramPath = model.Program.Path
+	}
+	return &config
+}
+
+// Inference computes the state root of the question and the mlgo answer if needed, a panic
+// of the run fails the question only
+func Inference(qa common.OptQA, model *models.Model) (err error) {
 	defer func() {
+		if r := recover(); r != nil {
+			log.With(log.Fields{ReqId: qa.ReqId, Worker: log.WORKER_MIPS}).Errorf("mips job panic: %v\n%s", r, debug.Stack())
+			qa.Err = fmt.Errorf("mips job panic: %v", r)
+			err = qa.Err
+		}
 		if qa.StateRoot == "" && qa.Err == nil {
 			qa.Err = common.ErrJobDownUnknow
 		}
 		callback.DoneWork(qa)
 	}()
 
-	MipsWork.mut.Lock()
-	if MipsWork.JobsNum >= MipsWork.MaxJobs {
-		log.Info("mips jobs exceed")
-		return common.ErrExceedMaxJobs
+	job := log.With(log.Fields{ReqId: qa.ReqId, Worker: log.WORKER_MIPS})
+	config := MipsWork.configFor(model)
+	// the cache key of the input
+	input := qa.Prompt
+	if model.Kind == models.KIND_MNIST {
+		input = string(qa.Image)
+	}
+	var entry *vm.RootEntry
+	if MipsWork.rootCache != nil {
+		cached, ok, err := MipsWork.rootCache.Get(config.ProgramPath, config.ModelPath, input)
+		if err != nil {
+			job.Phase("cache").Warn("root cache lookup error", err)
+		} else if ok {
+			job.Phase("cache").Infof("root cache hit: %s", cached.Root)
+			entry = cached
+		}
 	}
-	MipsWork.JobsNum++
-	MipsWork.mut.Unlock()
-	defer func() {
-		MipsWork.JobsNum -= 1
-	}()
 
-	log.Debugf("mips worker handling %v", qa)
-	cmd := exec.Command(os.Args[0], "mips", "--config", ConfigPath, "--prompt", qa.Prompt)
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		log.Error(err)
-	}
-	log.Info(string(output))
-	if cmd.ProcessState.Success() {
-		scanner := bufio.NewScanner(bytes.NewBuffer(output))
-		for scanner.Scan() {
-			line := scanner.Text()
-			if strings.Contains(line, "ok:") {
-				hexStr := strings.TrimLeft(strings.Trim(line, "\n"), "ok: 0x")
-				qa.StateRoot = ethCommon.HexToHash(hexStr).String()
-				return nil
+	if entry == nil || needsAnswer(entry, model) || needsTranscript(entry, model) {
+		if !MipsWork.startJob() {
+			job.Info("mips jobs exceed")
+			qa.Err = common.ErrExceedMaxJobs
+			return qa.Err
+		}
+		defer MipsWork.doneJob()
+
+		job.Phase("run").Debugf("handling job of model %s, prompt of %d bytes, image of %d bytes", qa.Model, len(qa.Prompt), len(qa.Image))
+		var err error
+		entry, err = run(config, model, qa, entry)
+		if err != nil {
+			job.Phase("run").Error("mips run failed", err)
+			qa.Err = err
+			return err
+		}
+		if MipsWork.rootCache != nil {
+			err := MipsWork.rootCache.Put(config.ProgramPath, config.ModelPath, input, *entry)
+			if err != nil {
+				job.Phase("cache").Warn("root cache update error", err)
 			}
 		}
-		if err := scanner.Err(); err != nil {
-			qa.Err = fmt.Errorf("error reading child process output:%v", err)
-			return fmt.Errorf("error reading child process output:%v", err)
+	}
+
+	qa.StateRoot = entry.Root.String()
+	qa.MlgoAnswer = entry.Answer
+	qa.ModelPath = config.ModelPath
+	qa.PromptTokens = entry.PromptTokens
+	qa.MlgoTokens = entry.Tokens
+	qa.NodeRoots = entry.NodeRoots
+	// mnist models answer from their graph only
+	if common.AnswerMode == common.ANSWER_MLGO || model.Kind == models.KIND_MNIST {
+		qa.Answer = entry.Answer
+		qa.AnswerBackend = common.BACKEND_MLGO
+	}
+	return nil
+}
+
+func needsTranscriptRoot() bool {
+	return MipsWork.TranscriptDir != ""
+}
+
+// transcripts commit to tokens, mnist models have none
+func needsTranscript(entry *vm.RootEntry, model *models.Model) bool {
+	return needsTranscriptRoot() && model.Kind == models.KIND_LLAMA && (entry.NodeRoots == nil || entry.PromptTokens == nil)
+}
+
+func needsAnswer(entry *vm.RootEntry, model *models.Model) bool {
+	if model.Kind == models.KIND_MNIST {
+		return entry.Answer == ""
+	}
+	return common.MlgoAnswerNeeded() && entry.MaxTokens < MipsWork.AnswerTokens
+}
+
+// run computes what the cached entry misses: the golden root, the mlgo answer and the
+// node roots of the transcripts if needed
+func run(config *vm.Config, model *models.Model, qa common.OptQA, entry *vm.RootEntry) (*vm.RootEntry, error) {
+	m := vm.NewMachine(config)
+	if model.Kind == models.KIND_MNIST {
+		return runMNIST(m, qa.Image, entry)
+	}
+	prompt := qa.Prompt
+	if entry == nil {
+		root, nodeCount, err := m.RunCheckPointZeroRoot(prompt)
+		if err != nil {
+			return nil, err
+		}
+		entry = &vm.RootEntry{Root: root, NodeCount: nodeCount}
+	}
+	if !needsAnswer(entry, model) && !needsTranscript(entry, model) {
+		return entry, nil
+	}
+	// the prompt tokens of a transcript are those of the first token
+	count := 1
+	if needsAnswer(entry, model) {
+		count = MipsWork.AnswerTokens
+	}
+	answer, err := vm.LLAMAAnswer(config.ModelPath, prompt, count)
+	if err != nil {
+		return nil, err
+	}
+	if needsAnswer(entry, model) {
+		entry.Answer, entry.Tokens, entry.MaxTokens = answer.Text, answer.Tokens, count
+	}
+	entry.PromptTokens = answer.PromptTokens
+	if needsTranscript(entry, model) {
+		entry.NodeRoots, err = m.RunNodeRoots(prompt, entry.NodeCount)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return entry, nil
+}
+
+// finish checks the llama.cpp answer of a question against the mlgo one, token by token,
+// and commits the transcript of the final answer, once both workers are done
+func finish(qa *common.OptQA) error {
+	checked := common.AnswerChecked() && qa.AnswerBackend == common.BACKEND_LLAMACPP
+	committed := needsTranscriptRoot() && qa.NodeRoots != nil
+	// mnist answers have no tokens
+	if qa.PromptTokens == nil || !checked && !committed {
+		return nil
+	}
+	var tokens []uint32
+	if qa.AnswerBackend == common.BACKEND_LLAMACPP {
+		var err error
+		tokens, err = vm.AnswerTokens(qa.ModelPath, qa.Prompt, qa.PromptTokens, qa.Answer)
+		if err != nil {
+			return err
+		}
+	}
+	if checked {
+		qa.CheckAnswer(tokens)
+		if !*qa.Consistent {
+			log.With(log.Fields{ReqId: qa.ReqId, Phase: "check"}).Warnf("answer disagrees with the mlgo graph, mlgo answer %q", qa.MlgoAnswer)
+		}
+	}
+	if !committed {
+		return nil
+	}
+	if qa.AnswerBackend == common.BACKEND_MLGO {
+		tokens = qa.MlgoTokens
+	}
+	t := &vm.Transcript{
+		PromptTokens: qa.PromptTokens,
+		Tokens:       tokens,
+		NodeCount:    len(qa.NodeRoots),
+		NodeRoots:    qa.NodeRoots,
+	}
+	root, err := vm.WriteTranscript(t, MipsWork.TranscriptDir)
+	if err != nil {
+		return err
+	}
+	qa.TranscriptRoot = root.String()
+	return nil
+}
+
+// runMNIST computes the golden root of the image and the predicted digit
+func runMNIST(m *vm.Machine, image []byte, entry *vm.RootEntry) (*vm.RootEntry, error) {
+	if entry == nil {
+		root, nodeCount, err := m.RunMNISTRoot(image)
+		if err != nil {
+			return nil, err
+		}
+		entry = &vm.RootEntry{Root: root, NodeCount: nodeCount}
+	}
+	if entry.Answer == "" {
+		digit, err := vm.MNISTAnswer(m.Config.ModelPath, image)
+		if err != nil {
+			return nil, err
 		}
+		entry.Answer = strconv.Itoa(digit)
 	}
-	qa.Err = errors.New("mips run failed")
-	return errors.New("mips run failed")
+	return entry, nil
 }
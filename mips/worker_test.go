@@ -0,0 +1,105 @@
+package mips
+
+import (
+	"opml-opt/common"
+	"opml-opt/log"
+	"opml-opt/mips/vm"
+	"opml-opt/models"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	ethcommon "github.com/ethereum/go-ethereum/common"
+)
+
+func TestFinishCommitsAnswerTokens(t *testing.T) {
+	dir := t.TempDir()
+	MipsWork = &Worker{TranscriptDir: dir}
+	defer func() { MipsWork = nil }()
+	qa := common.OptQA{
+		Answer:        " world, how are",
+		AnswerBackend: common.BACKEND_MLGO,
+		PromptTokens:  []uint32{1, 15043},
+		MlgoTokens:    []uint32{3186, 29892, 920, 526},
+		NodeRoots:     []ethcommon.Hash{ethcommon.HexToHash("0x0a"), ethcommon.HexToHash("0x0b")},
+	}
+	if err := finish(&qa); err != nil {
+		t.Fatal(err)
+	}
+	tr, err := vm.ReadTranscript(filepath.Join(dir, ethcommon.HexToHash(qa.TranscriptRoot).Hex()+".json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tr.Tokens) != 4 || tr.NodeCount != 2 || tr.Root().String() != qa.TranscriptRoot {
+		t.Fatalf("got transcript %+v of root %s", tr, qa.TranscriptRoot)
+	}
+
+	// a different token after the first one is another transcript
+	other := qa
+	other.MlgoTokens = []uint32{3186, 29892, 920, 527}
+	if err := finish(&other); err != nil {
+		t.Fatal(err)
+	}
+	if other.TranscriptRoot == qa.TranscriptRoot {
+		t.Fatal("last token not committed")
+	}
+}
+
+func TestCollectPreimages(t *testing.T) {
+	dir := t.TempDir()
+	store := vm.NewDiskPreimageStore(filepath.Join(dir, "preimages"))
+	MipsWork = &Worker{Config: &vm.Config{Store: store}, MaxJobs: 1}
+	defer func() { MipsWork = nil }()
+	cache, err := vm.NewRootCache("", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	MipsWork.rootCache = cache
+
+	cached, _ := store.Put([]byte("cached root"))
+	nodeRoot, _ := store.Put([]byte("node root"))
+	checkpointed, _ := store.Put([]byte("checkpoint root"))
+	garbage, _ := store.Put([]byte("garbage"))
+	program := filepath.Join(dir, "program.bin")
+	os.WriteFile(program, []byte("program"), 0644)
+	err = cache.Put(program, program, "hello", vm.RootEntry{Root: cached, NodeRoots: []ethcommon.Hash{nodeRoot}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkpoints := filepath.Join(dir, "checkpoint")
+	os.MkdirAll(checkpoints, os.ModePerm)
+	c := &vm.Checkpoint{Root: checkpointed, Step: -1, Preimages: map[ethcommon.Hash][]byte{}}
+	if _, err := vm.WriteCheckpointFile(c, filepath.Join(checkpoints, "0_golden.json"), vm.FORMAT_JSON, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	MipsWork.JobsNum = 1
+	if _, err := CollectPreimages([]string{checkpoints}); err != common.ErrExceedMaxJobs {
+		t.Fatalf("collected while a job runs: %v", err)
+	}
+	MipsWork.JobsNum = 0
+	removed, err := CollectPreimages([]string{checkpoints})
+	if err != nil || removed != 1 {
+		t.Fatalf("removed %d: %v", removed, err)
+	}
+	for _, hash := range []ethcommon.Hash{cached, nodeRoot, checkpointed} {
+		if !store.Has(hash) {
+			t.Errorf("live preimage %s removed", hash)
+		}
+	}
+	if store.Has(garbage) || MipsWork.JobsNum != 0 {
+		t.Errorf("garbage kept or job slots not released")
+	}
+}
+
+func TestInferencePanicFailsJob(t *testing.T) {
+	log.InitLog(log.InfoLog)
+	// a worker without a vm config panics in the job
+	MipsWork = &Worker{MaxJobs: 1}
+	defer func() { MipsWork = nil }()
+	err := Inference(common.OptQA{ReqId: "req", Model: "llama", Prompt: "hello"}, &models.Model{Name: "llama", Kind: models.KIND_LLAMA})
+	if err == nil || !strings.Contains(err.Error(), "panic") {
+		t.Fatalf("expected the panic as the job error, got %v", err)
+	}
+}
@@ -0,0 +1,314 @@
+package models
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// default gguf model of llama.cpp, for configs without a model registry
+const DefaultGGUFPath = "./llama-2-7b-chat.Q2_K.gguf"
+
+// PinnedFile is a file with its expected hashes, an empty hash is not checked
+type PinnedFile struct {
+	Path   string `yaml:"path"`
+	Keccak string `yaml:"keccak"`
+	Sha256 string `yaml:"sha256"`
+}
+
+// kinds of models
+const (
+	KIND_LLAMA = "llama" // answers prompts
+	KIND_MNIST = "mnist" // classifies 28x28 images of digits
+)
+
+// Model is a served model: the fp32 model of mlgo whose graph is committed, the gguf model
+// answering with llama.cpp and the mips program running the graph nodes
+type Model struct {
+	Name    string     `yaml:"name"`
+	Kind    string     `yaml:"kind"` // llama if empty
+	Model   PinnedFile `yaml:"model"`
+	GGUF    PinnedFile `yaml:"gguf"`
+	Program PinnedFile `yaml:"program"`
+}
+
+type Registry struct {
+	Models map[string]*Model
+	// the model of the questions without one
+	Default string
+}
+
+// the served registry, the jobs running on each model, the registry of a pending swap and
+// the models it replaces
+var (
+	mu       sync.Mutex
+	released = sync.NewCond(&mu)
+	swapMu   sync.Mutex
+	current  *Registry
+	next     *Registry
+	inflight = make(map[*Model]int)
+	retiring map[*Model]bool
+)
+
+// the registries to swap in, in the order they were loaded
+var (
+	reloads    = make(chan *Registry, 16)
+	reloadOnce sync.Once
+)
+
+// NewRegistry indexes the models by name, the first one is the default
+func NewRegistry(models []Model) (*Registry, error) {
+	if len(models) == 0 {
+		return nil, fmt.Errorf("no model")
+	}
+	r := &Registry{Models: make(map[string]*Model)}
+	for i := range models {
+		m := models[i]
+		if m.Name == "" {
+			return nil, fmt.Errorf("model %d has no name", i)
+		}
+		if m.Model.Path == "" {
+			return nil, fmt.Errorf("model %s has no model path", m.Name)
+		}
+		if m.Kind == "" {
+			m.Kind = KIND_LLAMA
+		}
+		if m.Kind != KIND_LLAMA && m.Kind != KIND_MNIST {
+			return nil, fmt.Errorf("model %s of unknown kind %s", m.Name, m.Kind)
+		}
+		if _, ok := r.Models[m.Name]; ok {
+			return nil, fmt.Errorf("model %s listed twice", m.Name)
+		}
+		r.Models[m.Name] = &m
+	}
+	r.Default = models[0].Name
+	return r, nil
+}
+
+// Get returns the model of name, the default one if name is empty
+func (r *Registry) Get(name string) (*Model, error) {
+	if name == "" {
+		name = r.Default
+	}
+	m, ok := r.Models[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown model %s", name)
+	}
+	return m, nil
+}
+
+// Names lists the models, the default first
+func (r *Registry) Names() []string {
+	names := []string{r.Default}
+	for name := range r.Models {
+		if name != r.Default {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// Verify checks that the files of every model exist and match their pinned hashes, the
+// gguf models only if llama.cpp answers
+func (r *Registry) Verify(llamaCpp bool) error {
+	for _, m := range r.Models {
+		if err := m.Verify(llamaCpp); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// UsesGGUF tells if llama.cpp answers with the gguf model, mnist models answer from their graph
+func (m *Model) UsesGGUF(llamaCpp bool) bool {
+	return llamaCpp && m.Kind == KIND_LLAMA
+}
+
+func (m *Model) Verify(llamaCpp bool) error {
+	for _, f := range []struct {
+		what string
+		file PinnedFile
+	}{{"model", m.Model}, {"gguf", m.GGUF}, {"program", m.Program}} {
+		if f.file.Path == "" || f.what == "gguf" && !m.UsesGGUF(llamaCpp) {
+			continue
+		}
+		if err := f.file.Verify(); err != nil {
+			return fmt.Errorf("model %s %s: %w", m.Name, f.what, err)
+		}
+	}
+	return nil
+}
+
+func (f PinnedFile) Verify() error {
+	if f.Keccak == "" && f.Sha256 == "" {
+		_, err := os.Stat(f.Path)
+		return err
+	}
+	_, err := f.Digest()
+	return err
+}
+
+// the digests of the files hashed, by path, reused while their size and mtime are unchanged
+var (
+	digestMu sync.Mutex
+	digests  = make(map[string]fileDigest)
+)
+
+type fileDigest struct {
+	size    int64
+	modTime time.Time
+	keccak  common.Hash
+	sha256  string
+}
+
+// Digest checks the file against its pins and returns its keccak. The file is read once,
+// the digests of the pin check are reused while the file is unchanged.
+func (f PinnedFile) Digest() (common.Hash, error) {
+	d, err := digestFile(f.Path)
+	if err != nil {
+		return common.Hash{}, err
+	}
+	keccak, sha := d.keccak, d.sha256
+	if f.Keccak != "" && !sameHex(keccak.Hex(), f.Keccak) {
+		return keccak, fmt.Errorf("%s keccak %s, expected %s", f.Path, keccak.Hex(), f.Keccak)
+	}
+	if f.Sha256 != "" && !sameHex(sha, f.Sha256) {
+		return keccak, fmt.Errorf("%s sha256 %s, expected %s", f.Path, sha, f.Sha256)
+	}
+	return keccak, nil
+}
+
+func digestFile(fn string) (fileDigest, error) {
+	fi, err := os.Stat(fn)
+	if err != nil {
+		return fileDigest{}, err
+	}
+	digestMu.Lock()
+	d, ok := digests[fn]
+	digestMu.Unlock()
+	if ok && d.size == fi.Size() && d.modTime.Equal(fi.ModTime()) {
+		return d, nil
+	}
+	file, err := os.Open(fn)
+	if err != nil {
+		return fileDigest{}, err
+	}
+	defer file.Close()
+	k := crypto.NewKeccakState()
+	s := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(k, s), file); err != nil {
+		return fileDigest{}, err
+	}
+	d = fileDigest{size: fi.Size(), modTime: fi.ModTime(), sha256: hex.EncodeToString(s.Sum(nil))}
+	k.Read(d.keccak[:])
+	digestMu.Lock()
+	digests[fn] = d
+	digestMu.Unlock()
+	return d, nil
+}
+
+func sameHex(a string, b string) bool {
+	return strings.EqualFold(strings.TrimPrefix(a, "0x"), strings.TrimPrefix(b, "0x"))
+}
+
+// Acquire returns the served model of name for a job, to Release when the job is done.
+// During a swap the incoming model is served, a model the swap removes takes no new job
+// so that its jobs drain.
+func Acquire(name string) (*Model, error) {
+	mu.Lock()
+	defer mu.Unlock()
+	if current == nil {
+		return nil, fmt.Errorf("no model registry")
+	}
+	m, err := current.Get(name)
+	if next != nil && (err != nil || retiring[m]) {
+		if n, nerr := next.Get(name); nerr == nil {
+			m, err = n, nil
+		} else if err == nil {
+			return nil, fmt.Errorf("model %s is being removed", m.Name)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	inflight[m]++
+	return m, nil
+}
+
+func Release(m *Model) {
+	mu.Lock()
+	defer mu.Unlock()
+	inflight[m]--
+	if inflight[m] <= 0 {
+		delete(inflight, m)
+	}
+	released.Broadcast()
+}
+
+// Served returns the served registry
+func Served() *Registry {
+	mu.Lock()
+	defer mu.Unlock()
+	return current
+}
+
+// Reload swaps r in after the registries reloaded before it, without waiting
+func Reload(r *Registry) {
+	reloadOnce.Do(func() {
+		go func() {
+			for r := range reloads {
+				Swap(r)
+			}
+		}()
+	})
+	reloads <- r
+}
+
+// Swap serves r once the jobs on the models it changes or removes are done, the
+// unchanged models keep serving meanwhile and the changed ones are served from r
+func Swap(r *Registry) {
+	swapMu.Lock()
+	defer swapMu.Unlock()
+	mu.Lock()
+	defer mu.Unlock()
+	next = r
+	retiring = make(map[*Model]bool)
+	if current != nil {
+		for name, m := range current.Models {
+			if n, ok := r.Models[name]; !ok || *n != *m {
+				retiring[m] = true
+			}
+		}
+	}
+	for busy() {
+		released.Wait()
+	}
+	// the unchanged models keep their entry, and the count of their jobs
+	if current != nil {
+		for name, m := range current.Models {
+			if !retiring[m] {
+				r.Models[name] = m
+			}
+		}
+	}
+	current = r
+	next = nil
+	retiring = nil
+}
+
+func busy() bool {
+	for m := range retiring {
+		if inflight[m] > 0 {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,217 @@
+package models
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"opml-opt/mips/vm"
+)
+
+func TestRegistry(t *testing.T) {
+	model := filepath.Join(t.TempDir(), "model.bin")
+	ioutil.WriteFile(model, []byte("model"), 0644)
+	keccak, err := vm.HashFile(model)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sha, err := sha256File(model)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewRegistry([]Model{
+		{Name: "llama-7b", Model: PinnedFile{Path: model, Keccak: keccak.Hex()}},
+		{Name: "mnist", Model: PinnedFile{Path: model, Sha256: "0x" + sha}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m, err := r.Get(""); err != nil || m.Name != "llama-7b" {
+		t.Fatalf("default model: %v %v", m, err)
+	}
+	if _, err := r.Get("gpt"); err == nil {
+		t.Fatal("expected an error for an unknown model")
+	}
+	if err := r.Verify(true); err != nil {
+		t.Fatal(err)
+	}
+
+	ioutil.WriteFile(model, []byte("tampered"), 0644)
+	for _, name := range []string{"llama-7b", "mnist"} {
+		m, _ := r.Get(name)
+		if err := m.Verify(true); err == nil {
+			t.Fatalf("%s: tampered model verified", name)
+		}
+	}
+
+	if _, err := NewRegistry([]Model{{Name: "a", Model: PinnedFile{Path: model}}, {Name: "a", Model: PinnedFile{Path: model}}}); err == nil {
+		t.Fatal("expected an error for a duplicate model")
+	}
+}
+
+func sha256File(fn string) (string, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func TestSwapWaitsForJobs(t *testing.T) {
+	old, _ := NewRegistry([]Model{{Name: "a", Model: PinnedFile{Path: "a1"}}, {Name: "b", Model: PinnedFile{Path: "b"}}})
+	Swap(old)
+	a, err := Acquire("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	next, _ := NewRegistry([]Model{{Name: "a", Model: PinnedFile{Path: "a2"}}, {Name: "b", Model: PinnedFile{Path: "b"}}})
+	done := make(chan struct{})
+	go func() {
+		Swap(next)
+		close(done)
+	}()
+	// the incoming model is served once the swap is pending
+	for {
+		m, err := Acquire("a")
+		if err != nil {
+			t.Fatal(err)
+		}
+		Release(m)
+		if m.Model.Path == "a2" {
+			break
+		}
+	}
+	b, err := Acquire("b")
+	if err != nil {
+		t.Fatalf("unchanged model not served during the swap: %v", err)
+	}
+	select {
+	case <-done:
+		t.Fatal("swapped with a job running")
+	default:
+	}
+
+	Release(a)
+	<-done
+	if a, err := Acquire("a"); err != nil || a.Model.Path != "a2" {
+		t.Fatalf("got %v %v", a, err)
+	} else {
+		Release(a)
+	}
+	if m, _ := Served().Get("b"); m != b {
+		t.Fatal("unchanged model entry replaced")
+	}
+	Release(b)
+}
+
+func TestReloadInOrder(t *testing.T) {
+	old, _ := NewRegistry([]Model{{Name: "a", Model: PinnedFile{Path: "a1"}}, {Name: "c", Model: PinnedFile{Path: "c"}}})
+	Swap(old)
+	c, err := Acquire("c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the first reload waits for the job on the removed model c
+	first, _ := NewRegistry([]Model{{Name: "a", Model: PinnedFile{Path: "a2"}}})
+	second, _ := NewRegistry([]Model{{Name: "a", Model: PinnedFile{Path: "a3"}}})
+	Reload(first)
+	Reload(second)
+	// the removed model takes no new job once its swap is pending, the swap still waits
+	for {
+		m, err := Acquire("c")
+		if err != nil {
+			if !strings.Contains(err.Error(), "being removed") {
+				t.Fatal(err)
+			}
+			break
+		}
+		Release(m)
+		time.Sleep(time.Millisecond)
+	}
+	if m, _ := Served().Get("a"); m.Model.Path != "a1" {
+		t.Fatalf("swapped to %s with a job running", m.Model.Path)
+	}
+	Release(c)
+	for i := 0; i < 1000; i++ {
+		if m, _ := Served().Get("a"); m.Model.Path == "a3" {
+			if _, err := Served().Get("c"); err == nil {
+				t.Fatal("removed model still served")
+			}
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	m, _ := Served().Get("a")
+	t.Fatalf("serving %s after the reloads", m.Model.Path)
+}
+
+func TestVerifyGGUF(t *testing.T) {
+	dir := t.TempDir()
+	model := filepath.Join(dir, "model.bin")
+	ioutil.WriteFile(model, []byte("model"), 0644)
+	missing := PinnedFile{Path: filepath.Join(dir, "missing.gguf")}
+	llama := &Model{Name: "llama", Kind: KIND_LLAMA, Model: PinnedFile{Path: model}, GGUF: missing}
+	mnist := &Model{Name: "mnist", Kind: KIND_MNIST, Model: PinnedFile{Path: model}, GGUF: missing}
+	if err := llama.Verify(true); err == nil {
+		t.Fatal("missing gguf verified for llama.cpp")
+	}
+	if err := llama.Verify(false); err != nil {
+		t.Fatalf("gguf checked without llama.cpp: %v", err)
+	}
+	if err := mnist.Verify(true); err != nil {
+		t.Fatalf("gguf of an mnist model checked: %v", err)
+	}
+}
+
+func TestDigest(t *testing.T) {
+	model := filepath.Join(t.TempDir(), "model.bin")
+	ioutil.WriteFile(model, []byte("model"), 0644)
+	keccak, _ := vm.HashFile(model)
+	sha, _ := sha256File(model)
+	for _, f := range []PinnedFile{
+		{Path: model},
+		{Path: model, Keccak: keccak.Hex()},
+		{Path: model, Sha256: sha},
+	} {
+		if digest, err := f.Digest(); err != nil || digest != keccak {
+			t.Fatalf("%+v: got %s %v", f, digest, err)
+		}
+	}
+	if _, err := (PinnedFile{Path: model, Sha256: keccak.Hex()}).Digest(); err == nil {
+		t.Fatal("wrong sha256 pin verified")
+	}
+}
+
+func TestDigestReused(t *testing.T) {
+	model := filepath.Join(t.TempDir(), "model.bin")
+	ioutil.WriteFile(model, []byte("model"), 0644)
+	f := PinnedFile{Path: model}
+	keccak, err := f.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the digest of an unchanged file is not computed again
+	d := digests[model]
+	d.keccak[0] ^= 1
+	digests[model] = d
+	if again, _ := f.Digest(); again != d.keccak {
+		t.Fatalf("digest computed again: %s", again)
+	}
+	// a changed file is hashed
+	ioutil.WriteFile(model, []byte("tampered"), 0644)
+	if changed, _ := f.Digest(); changed == keccak || changed == d.keccak {
+		t.Fatalf("stale digest %s of a changed file", changed)
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"opml-opt/mips"
+
+	cli "gopkg.in/urfave/cli.v1"
+)
+
+var checkpointsFlag = cli.StringSliceFlag{
+	Name:  "checkpoints",
+	Usage: "dir of checkpoints whose preimages are kept, repeatable, preimage_gc_checkpoints if not set",
+}
+
+var commandPreimages = cli.Command{
+	Name:  "preimages",
+	Usage: "manage the preimage store of preimage_dir",
+	Subcommands: []cli.Command{
+		{
+			Name:  "gc",
+			Usage: "remove the preimages no cached root or checkpoint reaches",
+			Description: `The roots of the root_cache entries and of the checkpoints under the --checkpoints dirs
+are live, with the trie nodes they reference. Run it while no operator writes the store.`,
+			Flags:  []cli.Flag{configPathFlag, setFlag, checkpointsFlag},
+			Action: CollectPreimages,
+		},
+	},
+}
+
+func CollectPreimages(ctx *cli.Context) error {
+	conf := loadConfig(ctx)
+	if conf.PreimageDir == "" {
+		return fmt.Errorf("no preimage_dir to collect")
+	}
+	if err := mips.InitWorker(conf.ModelName, conf.VMConfig(), conf.MipsMaxJobs); err != nil {
+		return err
+	}
+	if err := mips.InitRootCache(conf.RootCachePath, 0); err != nil {
+		return err
+	}
+	dirs := ctx.StringSlice(checkpointsFlag.Name)
+	if len(dirs) == 0 {
+		dirs = conf.PreimageGCCheckpoints
+	}
+	removed, err := mips.CollectPreimages(dirs)
+	if err != nil {
+		return err
+	}
+	fmt.Println("removed:", removed)
+	return nil
+}
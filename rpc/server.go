@@ -3,14 +3,20 @@ package rpc
 import (
 	"context"
 	"crypto/sha256"
+	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
+	"expvar"
+	"fmt"
+	"net"
 	"net/http"
 	"opml-opt/callback"
 	"opml-opt/common"
 	"opml-opt/llamago"
 	"opml-opt/log"
 	"opml-opt/mips"
+	"opml-opt/mips/vm"
+	"opml-opt/models"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -18,7 +24,6 @@ import (
 
 	"github.com/gin-contrib/pprof"
 	"github.com/gin-gonic/gin"
-	"github.com/google/uuid"
 )
 
 const InternalError = "internal server error"
@@ -29,6 +34,11 @@ const (
 	ErrorCodeReadReq   = -501
 	ErrorCodeParseReq  = -502
 	ErrorCodeUnmarshal = -503
+	ErrorCodePrompt    = -504
+	ErrorCodeModel     = -505
+	ErrorCodeReload    = -506
+	ErrorCodeImage     = -507
+	ErrorCodeVerify    = -508
 )
 
 var Host = "127.0.0.1"
@@ -50,7 +60,8 @@ type Service struct {
 	pendingQuestion atomic.Int32
 }
 
-var NodeID = uuid.NewString()
+// the node id of the callbacks and the log lines
+var NodeID = common.NodeID
 
 func InitRpcService(port string, modelName, modelPath string) {
 	once.Do(func() {
@@ -85,9 +96,13 @@ func (c *Service) Start(ctx context.Context) error {
 	r.GET("/healthcheck", func(c *gin.Context) {
 		c.String(http.StatusOK, "ok")
 	})
+	r.GET("/debug/vars", loopbackOnly, gin.WrapH(expvar.Handler()))
+
+	r.POST("/admin/reload", loopbackOnly, c.HandleReload)
 
 	apiV1 := r.Group("/api/v1/")
 	apiV1.POST("/question", c.HandleQuestion)
+	apiV1.POST("/verify", c.HandleVerify)
 	apiV1.GET("/status", c.HandleStatus)
 
 	address := "0.0.0.0:" + c.port
@@ -107,6 +122,35 @@ type QuestionReq struct {
 	Model    string `json:"model"`
 	CallBack string `json:"callback"`
 	ReqId    string `json:"req_id"`
+	Image    Image  `json:"image"` // for mnist models
+}
+
+// Image is a 28x28 grayscale image, a base64 string or an array of 784 bytes
+type Image []byte
+
+func (i *Image) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		dat, err := base64.StdEncoding.DecodeString(s)
+		if err != nil {
+			return err
+		}
+		*i = dat
+		return nil
+	}
+	var pixels []int
+	if err := json.Unmarshal(b, &pixels); err != nil {
+		return err
+	}
+	dat := make([]byte, len(pixels))
+	for j, p := range pixels {
+		if p < 0 || p > 255 {
+			return fmt.Errorf("pixel %d out of range: %d", j, p)
+		}
+		dat[j] = byte(p)
+	}
+	*i = dat
+	return nil
 }
 
 type QuestionResp struct {
@@ -129,40 +173,79 @@ func (s *Service) HandleQuestion(c *gin.Context) {
 		}
 	}()
 	req := QuestionReq{}
-	c.BindJSON(&req)
+	if err := c.ShouldBindJSON(&req); err != nil {
+		rep.ResultCode = ErrorCodeUnmarshal
+		rep.ResultMsg = err.Error()
+		return
+	}
+	// the mips run loads the graph node of the prompt in a fixed memory region
+	if err := vm.CheckPrompt(req.Prompt); err != nil {
+		rep.ResultCode = ErrorCodePrompt
+		rep.ResultMsg = fmt.Sprintf("prompt longer than %d bytes", vm.MAX_PROMPT_LENGTH)
+		return
+	}
+	model, err := models.Acquire(req.Model)
+	if err != nil {
+		rep.ResultCode = ErrorCodeModel
+		rep.ResultMsg = err.Error()
+		return
+	}
+	if model.Kind == models.KIND_MNIST && len(req.Image) != vm.MNIST_IMAGE_SIZE {
+		models.Release(model)
+		rep.ResultCode = ErrorCodeImage
+		rep.ResultMsg = fmt.Sprintf("image of %d bytes, expected %d", len(req.Image), vm.MNIST_IMAGE_SIZE)
+		return
+	}
 	reqId := req.ReqId
 	qa := common.OptQA{
 		ReqId:     reqId,
-		Model:     req.Model,
+		Model:     model.Name,
 		Prompt:    req.Prompt,
 		Answer:    "",
 		StateRoot: "",
 		StartTime: time.Now().Unix(),
 		CallBack:  req.CallBack,
+		Image:     req.Image,
 	}
 
+	job := log.With(log.Fields{ReqId: reqId})
 	if llamago.LlamaWorker.JobsNum >= llamago.LlamaWorker.MaxJobs || mips.MipsWork.JobsNum >= mips.MipsWork.MaxJobs {
-		log.Info("job exceed")
+		job.Info("job exceed")
 		rep = Resp{
 			ResultCode: -1,
 			ResultMsg:  "jobs exceed",
 			ResultBody: "",
 		}
+		models.Release(model)
 		return
 	}
 
+	// the model is released once both jobs are done, a reload waits for it
+	var jobs sync.WaitGroup
+	// the mips worker answers from the mlgo graph in mlgo mode and for mnist
+	if common.AnswerMode != common.ANSWER_MLGO && model.Kind == models.KIND_LLAMA {
+		jobs.Add(1)
+		go func() {
+			defer jobs.Done()
+			err := llamago.Inference(qa, model)
+			if err != nil {
+				job.With(log.Fields{Worker: log.WORKER_LLAMA}).Warn("llamago inference error", err)
+			}
+		}()
+	}
+
+	jobs.Add(1)
 	go func() {
-		err := llamago.Inference(qa)
+		defer jobs.Done()
+		err := mips.Inference(qa, model)
 		if err != nil {
-			log.Warn("llamago inference error", err)
+			job.With(log.Fields{Worker: log.WORKER_MIPS}).Warn("mips inference error", err)
 		}
 	}()
-
 	go func() {
-		err := mips.Inference(qa)
-		if err != nil {
-			log.Warn("mips inference error", err)
-		}
+		jobs.Wait()
+		models.Release(model)
+		callback.Forget(reqId)
 	}()
 
 	data, _ := json.Marshal(QuestionResp{
@@ -177,6 +260,112 @@ func (s *Service) HandleQuestion(c *gin.Context) {
 	}
 }
 
+// VerifyReq is a claimed state root to check, a callback payload is one
+type VerifyReq struct {
+	Model     string `json:"model"`
+	Prompt    string `json:"prompt"`
+	StateRoot string `json:"state_root"`
+	ReqId     string `json:"req_id"`
+	// the verdict is posted here
+	CallBack string `json:"callback"`
+}
+
+type VerifyResp struct {
+	NodeId string `json:"node_id"`
+	ReqId  string `json:"req_id"`
+	*mips.Verdict
+}
+
+// HandleVerify recomputes the golden root of a claim, the verdict is posted to the callback
+// of the request
+func (s *Service) HandleVerify(c *gin.Context) {
+	rep := Resp{
+		ResultCode: ErrorCodeUnknow,
+		ResultMsg:  InternalError,
+		ResultBody: "",
+	}
+	defer func() {
+		if rep.ResultCode == Success {
+			c.JSON(http.StatusOK, rep)
+		} else {
+			c.JSON(http.StatusBadRequest, rep)
+		}
+	}()
+	req := VerifyReq{}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		rep.ResultCode = ErrorCodeUnmarshal
+		rep.ResultMsg = err.Error()
+		return
+	}
+	// a run is too long to hold the request
+	if req.CallBack == "" {
+		rep.ResultCode = ErrorCodeVerify
+		rep.ResultMsg = "callback is required"
+		return
+	}
+	model, err := models.Acquire(req.Model)
+	if err != nil {
+		rep.ResultCode = ErrorCodeModel
+		rep.ResultMsg = err.Error()
+		return
+	}
+	if mips.MipsWork.JobsNum >= mips.MipsWork.MaxJobs {
+		models.Release(model)
+		rep = Resp{
+			ResultCode: -1,
+			ResultMsg:  "jobs exceed",
+			ResultBody: "",
+		}
+		return
+	}
+	verify := func() (*VerifyResp, error) {
+		defer models.Release(model)
+		verdict, err := mips.Verify(model, req.Prompt, req.StateRoot)
+		if err != nil {
+			return nil, err
+		}
+		return &VerifyResp{NodeId: NodeID, ReqId: req.ReqId, Verdict: verdict}, nil
+	}
+
+	job := log.With(log.Fields{ReqId: req.ReqId, Worker: log.WORKER_MIPS, Phase: "verify"})
+	go func() {
+		resp, err := verify()
+		if err != nil {
+			job.Warn("verify error", err)
+			return
+		}
+		body, _ := json.Marshal(resp)
+		if _, err := callback.DoPost(req.CallBack, string(body), callback.CALLBACK_TIMEOUT); err != nil {
+			job.Phase("callback").Errorf("verify callback post error %v: %v", req.CallBack, err)
+		}
+	}()
+	data, _ := json.Marshal(QuestionResp{NodeId: NodeID, ReqId: req.ReqId})
+	rep = Resp{ResultCode: Success, ResultBody: string(data)}
+}
+
+// Reload reloads the config, set by the operator
+var Reload func() error
+
+// loopbackOnly rejects the requests of other hosts, for the admin and debug routes
+func loopbackOnly(c *gin.Context) {
+	if !net.ParseIP(c.ClientIP()).IsLoopback() {
+		c.AbortWithStatusJSON(http.StatusForbidden, Resp{ResultCode: ErrorCodeUnknow, ResultMsg: "forbidden"})
+	}
+}
+
+// HandleReload reloads the config, routed for local requests only
+func (s *Service) HandleReload(c *gin.Context) {
+	if Reload == nil {
+		c.JSON(http.StatusNotFound, Resp{ResultCode: ErrorCodeUnknow, ResultMsg: "reload not supported"})
+		return
+	}
+	if err := Reload(); err != nil {
+		c.JSON(http.StatusBadRequest, Resp{ResultCode: ErrorCodeReload, ResultMsg: err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, Resp{ResultCode: Success, ResultMsg: "reloading"})
+}
+
 type StatusResp struct {
 	Status int    `json:"status"`
 	NodeId string `json:"node_id"`
@@ -0,0 +1,72 @@
+package rpc
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"expvar"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestImageUnmarshal(t *testing.T) {
+	image := []byte{0, 128, 255}
+	var req QuestionReq
+	if err := json.Unmarshal([]byte(`{"image":"`+base64.StdEncoding.EncodeToString(image)+`"}`), &req); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(req.Image, image) {
+		t.Fatalf("base64: got %v", req.Image)
+	}
+	req = QuestionReq{}
+	if err := json.Unmarshal([]byte(`{"image":[0,128,255]}`), &req); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(req.Image, image) {
+		t.Fatalf("array: got %v", req.Image)
+	}
+	if err := json.Unmarshal([]byte(`{"image":[256]}`), &req); err == nil {
+		t.Fatal("expected an error for a pixel out of range")
+	}
+}
+
+func TestVerifyNeedsCallback(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest("POST", "/api/v1/verify", strings.NewReader(`{"prompt":"hello","state_root":"0x01"}`))
+	(&Service{}).HandleVerify(c)
+	var rep Resp
+	if err := json.Unmarshal(w.Body.Bytes(), &rep); err != nil {
+		t.Fatal(err)
+	}
+	if rep.ResultCode != ErrorCodeVerify {
+		t.Fatalf("got %+v", rep)
+	}
+}
+
+func TestDebugVarsLoopbackOnly(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/debug/vars", loopbackOnly, gin.WrapH(expvar.Handler()))
+	for _, tt := range []struct {
+		remote string
+		code   int
+	}{
+		{"127.0.0.1:4000", http.StatusOK},
+		{"[::1]:4000", http.StatusOK},
+		{"203.0.113.7:4000", http.StatusForbidden},
+	} {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/debug/vars", nil)
+		req.RemoteAddr = tt.remote
+		r.ServeHTTP(w, req)
+		if w.Code != tt.code {
+			t.Fatalf("%s: got %d, expected %d", tt.remote, w.Code, tt.code)
+		}
+	}
+}
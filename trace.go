@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"opml-opt/mips/vm"
+	"strings"
+
+	cli "gopkg.in/urfave/cli.v1"
+)
+
+var (
+	fromFlag = cli.IntFlag{
+		Name:  "from",
+		Usage: "first step to print",
+	}
+	toFlag = cli.IntFlag{
+		Name:  "to",
+		Usage: "step to stop at, -1 for the end of the trace",
+		Value: -1,
+	}
+)
+
+var commandTrace = cli.Command{
+	Name:      "trace",
+	Usage:     "print the steps of an execution trace, recorded with mips_trace_dir",
+	ArgsUsage: "<trace>",
+	Flags:     []cli.Flag{fromFlag, toFlag},
+	Action:    PrintTrace,
+}
+
+// PrintTrace prints a step a line: step, pc, instruction, then the registers, memory words
+// and syscall it wrote
+func PrintTrace(ctx *cli.Context) error {
+	if ctx.NArg() != 1 {
+		return fmt.Errorf("trace takes a trace file")
+	}
+	t, err := vm.OpenTrace(ctx.Args().First())
+	if err != nil {
+		return err
+	}
+	defer t.Close()
+	return t.Range(ctx.Int(fromFlag.Name), ctx.Int(toFlag.Name), func(r *vm.TraceRecord) error {
+		var b strings.Builder
+		fmt.Fprintf(&b, "%d %08x %08x", r.Step, r.PC, r.Insn)
+		for _, w := range r.Regs {
+			fmt.Fprintf(&b, " %s=%08x", vm.REG_NAMES[w.Reg], w.Value)
+		}
+		for _, w := range r.Mems {
+			fmt.Fprintf(&b, " [%08x]=%08x", w.Addr, w.Value)
+		}
+		if r.Syscall != nil {
+			fmt.Fprintf(&b, " syscall %d v0=%x", r.Syscall.Number, r.Syscall.V0)
+		}
+		fmt.Println(b.String())
+		return nil
+	})
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"opml-opt/common"
+	"opml-opt/mips"
+	"opml-opt/models"
+	"os"
+
+	cli "gopkg.in/urfave/cli.v1"
+)
+
+var (
+	payloadFlag = cli.StringFlag{
+		Name:  "payload",
+		Usage: "file of the callback payload to check, - for stdin",
+	}
+	rootFlag = cli.StringFlag{
+		Name:  "root",
+		Usage: "claimed state root, over the one of the payload",
+	}
+)
+
+var commandVerify = cli.Command{
+	Name:  "verify",
+	Usage: "recompute the golden root of a prompt and compare it to a claimed state root",
+	Description: `The model of the claim is looked up in the config, its files are checked against their
+pins. The verdict is printed as json, the exit status is 1 if the claim is wrong.`,
+	Flags: []cli.Flag{
+		configPathFlag,
+		setFlag,
+		payloadFlag,
+		modelFlag,
+		promptFlag,
+		rootFlag,
+	},
+	Action: RunVerify,
+}
+
+func RunVerify(ctx *cli.Context) error {
+	var claim common.CallbackReq
+	if fn := ctx.String(payloadFlag.Name); fn != "" {
+		var b []byte
+		var err error
+		if fn == "-" {
+			b, err = io.ReadAll(os.Stdin)
+		} else {
+			b, err = os.ReadFile(fn)
+		}
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal(b, &claim); err != nil {
+			return fmt.Errorf("payload: %w", err)
+		}
+	}
+	// the flags override the payload, the prompt flag has a default
+	if ctx.IsSet(modelFlag.Name) {
+		claim.Model = ctx.String(modelFlag.Name)
+	}
+	if ctx.IsSet(promptFlag.Name) || ctx.String(payloadFlag.Name) == "" {
+		claim.Prompt = ctx.String(promptFlag.Name)
+	}
+	if ctx.IsSet(rootFlag.Name) {
+		claim.StateRoot = ctx.String(rootFlag.Name)
+	}
+
+	conf := loadConfig(ctx)
+	registry, err := models.NewRegistry(conf.ModelList())
+	if err != nil {
+		return err
+	}
+	model, err := registry.Get(claim.Model)
+	if err != nil {
+		return err
+	}
+	if err := mips.InitWorker(conf.ModelName, conf.VMConfig(), 1); err != nil {
+		return err
+	}
+	verdict, err := mips.Verify(model, claim.Prompt, claim.StateRoot)
+	if err != nil {
+		return err
+	}
+	if err := json.NewEncoder(os.Stdout).Encode(verdict); err != nil {
+		return err
+	}
+	if !verdict.Valid {
+		return fmt.Errorf("state root mismatch: claimed %s, computed %s", verdict.ClaimedRoot, verdict.StateRoot)
+	}
+	return nil
+}